@@ -130,11 +130,12 @@ def fetch_products():
         with DaprClient() as d:
             response = d.invoke_method(
                 app_id='stock-management-app',
-                method_name='products',
+                method_name='v1/products',
                 http_verb='GET'
             )
             if response.status_code == 200:
-                products_data = response.json()
+                # The stock service wraps results in a versioned envelope: { apiVersion, status, data }
+                products_data = response.json().get("data", [])
                 logging.info("Products successfully fetched.")
                 return [Product.from_dict(prod) for prod in products_data]
             else:
@@ -188,11 +189,11 @@ def fetch_product_details(product_ids):
                 logging.info(f"Fetching details for product ID: {product_id}")
                 response = d.invoke_method(
                     app_id='stock-management-app',
-                    method_name=f'product/{product_id}',
+                    method_name=f'v1/product/{product_id}',
                     http_verb='GET'
                 )
                 if response.status_code == 200:
-                    product_detail = response.json()
+                    product_detail = response.json().get("data")
                     logging.info(f"Details fetched for product ID {product_id}: {product_detail}")
                     products.append(product_detail)
                 else:
@@ -0,0 +1,508 @@
+// stock-management-app/audit.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Audited actions
+const (
+	auditActionCreate = "create"
+	auditActionUpdate = "update"
+	auditActionAdmin  = "admin"
+)
+
+// auditStreamAdmin holds a tenant's admin actions, product changes are kept per product
+const auditStreamAdmin = "admin"
+
+// auditAppendAttempts bounds how often an append that lost an ETag race is retried
+const auditAppendAttempts = 3
+
+// auditActorSystem is credited with changes made outside of a request and without an actor
+const auditActorSystem = "system"
+
+// Limits of the entries returned by GET /admin/audit
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// fieldChange is a product field a change modified, by its JSON name
+type fieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// auditEntry records who changed what and when. Product changes carry the version of the
+// product they produced, admin actions the route and the status it answered with.
+type auditEntry struct {
+	Action    string        `json:"action"`
+	ProductId int           `json:"productId,omitempty"`
+	Actor     string        `json:"actor"`
+	Timestamp time.Time     `json:"timestamp"`
+	RequestId string        `json:"requestId,omitempty"`
+	Changes   []fieldChange `json:"changes,omitempty"`
+	Product   *Product      `json:"product,omitempty"`
+	Route     string        `json:"route,omitempty"`
+	Status    int           `json:"status,omitempty"`
+}
+
+// auditStore keeps the audit entries of the tenant ctx is scoped to in streams, one per
+// product and one for admin actions. Entries are returned oldest first.
+type auditStore interface {
+	Append(ctx context.Context, stream string, entry auditEntry) error
+	Entries(ctx context.Context, stream string) ([]auditEntry, error)
+}
+
+// productAuditStream is the stream holding the versions of a product, every change but those
+// that only move its stock
+func productAuditStream(id int) string {
+	return "product-" + strconv.Itoa(id)
+}
+
+// productStockAuditStream holds the changes of a product that only moved its stock, kept apart
+// so stock updates do not push its versions out of the history
+func productStockAuditStream(id int) string {
+	return productAuditStream(id) + "-stock"
+}
+
+// daprAuditStore keeps each stream under one state store key, trimmed to AUDIT_HISTORY_LIMIT entries
+type daprAuditStore struct {
+	client dapr.Client
+	// locks serialise appends to a stream within this process, the ETag guards against other replicas
+	locks streamLocks
+}
+
+func newDaprAuditStore(client dapr.Client) *daprAuditStore {
+	return &daprAuditStore{client: client, locks: streamLocks{locks: make(map[string]*streamLock)}}
+}
+
+// streamLocks hands out a mutex per stream, so appends only wait for appends to the same stream
+type streamLocks struct {
+	mu    sync.Mutex
+	locks map[string]*streamLock
+}
+
+type streamLock struct {
+	sync.Mutex
+	// holders counts who holds or waits for the lock, it is dropped when none are left
+	holders int
+}
+
+// lock locks a stream and returns the function unlocking it
+func (l *streamLocks) lock(key string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &streamLock{}
+		l.locks[key] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.mu.Lock()
+		if lock.holders--; lock.holders == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (s *daprAuditStore) Append(ctx context.Context, stream string, entry auditEntry) error {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return err
+	}
+	key := auditKey(tenant, stream)
+
+	defer s.locks.lock(key)()
+	for attempt := 1; ; attempt++ {
+		entries, etag, err := s.read(ctx, key)
+		if err != nil {
+			return err
+		}
+		entries = trimAuditEntries(append(entries, entry))
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+
+		// First-write concurrency also rejects creating a stream another replica just created
+		err = s.client.SaveStateWithETag(ctx, config().StateStoreName, key, data, etag, map[string]string{},
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if err == nil {
+			return nil
+		}
+		if status.Code(err) != codes.Aborted || attempt == auditAppendAttempts {
+			return wrapStateStoreError(fmt.Errorf("failed to append to audit stream %s: %w", key, err))
+		}
+		slog.DebugContext(ctx, "Audit stream changed while appending, retrying", "key", key, "attempt", attempt)
+	}
+}
+
+func (s *daprAuditStore) Entries(ctx context.Context, stream string) ([]auditEntry, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := s.read(ctx, auditKey(tenant, stream))
+	return entries, err
+}
+
+func (s *daprAuditStore) read(ctx context.Context, key string) ([]auditEntry, string, error) {
+	item, err := s.client.GetState(ctx, config().StateStoreName, key, nil)
+	if err != nil {
+		return nil, "", wrapStateStoreError(fmt.Errorf("failed to read audit stream %s: %w", key, err))
+	}
+	entries := make([]auditEntry, 0)
+	if item.Value == nil {
+		return entries, "", nil
+	}
+	if err := json.Unmarshal(item.Value, &entries); err != nil {
+		return nil, "", fmt.Errorf("failed to decode audit stream %s: %v", key, err)
+	}
+	return entries, item.Etag, nil
+}
+
+// memoryAuditStore keeps audit streams in memory, alongside memoryProductRepository
+type memoryAuditStore struct {
+	mu      sync.RWMutex
+	streams map[string][]auditEntry
+}
+
+func newMemoryAuditStore() *memoryAuditStore {
+	return &memoryAuditStore{streams: make(map[string][]auditEntry)}
+}
+
+func (s *memoryAuditStore) Append(ctx context.Context, stream string, entry auditEntry) error {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := auditKey(tenant, stream)
+	s.streams[key] = trimAuditEntries(append(s.streams[key], entry))
+	return nil
+}
+
+func (s *memoryAuditStore) Entries(ctx context.Context, stream string) ([]auditEntry, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(make([]auditEntry, 0), s.streams[auditKey(tenant, stream)]...), nil
+}
+
+// trimAuditEntries drops the oldest entries of a stream over AUDIT_HISTORY_LIMIT
+func trimAuditEntries(entries []auditEntry) []auditEntry {
+	if limit := config().AuditHistoryLimit; len(entries) > limit {
+		return entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// auditedProductRepository records every product write in the audit store, with the fields
+// it changed. Writes that change nothing are not recorded.
+type auditedProductRepository struct {
+	ProductRepository
+	audit auditStore
+}
+
+func newAuditedProductRepository(repo ProductRepository, audit auditStore) *auditedProductRepository {
+	return &auditedProductRepository{ProductRepository: repo, audit: audit}
+}
+
+func (r *auditedProductRepository) SaveProduct(ctx context.Context, product Product) error {
+	before, err := r.currentVersion(ctx, product.Id)
+	if err != nil {
+		return err
+	}
+	if err := r.ProductRepository.SaveProduct(ctx, product); err != nil {
+		return err
+	}
+	r.record(ctx, before, product)
+	return nil
+}
+
+// SaveProducts audits like SaveProduct. The current versions are read for the diffs; should
+// one have changed since the caller read it the transaction fails and nothing is recorded.
+func (r *auditedProductRepository) SaveProducts(ctx context.Context, products []versionedProduct) error {
+	befores := make([]*Product, len(products))
+	for i, product := range products {
+		before, err := r.currentVersion(ctx, product.Id)
+		if err != nil {
+			return err
+		}
+		befores[i] = before
+	}
+
+	if err := r.ProductRepository.SaveProducts(ctx, products); err != nil {
+		return err
+	}
+	for i, product := range products {
+		r.record(ctx, befores[i], product.Product)
+	}
+	return nil
+}
+
+// currentVersion reads a product before it is written, nil if it does not exist yet. Without
+// the current version the change could not be audited, so the write is refused.
+func (r *auditedProductRepository) currentVersion(ctx context.Context, id int) (*Product, error) {
+	before, err := r.ProductRepository.GetProduct(ctx, id)
+	switch {
+	case errors.Is(err, errProductNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return &before, nil
+}
+
+// record appends the changes of a write to the product's streams, a nil before being a create
+func (r *auditedProductRepository) record(ctx context.Context, before *Product, product Product) {
+	action := auditActionCreate
+	stream := productAuditStream(product.Id)
+	changes := diffProducts(before, product)
+	if before != nil {
+		action = auditActionUpdate
+		if len(changes) == 0 {
+			return
+		}
+		if len(changes) == 1 && changes[0].Field == "quantity" {
+			stream = productStockAuditStream(product.Id)
+		}
+	}
+	version := copyProduct(product)
+	recordAudit(ctx, r.audit, stream, auditEntry{
+		Action:    action,
+		ProductId: product.Id,
+		Changes:   changes,
+		Product:   &version,
+	})
+}
+
+// diffProducts lists the fields that differ between two versions of a product. A product that
+// did not exist before has every field it sets listed, with no previous value.
+func diffProducts(before *Product, after Product) []fieldChange {
+	var changes []fieldChange
+	newValue := reflect.ValueOf(after)
+	fields := newValue.Type()
+	for i := 0; i < fields.NumField(); i++ {
+		name, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		value := newValue.Field(i)
+		if before == nil {
+			if !value.IsZero() {
+				changes = append(changes, fieldChange{Field: name, After: value.Interface()})
+			}
+			continue
+		}
+
+		old := reflect.ValueOf(*before).Field(i)
+		if value.Kind() == reflect.Slice && value.Len() == 0 && old.Len() == 0 {
+			// A missing and an empty list of tags are the same
+			continue
+		}
+		if !reflect.DeepEqual(old.Interface(), value.Interface()) {
+			changes = append(changes, fieldChange{Field: name, Before: old.Interface(), After: value.Interface()})
+		}
+	}
+	return changes
+}
+
+type auditActorKey struct{}
+
+// withAuditActor credits changes made with ctx outside of a request, such as by a background
+// job, to actor
+func withAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// auditActor names who is making a change: the authenticated caller as method:name, the actor
+// ctx was given for background work, or the system
+func auditActor(ctx context.Context) string {
+	if p, _ := principalFromContext(ctx); p != nil {
+		return p.Method + ":" + p.Name
+	}
+	if actor, ok := ctx.Value(auditActorKey{}).(string); ok {
+		return actor
+	}
+	return auditActorSystem
+}
+
+// recordAudit appends an entry for the change being made with ctx. The change has already
+// been made, so a failure is logged rather than returned.
+func recordAudit(ctx context.Context, audit auditStore, stream string, entry auditEntry) {
+	corr, _ := ctx.Value(correlationKey{}).(correlation)
+	entry.Actor = auditActor(ctx)
+	entry.Timestamp = time.Now().UTC()
+	entry.RequestId = corr.RequestID
+
+	if err := audit.Append(ctx, stream, entry); err != nil {
+		auditWriteFailures.Inc()
+		slog.ErrorContext(ctx, "Failed to record audit entry", "stream", stream, "action", entry.Action, "actor", entry.Actor, "error", err)
+	}
+}
+
+// auditAdminActions records the admin requests that change something once they have been handled
+func auditAdminActions(audit auditStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			return
+		}
+		recordAudit(c.Request.Context(), audit, auditStreamAdmin, auditEntry{
+			Action: auditActionAdmin,
+			Route:  c.Request.Method + " " + c.FullPath(),
+			Status: c.Writer.Status(),
+		})
+	}
+}
+
+// auditFilter selects audit entries, zero values match everything
+type auditFilter struct {
+	ProductID int
+	Actor     string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
+
+func parseAuditFilter(c *gin.Context) (auditFilter, error) {
+	filter := auditFilter{Actor: c.Query("actor"), Limit: defaultAuditLimit}
+
+	if value := c.Query("productId"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 1 {
+			return filter, fmt.Errorf("invalid productId value %q", value)
+		}
+		filter.ProductID = id
+	}
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s value %q: expected an RFC 3339 timestamp", name, value)
+			}
+			*target = t
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			return filter, fmt.Errorf("invalid limit value %q: expected 1 to %d", value, maxAuditLimit)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// matches reports whether an entry passes every filter that is set
+func (f auditFilter) matches(entry auditEntry) bool {
+	if f.ProductID != 0 && entry.ProductId != f.ProductID {
+		return false
+	}
+	if f.Actor != "" && entry.Actor != f.Actor {
+		return false
+	}
+	if !f.From.IsZero() && entry.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && entry.Timestamp.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// listAuditEntries returns the tenant's audit entries, newest first.
+// Query parameters: productId, actor, from and to (RFC 3339) and limit.
+func listAuditEntries(c *gin.Context, repo ProductRepository, audit auditStore) {
+	ctx := c.Request.Context()
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		abortWithError(c, newBadRequestError("%v", err))
+		return
+	}
+
+	streams := []string{productAuditStream(filter.ProductID), productStockAuditStream(filter.ProductID)}
+	if filter.ProductID == 0 {
+		productIDs, err := repo.GetProductIDs(ctx)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		streams = []string{auditStreamAdmin}
+		for _, id := range productIDs {
+			streams = append(streams, productAuditStream(id), productStockAuditStream(id))
+		}
+	}
+
+	entries := make([]auditEntry, 0)
+	for _, stream := range streams {
+		streamEntries, err := audit.Entries(ctx, stream)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		for _, entry := range streamEntries {
+			if filter.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.After(entries[j].Timestamp) })
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	respond(c, http.StatusOK, entries, "")
+}
+
+// getProductHistory returns the recorded versions of a product, newest first. Changes that only
+// moved its stock are left out, GET /admin/audit lists them.
+func getProductHistory(c *gin.Context, repo ProductRepository, audit auditStore) {
+	productIDStr := c.Param("productid")
+	productID, err := strconv.Atoi(productIDStr)
+	if err != nil {
+		abortWithError(c, newBadRequestError("Invalid product ID %q", productIDStr))
+		return
+	}
+
+	if _, err := repo.GetProduct(c.Request.Context(), productID); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	entries, err := audit.Entries(c.Request.Context(), productAuditStream(productID))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	respond(c, http.StatusOK, entries, "")
+}
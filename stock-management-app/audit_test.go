@@ -0,0 +1,42 @@
+// stock-management-app/audit_test.go
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestDaprAuditStoreKeepsConcurrentAppends(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	_, client := connectSidecar(t)
+	store := newDaprAuditStore(client)
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+
+	streams := []string{productAuditStream(1), productStockAuditStream(1), auditStreamAdmin}
+	const appends = 10
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		for i := 0; i < appends; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := store.Append(ctx, stream, auditEntry{Actor: "test"}); err != nil {
+					t.Errorf("Append(%s): %v", stream, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, stream := range streams {
+		entries, err := store.Entries(ctx, stream)
+		if err != nil || len(entries) != appends {
+			t.Errorf("stream %s has %d entries (%v), want %d", stream, len(entries), err, appends)
+		}
+	}
+	if len(store.locks.locks) != 0 {
+		t.Errorf("%d stream locks kept after the appends", len(store.locks.locks))
+	}
+}
@@ -0,0 +1,583 @@
+// stock-management-app/auth.go
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	commonv1pb "github.com/dapr/dapr/pkg/proto/common/v1"
+	runtimev1pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Roles granted to callers
+const (
+	roleReader       = "reader"
+	roleMerchandiser = "merchandiser"
+	roleInventory    = "inventory"
+	roleAdmin        = "admin"
+)
+
+// impliedRoles are the roles that come with each role
+var impliedRoles = map[string][]string{
+	roleReader:       nil,
+	roleMerchandiser: {roleReader},
+	roleInventory:    {roleReader},
+	roleAdmin:        {roleReader, roleMerchandiser, roleInventory},
+}
+
+// Credential headers, also read from gRPC metadata in lower case
+const (
+	apiKeyHeader    = "X-API-Key"
+	daprTokenHeader = "dapr-api-token"
+)
+
+// jwtClockSkew is tolerated when checking the expiry and not-before times of a token
+const jwtClockSkew = time.Minute
+
+// daprCallbackPrefix prefixes the gRPC methods the sidecar calls on the app
+const daprCallbackPrefix = "/dapr.proto.runtime.v1."
+
+// grpcMethodRoles is the role each RPC requires. Methods that are not listed, such as server
+// reflection, are open.
+var grpcMethodRoles = map[string]string{
+	CatalogService_GetProduct_FullMethodName:          roleReader,
+	CatalogService_ListProducts_FullMethodName:        roleReader,
+	CatalogService_UpsertProduct_FullMethodName:       roleMerchandiser,
+	InventoryService_ApplyStockUpdates_FullMethodName: roleInventory,
+	InventoryService_WatchStock_FullMethodName:        roleReader,
+}
+
+// principal is the authenticated caller of a request
+type principal struct {
+	Name   string
+	Method string
+	Roles  []string
+	// Tenant is the only tenant the caller may work on. Empty lets it pick any, but only
+	// crossTenant callers may while several tenants are served.
+	Tenant string
+}
+
+// hasRole reports whether the principal holds role, directly or through another role
+func (p *principal) hasRole(role string) bool {
+	for _, held := range p.Roles {
+		if held == role {
+			return true
+		}
+		for _, implied := range impliedRoles[held] {
+			if implied == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// anonymousPrincipal is the caller of every request while authentication is off (AUTH_DISABLED)
+var anonymousPrincipal = &principal{Name: "anonymous", Method: "none", Roles: []string{roleAdmin}}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns the caller of the request ctx belongs to, if it was authenticated
+func principalFromContext(ctx context.Context) (*principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	return p, ok
+}
+
+// credentials are what a request presents to prove who sent it
+type credentials struct {
+	APIKey      string
+	BearerToken string
+	DaprToken   string
+}
+
+func (c credentials) empty() bool {
+	return c.APIKey == "" && c.BearerToken == "" && c.DaprToken == ""
+}
+
+func httpCredentials(h http.Header) credentials {
+	return credentials{
+		APIKey:      h.Get(apiKeyHeader),
+		BearerToken: bearerToken(h.Get("Authorization")),
+		DaprToken:   h.Get(daprTokenHeader),
+	}
+}
+
+func grpcCredentials(ctx context.Context) credentials {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	return credentials{
+		APIKey:      first(strings.ToLower(apiKeyHeader)),
+		BearerToken: bearerToken(first("authorization")),
+		DaprToken:   first(daprTokenHeader),
+	}
+}
+
+func bearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// authenticator verifies one kind of credentials. It returns nil and no error when the
+// credentials hold none of its kind, so the next authenticator can try.
+type authenticator interface {
+	authenticate(creds credentials) (*principal, error)
+}
+
+// authChain tries each authenticator in turn. Authentication is enforced unless AUTH_DISABLED
+// is set, in which case every caller is anonymous.
+type authChain struct {
+	authenticators []authenticator
+	enforced       bool
+	daprToken      daprTokenAuthenticator
+}
+
+// newAuthChain builds the authenticators configured in cfg. Callers' own credentials are
+// preferred over the Dapr app API token, which the sidecar adds to everything it forwards.
+func newAuthChain(cfg *Config) (*authChain, error) {
+	chain := &authChain{}
+	if cfg.APIKeys != "" {
+		keys, err := parseAPIKeys(cfg.APIKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API_KEYS: %v", err)
+		}
+		chain.authenticators = append(chain.authenticators, keys)
+		chain.enforced = true
+	}
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS_FILE: %v", err)
+		}
+		chain.authenticators = append(chain.authenticators, &jwtAuthenticator{
+			keys:        keys,
+			issuer:      cfg.JWTIssuer,
+			audience:    cfg.JWTAudience,
+			rolesClaim:  cfg.JWTRolesClaim,
+			tenantClaim: cfg.JWTTenantClaim,
+		})
+		chain.enforced = true
+	}
+	if cfg.AppAPIToken != "" {
+		chain.daprToken = daprTokenAuthenticator(cfg.AppAPIToken)
+		chain.authenticators = append(chain.authenticators, chain.daprToken)
+	}
+	if !chain.enforced && !cfg.AuthDisabled {
+		return nil, errors.New("no API_KEYS or JWKS_FILE configured, set AUTH_DISABLED=true to run without authentication")
+	}
+	return chain, nil
+}
+
+func (a *authChain) authenticate(creds credentials) (*principal, error) {
+	if !a.enforced {
+		return anonymousPrincipal, nil
+	}
+	for _, auth := range a.authenticators {
+		p, err := auth.authenticate(creds)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	if creds.empty() {
+		return nil, errors.New("credentials are required")
+	}
+	return nil, errors.New("credentials are not accepted")
+}
+
+// checkDaprToken verifies the app API token on calls only the sidecar makes. Without
+// APP_API_TOKEN they are refused, unless authentication is off altogether.
+func (a *authChain) checkDaprToken(creds credentials) error {
+	if a.daprToken == "" {
+		if a.enforced {
+			return errors.New("the Dapr app API token is not configured")
+		}
+		return nil
+	}
+	if p, err := a.daprToken.authenticate(creds); err != nil || p == nil {
+		return errors.New("the Dapr app API token is required")
+	}
+	return nil
+}
+
+// authenticate identifies the caller of every request on a route group and rejects requests
+// whose credentials are missing or invalid; requireRole then checks what the caller may do
+func authenticate(auth *authChain) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, err := auth.authenticate(httpCredentials(c.Request.Header))
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="stock-management-app"`)
+			abortWithError(c, newUnauthorizedError("%v", err))
+			return
+		}
+		c.Request = c.Request.WithContext(withPrincipal(c.Request.Context(), p))
+		c.Next()
+	}
+}
+
+// requireRole rejects callers that do not hold role
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := principalFromContext(c.Request.Context())
+		if !ok || !p.hasRole(role) {
+			abortWithError(c, newForbiddenError("The %s role is required", role))
+			return
+		}
+		c.Next()
+	}
+}
+
+// daprTokenMiddleware makes event deliveries and the other calls the sidecar makes to the
+// Dapr HTTP service carry the app API token
+func daprTokenMiddleware(auth *authChain, subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	routes := subscriptionRoutes(subscriptions)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if routes[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/dapr/") {
+				if err := auth.checkDaprToken(httpCredentials(r.Header)); err != nil {
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// authUnaryInterceptor enforces grpcMethodRoles. Service invocations through the sidecar need
+// the role of the invoked method; the other app callbacks need the Dapr app API token.
+func authUnaryInterceptor(auth *authChain) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := info.FullMethod
+		if in, ok := req.(*commonv1pb.InvokeRequest); ok && method == runtimev1pb.AppCallback_OnInvoke_FullMethodName {
+			method = "/" + in.GetMethod()
+		} else if strings.HasPrefix(method, daprCallbackPrefix) {
+			if err := auth.checkDaprToken(grpcCredentials(ctx)); err != nil {
+				return nil, grpcError(ctx, newUnauthorizedError("%v", err))
+			}
+			return handler(ctx, req)
+		}
+
+		ctx, err := authorizeRPC(ctx, auth, method)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// authStreamInterceptor enforces grpcMethodRoles on streaming RPCs
+func authStreamInterceptor(auth *authChain) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorizeRPC(stream.Context(), auth, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &correlatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func authorizeRPC(ctx context.Context, auth *authChain, method string) (context.Context, error) {
+	role, ok := grpcMethodRoles[method]
+	if !ok {
+		return ctx, nil
+	}
+	p, err := auth.authenticate(grpcCredentials(ctx))
+	if err != nil {
+		return ctx, grpcError(ctx, newUnauthorizedError("%v", err))
+	}
+	if !p.hasRole(role) {
+		return ctx, grpcError(ctx, newForbiddenError("The %s role is required", role))
+	}
+	return withPrincipal(ctx, p), nil
+}
+
+// apiKeyAuthenticator looks callers up by the SHA-256 of their key
+type apiKeyAuthenticator map[[sha256.Size]byte]*principal
+
+// parseAPIKeys reads comma-separated name:key:role+role entries, optionally followed by
+// :tenant to bind the key to a tenant
+func parseAPIKeys(raw string) (apiKeyAuthenticator, error) {
+	keys := make(apiKeyAuthenticator)
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, errors.New("expected comma-separated name:key:role+role[:tenant] entries")
+		}
+		name, key, roles := parts[0], parts[1], strings.Split(parts[2], "+")
+		var tenant string
+		if len(parts) == 4 {
+			tenant = parts[3]
+			if !tenantIDPattern.MatchString(tenant) {
+				return nil, fmt.Errorf("key %s has invalid tenant %q", name, tenant)
+			}
+		}
+		if names[name] {
+			return nil, fmt.Errorf("key %s is listed twice", name)
+		}
+		for _, role := range roles {
+			if _, ok := impliedRoles[role]; !ok {
+				return nil, fmt.Errorf("key %s has unknown role %q", name, role)
+			}
+		}
+		hash := sha256.Sum256([]byte(key))
+		if _, ok := keys[hash]; ok {
+			return nil, fmt.Errorf("key %s reuses the key of another entry", name)
+		}
+		names[name] = true
+		keys[hash] = &principal{Name: name, Method: "api-key", Roles: roles, Tenant: tenant}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keys, nil
+}
+
+func (a apiKeyAuthenticator) authenticate(creds credentials) (*principal, error) {
+	if creds.APIKey == "" {
+		return nil, nil
+	}
+	p, ok := a[sha256.Sum256([]byte(creds.APIKey))]
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+	return p, nil
+}
+
+// daprTokenAuthenticator accepts the app API token the sidecar adds to the calls it forwards
+// and grants the inventory role, so pubsub deliveries can update stock
+type daprTokenAuthenticator string
+
+func (a daprTokenAuthenticator) authenticate(creds credentials) (*principal, error) {
+	if creds.DaprToken == "" {
+		return nil, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(creds.DaprToken), []byte(a)) != 1 {
+		return nil, errors.New("invalid Dapr app API token")
+	}
+	return &principal{Name: "dapr", Method: "dapr-api-token", Roles: []string{roleInventory}}, nil
+}
+
+// jwk is one HMAC key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+}
+
+type jwtKey struct {
+	alg    string
+	secret []byte
+}
+
+// jwtAlgorithms are the accepted signing algorithms, all HMAC
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// loadJWKS reads the symmetric ("oct") keys of a JWKS file by key ID
+func loadJWKS(path string) (map[string]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	keys := make(map[string]jwtKey, len(set.Keys))
+	for i, key := range set.Keys {
+		if key.Kty != "oct" {
+			return nil, fmt.Errorf("key %d: only HMAC (oct) keys are supported, got %q", i, key.Kty)
+		}
+		if _, ok := jwtAlgorithms[key.Alg]; key.Alg != "" && !ok {
+			return nil, fmt.Errorf("key %d: unsupported algorithm %q", i, key.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.K, "="))
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("key %d: k is not a base64url encoded secret", i)
+		}
+		if _, ok := keys[key.Kid]; ok {
+			return nil, fmt.Errorf("key %d: kid %q is used twice", i, key.Kid)
+		}
+		keys[key.Kid] = jwtKey{alg: key.Alg, secret: secret}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no keys", path)
+	}
+	return keys, nil
+}
+
+// jwtAuthenticator verifies HMAC-signed bearer tokens and takes the caller's roles, and the
+// tenant it is bound to if any, from claims
+type jwtAuthenticator struct {
+	keys        map[string]jwtKey
+	issuer      string
+	audience    string
+	rolesClaim  string
+	tenantClaim string
+}
+
+func (a *jwtAuthenticator) authenticate(creds credentials) (*principal, error) {
+	if creds.BearerToken == "" {
+		return nil, nil
+	}
+	claims, err := a.verify(creds.BearerToken, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %v", err)
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("invalid bearer token: no subject")
+	}
+	tenant, _ := claims[a.tenantClaim].(string)
+	return &principal{Name: sub, Method: "jwt", Roles: claimRoles(claims[a.rolesClaim]), Tenant: tenant}, nil
+}
+
+// verify checks the signature and the registered claims of a token and returns its claims
+func (a *jwtAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %v", err)
+	}
+	newHash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok && header.Kid == "" && len(a.keys) == 1 {
+		for _, only := range a.keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("key %q is not for %s", header.Kid, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	mac := hmac.New(newHash, key.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("signature mismatch")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %v", err)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, errors.New("no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return nil, errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	if a.audience != "" && !containsClaim(claims["aud"], a.audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimRoles reads roles from a JSON array or a space-separated string, skipping unknown roles
+func claimRoles(claim interface{}) []string {
+	var values []string
+	switch v := claim.(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	roles := make([]string, 0, len(values))
+	for _, role := range values {
+		if _, ok := impliedRoles[role]; ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// containsClaim reports whether a string or array claim holds want
+func containsClaim(claim interface{}, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, item := range v {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
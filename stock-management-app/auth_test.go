@@ -0,0 +1,97 @@
+// stock-management-app/auth_test.go
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testJWTSecret signs the tokens useJWTAuth accepts
+const testJWTSecret = "test-secret"
+
+// useJWTAuth turns authentication on with a JWKS holding testJWTSecret
+func useJWTAuth(t *testing.T) *authChain {
+	t.Helper()
+	jwks := `{"keys":[{"kty":"oct","kid":"test","alg":"HS256","k":"` + base64.RawURLEncoding.EncodeToString([]byte(testJWTSecret)) + `"}]}`
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(jwks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWKS_FILE", path)
+	t.Setenv("APP_API_TOKEN", testAppAPIToken)
+	t.Setenv("AUTH_DISABLED", "false")
+	_, auth := loadTestConfig(t)
+	return auth
+}
+
+// signJWT signs claims with secret as an HS256 token
+func signJWT(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(map[string]string{"alg": "HS256", "kid": "test"}) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthentication(t *testing.T) {
+	audit := newMemoryAuditStore()
+	api := routeTestAPI(useJWTAuth(t), newAuditedProductRepository(newMemoryProductRepository(), audit), audit)
+
+	valid := time.Now().Add(time.Hour).Unix()
+	bearer := func(secret string, roles string, exp int64) map[string]string {
+		token := signJWT(t, secret, map[string]interface{}{"sub": "alice", "roles": roles, "exp": exp})
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		code    string
+	}{
+		{"no credentials", "/products", nil, http.StatusUnauthorized, codeUnauthorized},
+		{"valid token", "/products", bearer(testJWTSecret, roleReader, valid), http.StatusOK, ""},
+		{"wrong role", "/admin/config", bearer(testJWTSecret, roleReader, valid), http.StatusForbidden, codeForbidden},
+		{"bad signature", "/products", bearer("another-secret", roleReader, valid), http.StatusUnauthorized, codeUnauthorized},
+		{"expired token", "/products", bearer(testJWTSecret, roleReader, time.Now().Add(-time.Hour).Unix()), http.StatusUnauthorized, codeUnauthorized},
+		{"unknown API key", "/products", map[string]string{apiKeyHeader: "guess"}, http.StatusUnauthorized, codeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveWithHeaders(t, api, http.MethodGet, tt.path, "", tt.headers)
+			if tt.code == "" {
+				if w.Code != tt.status {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+				return
+			}
+			expectProblem(t, w, tt.status, tt.code)
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAuthDisabledLetsEveryoneInAsAnAdmin(t *testing.T) {
+	api, _ := newTestAPI(t)
+	if w := serve(t, api, http.MethodGet, "/admin/config", ""); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
@@ -0,0 +1,378 @@
+// stock-management-app/bulksubscribe.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	runtimev1pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// bulkEventStatus tells the sidecar what to do with one entry of a bulk delivery
+type bulkEventStatus string
+
+const (
+	bulkStatusSuccess bulkEventStatus = "SUCCESS"
+	bulkStatusRetry   bulkEventStatus = "RETRY"
+	bulkStatusDrop    bulkEventStatus = "DROP"
+)
+
+// bulkEntry is one event of a bulk delivery with its CloudEvent data, the trace context of its
+// publisher and the tenant it is for
+type bulkEntry struct {
+	EntryID     string
+	Data        []byte
+	TraceParent string
+	TraceState  string
+	Tenant      string
+}
+
+// bulkEventHandler handles a whole batch and returns a status per entry ID.
+// Entries without a status are retried.
+type bulkEventHandler func(ctx context.Context, entries []bulkEntry) map[string]bulkEventStatus
+
+// stockSubscriptionBulkOptions enables bulk delivery of stockUpdate events unless it is turned off
+func stockSubscriptionBulkOptions() *bulkSubscribeOptions {
+	if config().StockUpdateBulkMaxMessages <= 0 {
+		return nil
+	}
+	return &bulkSubscribeOptions{
+		MaxMessagesCount:   int32(config().StockUpdateBulkMaxMessages),
+		MaxAwaitDurationMs: int32(config().StockUpdateBulkMaxAwait.Milliseconds()),
+	}
+}
+
+// stockUpdateBulkHandler applies a batch of stockUpdate events with one read per product and one
+// transaction, one tenant at a time. Invalid entries and entries for unknown products or tenants
+// are dropped without touching stock, entries whose products could not be read or saved are retried.
+func stockUpdateBulkHandler(repo ProductRepository) bulkEventHandler {
+	return func(ctx context.Context, entries []bulkEntry) map[string]bulkEventStatus {
+		statuses := make(map[string]bulkEventStatus, len(entries))
+
+		// Each entry gets a span in its publisher's trace, ended and counted with the entry's status
+		spans := make(map[string]trace.Span, len(entries))
+		for _, entry := range entries {
+			_, spans[entry.EntryID] = startEventSpan(ctx, config().StockUpdateTopic, entry.TraceParent, entry.TraceState)
+		}
+		defer func() {
+			for entryID, span := range spans {
+				status, ok := statuses[entryID]
+				if !ok {
+					status = bulkStatusRetry
+				}
+				span.SetAttributes(attribute.String("dapr.event.status", string(status)))
+				span.End()
+				countStockUpdate(stockUpdateSourceBulk, bulkStockUpdateResults[status])
+			}
+		}()
+
+		var tenants []string
+		byTenant := make(map[string][]bulkEntry)
+		for _, entry := range entries {
+			if _, ok := byTenant[entry.Tenant]; !ok {
+				tenants = append(tenants, entry.Tenant)
+			}
+			byTenant[entry.Tenant] = append(byTenant[entry.Tenant], entry)
+		}
+		for _, tenant := range tenants {
+			tenantCtx, err := scopeEventTenant(ctx, tenant)
+			if err != nil {
+				slog.WarnContext(ctx, "Dropping stock update entries for a tenant that is not served", "tenant", tenant, "entries", len(byTenant[tenant]), "error", err)
+				for _, entry := range byTenant[tenant] {
+					statuses[entry.EntryID] = bulkStatusDrop
+				}
+				continue
+			}
+			applyBulkStockUpdates(tenantCtx, repo, byTenant[tenant], statuses)
+		}
+		return statuses
+	}
+}
+
+// applyBulkStockUpdates applies the entries of one tenant, recording the status of each entry
+func applyBulkStockUpdates(ctx context.Context, repo ProductRepository, entries []bulkEntry, statuses map[string]bulkEventStatus) {
+	requests := make(map[string][]ProductUpdate, len(entries))
+	for _, entry := range entries {
+		var req StockUpdateRequest
+		if err := json.Unmarshal(entry.Data, &req); err != nil {
+			slog.WarnContext(ctx, "Dropping stock update entry with invalid payload", "entryId", entry.EntryID, "payload", logPayload(entry.Data), "error", err)
+			statuses[entry.EntryID] = bulkStatusDrop
+			continue
+		}
+		if errs := validateStockUpdateRequest(req); len(errs) > 0 {
+			slog.WarnContext(ctx, "Dropping invalid stock update entry", "entryId", entry.EntryID, "errors", errs.Error())
+			statuses[entry.EntryID] = bulkStatusDrop
+			continue
+		}
+		requests[entry.EntryID] = req.Updates
+	}
+
+	// Read every product once, remembering why the ones that failed could not be read
+	products := make(map[int]versionedProduct)
+	unavailable := make(map[int]bulkEventStatus)
+	for _, entry := range entries {
+		for _, update := range requests[entry.EntryID] {
+			if _, ok := products[update.Id]; ok {
+				continue
+			}
+			if _, ok := unavailable[update.Id]; ok {
+				continue
+			}
+
+			product, err := repo.GetVersionedProduct(ctx, update.Id)
+			switch {
+			case errors.Is(err, errProductNotFound):
+				unavailable[update.Id] = bulkStatusDrop
+			case err != nil:
+				slog.WarnContext(ctx, "Error getting product from state store", "productId", update.Id, "error", err)
+				unavailable[update.Id] = bulkStatusRetry
+			default:
+				products[update.Id] = product
+			}
+		}
+	}
+
+	// Coalesce the entries whose products could all be read into one total per product
+	var order []int
+	totals := make(map[int]int)
+	touchedBy := make(map[int][]string)
+	for _, entry := range entries {
+		updates, ok := requests[entry.EntryID]
+		if !ok {
+			continue
+		}
+
+		status := bulkStatusSuccess
+		for _, update := range updates {
+			if s, ok := unavailable[update.Id]; ok && status != bulkStatusDrop {
+				status = s
+			}
+		}
+		if status == bulkStatusSuccess && !featureEnabled(featureBackorders) && exceedsStock(products, totals, updates) {
+			status = bulkStatusDrop
+		}
+		if status != bulkStatusSuccess {
+			slog.WarnContext(ctx, "Stock update entry not applied", "entryId", entry.EntryID, "status", status)
+			statuses[entry.EntryID] = status
+			continue
+		}
+
+		for _, update := range updates {
+			if _, ok := totals[update.Id]; !ok {
+				order = append(order, update.Id)
+			}
+			totals[update.Id] += update.PurchaseQty
+			touchedBy[update.Id] = append(touchedBy[update.Id], entry.EntryID)
+		}
+		statuses[entry.EntryID] = bulkStatusSuccess
+	}
+
+	// Every product is written in one transaction guarded by the versions read above. When it
+	// fails nothing was applied, so retrying the accepted entries cannot take stock twice.
+	changed := make([]versionedProduct, len(order))
+	for i, id := range order {
+		product := products[id]
+		product.Quantity -= totals[id]
+		slog.DebugContext(ctx, "Applying coalesced stock updates", "productId", id, "entries", len(touchedBy[id]), "quantity", product.Quantity)
+		changed[i] = product
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if err := repo.SaveProducts(ctx, changed); err != nil {
+		slog.ErrorContext(ctx, "Error saving products to state store", "products", len(changed), "error", err)
+		for _, id := range order {
+			for _, entryID := range touchedBy[id] {
+				statuses[entryID] = bulkStatusRetry
+			}
+		}
+		return
+	}
+	for _, product := range changed {
+		stockWatchers.publish(ctx, product.Product)
+	}
+}
+
+// exceedsStock reports whether the updates of an entry, on top of the entries accepted before
+// it, purchase more than the stock on hand of a product
+func exceedsStock(products map[int]versionedProduct, totals map[int]int, updates []ProductUpdate) bool {
+	purchased := make(map[int]int, len(updates))
+	for _, update := range updates {
+		purchased[update.Id] += update.PurchaseQty
+		if totals[update.Id]+purchased[update.Id] > products[update.Id].Quantity {
+			return true
+		}
+	}
+	return false
+}
+
+// bulkStockUpdateResults maps entry statuses onto stock update results
+var bulkStockUpdateResults = map[bulkEventStatus]string{
+	bulkStatusSuccess: stockUpdateProcessed,
+	bulkStatusRetry:   stockUpdateRetried,
+	bulkStatusDrop:    stockUpdateFailed,
+}
+
+// findBulkSubscription returns the subscription of a bulk delivery if it has a bulk handler
+func findBulkSubscription(subscriptions []topicSubscription, pubsub, topic string) (topicSubscription, bool) {
+	sub, ok := findSubscription(subscriptions, pubsub, topic)
+	return sub, ok && sub.BulkHandler != nil
+}
+
+// bulkSubscribeRequest is the body Dapr posts to a subscription route with a batch of events
+type bulkSubscribeRequest struct {
+	ID         string `json:"id"`
+	Topic      string `json:"topic"`
+	PubsubName string `json:"pubsubname"`
+	Entries    []struct {
+		EntryID     string          `json:"entryId"`
+		Event       json.RawMessage `json:"event"`
+		ContentType string          `json:"contentType"`
+	} `json:"entries"`
+}
+
+type bulkSubscribeResponseEntry struct {
+	EntryID string          `json:"entryId"`
+	Status  bulkEventStatus `json:"status"`
+}
+
+// bulkEventMiddleware answers batched deliveries on the routes of bulk subscriptions. Single
+// CloudEvents have no entries and are passed on to the SDK's handler for the route.
+func bulkEventMiddleware(subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	routes := make(map[string]bool)
+	for _, sub := range subscriptions {
+		if sub.BulkHandler != nil {
+			routes[sub.Route] = true
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || !routes[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			var req bulkSubscribeRequest
+			if json.Unmarshal(body, &req) != nil || req.Entries == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sub, ok := findBulkSubscription(subscriptions, req.PubsubName, req.Topic)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			entries := make([]bulkEntry, len(req.Entries))
+			for i, entry := range req.Entries {
+				traceParent, traceState := cloudEventTraceFields(entry.Event)
+				entries[i] = bulkEntry{EntryID: entry.EntryID, Data: cloudEventData(entry.Event), TraceParent: traceParent, TraceState: traceState, Tenant: cloudEventTenant(entry.Event)}
+			}
+			slog.InfoContext(r.Context(), "Received bulk delivery", "topic", req.Topic, "bulkId", req.ID, "entries", len(entries))
+			statuses := sub.BulkHandler(r.Context(), entries)
+
+			resp := struct {
+				Statuses []bulkSubscribeResponseEntry `json:"statuses"`
+			}{Statuses: make([]bulkSubscribeResponseEntry, len(entries))}
+			for i, entry := range entries {
+				status, ok := statuses[entry.EntryID]
+				if !ok {
+					status = bulkStatusRetry
+				}
+				resp.Statuses[i] = bulkSubscribeResponseEntry{EntryID: entry.EntryID, Status: status}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(resp); err != nil {
+				slog.WarnContext(r.Context(), "Failed to write bulk subscribe response", "error", err)
+			}
+		})
+	}
+}
+
+// cloudEventData extracts the data of a CloudEvent entry, raw payload entries are returned as is
+func cloudEventData(event json.RawMessage) []byte {
+	var ce struct {
+		SpecVersion string          `json:"specversion"`
+		Data        json.RawMessage `json:"data"`
+		DataBase64  string          `json:"data_base64"`
+	}
+	if json.Unmarshal(event, &ce) != nil || ce.SpecVersion == "" {
+		return event
+	}
+	if ce.DataBase64 != "" {
+		if data, err := base64.StdEncoding.DecodeString(ce.DataBase64); err == nil {
+			return data
+		}
+	}
+	// Publishers that send JSON as text end up with the document in a string
+	var text string
+	if json.Unmarshal(ce.Data, &text) == nil {
+		return []byte(text)
+	}
+	return ce.Data
+}
+
+// bulkEventInterceptor answers OnBulkTopicEventAlpha1 for bulk subscriptions. The SDK's gRPC
+// service registers the method but panics in it (service/grpc/topic.go in go-sdk v1.11.0), so
+// deliveries for those subscriptions never reach it.
+func bulkEventInterceptor(subscriptions []topicSubscription) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod != runtimev1pb.AppCallbackAlpha_OnBulkTopicEventAlpha1_FullMethodName {
+			return handler(ctx, req)
+		}
+		in, ok := req.(*runtimev1pb.TopicEventBulkRequest)
+		if !ok {
+			return handler(ctx, req)
+		}
+		sub, ok := findBulkSubscription(subscriptions, in.GetPubsubName(), in.GetTopic())
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		entries := make([]bulkEntry, len(in.GetEntries()))
+		for i, entry := range in.GetEntries() {
+			entries[i] = bulkEntry{EntryID: entry.GetEntryId(), Data: entry.GetBytes()}
+			if ce := entry.GetCloudEvent(); ce != nil {
+				fields := ce.GetExtensions().GetFields()
+				entries[i].Data = ce.GetData()
+				entries[i].TraceParent = fields[traceParentHeader].GetStringValue()
+				entries[i].TraceState = fields[traceStateHeader].GetStringValue()
+				entries[i].Tenant = fields[tenantExtension].GetStringValue()
+			}
+		}
+		slog.InfoContext(ctx, "Received bulk delivery", "topic", in.GetTopic(), "bulkId", in.GetId(), "entries", len(entries))
+		statuses := sub.BulkHandler(ctx, entries)
+
+		resp := &runtimev1pb.TopicEventBulkResponse{Statuses: make([]*runtimev1pb.TopicEventBulkResponseEntry, len(entries))}
+		for i, entry := range entries {
+			status := runtimev1pb.TopicEventResponse_RETRY
+			switch statuses[entry.EntryID] {
+			case bulkStatusSuccess:
+				status = runtimev1pb.TopicEventResponse_SUCCESS
+			case bulkStatusDrop:
+				status = runtimev1pb.TopicEventResponse_DROP
+			}
+			resp.Statuses[i] = &runtimev1pb.TopicEventBulkResponseEntry{EntryId: entry.EntryID, Status: status}
+		}
+		return resp, nil
+	}
+}
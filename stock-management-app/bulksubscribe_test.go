@@ -0,0 +1,85 @@
+// stock-management-app/bulksubscribe_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// flakyRepository fails the first SaveProducts calls
+type flakyRepository struct {
+	ProductRepository
+	failures int
+}
+
+func (r *flakyRepository) SaveProducts(ctx context.Context, products []versionedProduct) error {
+	if r.failures > 0 {
+		r.failures--
+		return errStateStore
+	}
+	return r.ProductRepository.SaveProducts(ctx, products)
+}
+
+func TestBulkStockUpdateRetryDoesNotTakeStockTwice(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	memory := newMemoryProductRepository()
+	for _, product := range []Product{{Id: 1, Name: "Mug", Quantity: 10}, {Id: 2, Name: "Lamp", Quantity: 10}} {
+		if err := memory.SaveProduct(ctx, product); err != nil {
+			t.Fatalf("SaveProduct: %v", err)
+		}
+	}
+	repo := &flakyRepository{ProductRepository: memory, failures: 1}
+	entries := []bulkEntry{
+		{EntryID: "both", Data: []byte(`{"updates":[{"id":1,"purchaseQty":2},{"id":2,"purchaseQty":3}]}`)},
+		{EntryID: "unknown", Data: []byte(`{"updates":[{"id":99,"purchaseQty":1}]}`)},
+	}
+
+	statuses := make(map[string]bulkEventStatus)
+	applyBulkStockUpdates(ctx, repo, entries, statuses)
+	if statuses["both"] != bulkStatusRetry || statuses["unknown"] != bulkStatusDrop {
+		t.Fatalf("statuses = %v, want both RETRY and unknown DROP", statuses)
+	}
+	expectQuantity(t, memory, 1, 10)
+	expectQuantity(t, memory, 2, 10)
+
+	// The sidecar redelivers the entry it was told to retry
+	statuses = make(map[string]bulkEventStatus)
+	applyBulkStockUpdates(ctx, repo, entries[:1], statuses)
+	if statuses["both"] != bulkStatusSuccess {
+		t.Fatalf("status on redelivery = %s, want SUCCESS", statuses["both"])
+	}
+	expectQuantity(t, memory, 1, 8)
+	expectQuantity(t, memory, 2, 7)
+}
+
+func TestStockUpdateFailureLeavesEveryProductUntouched(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	memory := newMemoryProductRepository()
+	for _, product := range []Product{{Id: 1, Name: "Mug", Quantity: 10}, {Id: 2, Name: "Lamp", Quantity: 10}} {
+		if err := memory.SaveProduct(ctx, product); err != nil {
+			t.Fatalf("SaveProduct: %v", err)
+		}
+	}
+
+	repo := &flakyRepository{ProductRepository: memory, failures: 1}
+	updates := []ProductUpdate{{Id: 1, PurchaseQty: 2}, {Id: 2, PurchaseQty: 3}, {Id: 1, PurchaseQty: 1}}
+	if _, err := applyStockUpdates(ctx, repo, updates); !errors.Is(err, errStateStore) {
+		t.Fatalf("applyStockUpdates = %v, want the state store failure", err)
+	}
+	expectQuantity(t, memory, 1, 10)
+	expectQuantity(t, memory, 2, 10)
+
+	updated, err := applyStockUpdates(ctx, repo, updates)
+	if err != nil {
+		t.Fatalf("applyStockUpdates on retry: %v", err)
+	}
+	if len(updated) != 2 {
+		t.Errorf("updated %d products, want 2", len(updated))
+	}
+	expectQuantity(t, memory, 1, 7)
+	expectQuantity(t, memory, 2, 7)
+}
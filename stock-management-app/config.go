@@ -0,0 +1,697 @@
+// stock-management-app/config.go
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the service. Each field is read from, in increasing order of
+// precedence, its default, the YAML file named by CONFIG_FILE or --config, the environment
+// variable in its env tag and the matching flag (e.g. --state-store-read-timeout-ms).
+// Fields tagged reload can also be changed at runtime through the Dapr configuration store.
+//
+// Durations are given as whole numbers in the unit of their tag, or as Go durations ("1.5s").
+type Config struct {
+	Port string `env:"PORT" yaml:"port" default:"8080"`
+	// GRPCPort is where CatalogService and InventoryService are served, next to the HTTP API
+	GRPCPort       string `env:"GRPC_PORT" yaml:"grpcPort" default:"50051"`
+	MaxRetries     int    `env:"MAX_RETRIES" yaml:"maxRetries" default:"3"`
+	StateStoreName string `env:"STATE_STORE_NAME" yaml:"stateStoreName" default:"statestore"`
+	PubsubName     string `env:"PUBSUB_NAME" yaml:"pubsubName" default:"orderpubsub"`
+
+	// ConfigStoreName is the Dapr configuration store watched for reloadable settings, empty turns reloading off
+	ConfigStoreName string `env:"CONFIG_STORE_NAME" yaml:"configStoreName" default:""`
+	// FeatureFlagStoreName is the Dapr configuration store holding feature flags, empty keeps the defaults
+	FeatureFlagStoreName string `env:"FEATURE_FLAG_STORE_NAME" yaml:"featureFlagStoreName" default:""`
+
+	DaprAppProtocol            string `env:"DAPR_APP_PROTOCOL" yaml:"daprAppProtocol" default:"http"`
+	StockUpdateTopic           string `env:"STOCK_UPDATE_TOPIC" yaml:"stockUpdateTopic" default:"stockUpdate"`
+	StockUpdateDeadLetterTopic string `env:"STOCK_UPDATE_DEAD_LETTER_TOPIC" yaml:"stockUpdateDeadLetterTopic" default:"stockUpdateDeadLetter"`
+	// Batches of stockUpdate events are delivered once either limit is reached, 0 turns bulk delivery off
+	StockUpdateBulkMaxMessages int           `env:"STOCK_UPDATE_BULK_MAX_MESSAGES" yaml:"stockUpdateBulkMaxMessages" default:"100"`
+	StockUpdateBulkMaxAwait    time.Duration `env:"STOCK_UPDATE_BULK_MAX_AWAIT_MS" yaml:"stockUpdateBulkMaxAwaitMs" default:"1000" unit:"ms"`
+
+	SeedFile string `env:"SEED_FILE" yaml:"seedFile" default:""`
+	SeedMode string `env:"SEED_MODE" yaml:"seedMode" default:"if-empty"`
+	// StartupJobLease bounds how long a replica may hold a job before others take over
+	StartupJobLease time.Duration `env:"STARTUP_JOB_LEASE_SECONDS" yaml:"startupJobLeaseSeconds" default:"120" unit:"s"`
+	// StartupJobWait bounds how long a replica waits for a job held by another replica
+	StartupJobWait time.Duration `env:"STARTUP_JOB_WAIT_SECONDS" yaml:"startupJobWaitSeconds" default:"600" unit:"s"`
+	// LegacyProductScanLimit is the highest product ID probed for legacy product keys, which
+	// the legacy index misses for products added through POST /product
+	LegacyProductScanLimit int `env:"LEGACY_PRODUCT_SCAN_LIMIT" yaml:"legacyProductScanLimit" default:"10000"`
+
+	// ShutdownTimeout bounds the whole shutdown, from the signal to closing the Dapr client
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT_SECONDS" yaml:"shutdownTimeoutSeconds" default:"25" unit:"s"`
+	// ShutdownReadinessDelay keeps serving after readiness has gone false, so endpoints
+	// and the sidecar stop sending traffic before the listeners close
+	ShutdownReadinessDelay time.Duration `env:"SHUTDOWN_READINESS_DELAY_SECONDS" yaml:"shutdownReadinessDelaySeconds" default:"5" unit:"s"`
+	// ReadinessCacheTTL is how long a readiness result is reused, so probes cannot storm the sidecar
+	ReadinessCacheTTL time.Duration `env:"READINESS_CACHE_SECONDS" yaml:"readinessCacheSeconds" default:"5" unit:"s" reload:"true"`
+	// ReadinessCheckTimeout bounds each dependency check
+	ReadinessCheckTimeout time.Duration `env:"READINESS_CHECK_TIMEOUT_MS" yaml:"readinessCheckTimeoutMs" default:"2000" unit:"ms" reload:"true"`
+
+	// Deadlines for each kind of sidecar call, on top of the caller's own context
+	StateStoreReadTimeout  time.Duration `env:"STATE_STORE_READ_TIMEOUT_MS" yaml:"stateStoreReadTimeoutMs" default:"2000" unit:"ms" reload:"true"`
+	StateStoreWriteTimeout time.Duration `env:"STATE_STORE_WRITE_TIMEOUT_MS" yaml:"stateStoreWriteTimeoutMs" default:"3000" unit:"ms" reload:"true"`
+	PubsubPublishTimeout   time.Duration `env:"PUBSUB_PUBLISH_TIMEOUT_MS" yaml:"pubsubPublishTimeoutMs" default:"3000" unit:"ms" reload:"true"`
+	// The breaker opens after this many consecutive failures and stays open for the cool-down
+	CircuitBreakerFailures int           `env:"CIRCUIT_BREAKER_FAILURES" yaml:"circuitBreakerFailures" default:"5" reload:"true"`
+	CircuitBreakerCoolDown time.Duration `env:"CIRCUIT_BREAKER_OPEN_SECONDS" yaml:"circuitBreakerOpenSeconds" default:"10" unit:"s" reload:"true"`
+
+	// LogLevel is one of debug, info, warn or error
+	LogLevel string `env:"LOG_LEVEL" yaml:"logLevel" default:"info" reload:"true"`
+	// LogPayloadLimit caps how many bytes of a request or event payload are logged
+	LogPayloadLimit int `env:"LOG_PAYLOAD_LIMIT" yaml:"logPayloadLimit" default:"512" reload:"true"`
+
+	// TracingExporter is zipkin, otlp or none
+	TracingExporter string `env:"TRACING_EXPORTER" yaml:"tracingExporter" default:"zipkin"`
+	// ZipkinEndpoint defaults to the collector the sidecars and the order-processing-app report to
+	ZipkinEndpoint string `env:"ZIPKIN_ENDPOINT" yaml:"zipkinEndpoint" default:"http://zipkin.default.svc.cluster.local:9411/api/v2/spans"`
+	// OTLPEndpoint is the host:port of an OTLP gRPC collector
+	OTLPEndpoint string `env:"OTLP_ENDPOINT" yaml:"otlpEndpoint" default:"localhost:4317"`
+	// TracingSamplePercent applies to traces started here, traces continued from a caller or
+	// publisher keep the caller's sampling decision
+	TracingSamplePercent int    `env:"TRACING_SAMPLE_PERCENT" yaml:"tracingSamplePercent" default:"100"`
+	ServiceName          string `env:"OTEL_SERVICE_NAME" yaml:"serviceName" default:"stock-management-app"`
+
+	// InventoryResyncInterval is how often the inventory gauges are rebuilt from the state
+	// store, picking up writes made by other replicas; 0 turns the resync off
+	InventoryResyncInterval time.Duration `env:"INVENTORY_METRICS_RESYNC_SECONDS" yaml:"inventoryMetricsResyncSeconds" default:"60" unit:"s" reload:"true"`
+
+	MaxProductNameLength int `env:"MAX_PRODUCT_NAME_LENGTH" yaml:"maxProductNameLength" default:"200"`
+	MaxProductTags       int `env:"MAX_PRODUCT_TAGS" yaml:"maxProductTags" default:"20"`
+	MaxProductTagLength  int `env:"MAX_PRODUCT_TAG_LENGTH" yaml:"maxProductTagLength" default:"50"`
+	// MaxStockUpdates caps the lines of a single stock update request or event
+	MaxStockUpdates int `env:"MAX_STOCK_UPDATES" yaml:"maxStockUpdates" default:"100"`
+
+	// Request bodies over these sizes are rejected with 413, 0 turns a limit off
+	MaxRequestBodyBytes int `env:"MAX_REQUEST_BODY_BYTES" yaml:"maxRequestBodyBytes" default:"1048576" reload:"true"`
+	MaxImportBodyBytes  int `env:"MAX_IMPORT_BODY_BYTES" yaml:"maxImportBodyBytes" default:"33554432" reload:"true"`
+	// Requests per minute each client may make against a route budget, 0 turns a budget off
+	RateLimitReadPerMinute   int `env:"RATE_LIMIT_READ_PER_MINUTE" yaml:"rateLimitReadPerMinute" default:"600" reload:"true"`
+	RateLimitWritePerMinute  int `env:"RATE_LIMIT_WRITE_PER_MINUTE" yaml:"rateLimitWritePerMinute" default:"120" reload:"true"`
+	RateLimitExportPerMinute int `env:"RATE_LIMIT_EXPORT_PER_MINUTE" yaml:"rateLimitExportPerMinute" default:"10" reload:"true"`
+	RateLimitAdminPerMinute  int `env:"RATE_LIMIT_ADMIN_PER_MINUTE" yaml:"rateLimitAdminPerMinute" default:"60" reload:"true"`
+	// RateLimitBurstSeconds is how many seconds of its budget a client may spend at once
+	RateLimitBurstSeconds int `env:"RATE_LIMIT_BURST_SECONDS" yaml:"rateLimitBurstSeconds" default:"10" reload:"true"`
+	// TrustedProxies are comma-separated addresses or CIDRs whose X-Forwarded-For header is
+	// believed when clients are told apart by IP
+	TrustedProxies string `env:"TRUSTED_PROXIES" yaml:"trustedProxies" default:""`
+
+	// DefaultTenant serves requests and events that name no tenant, empty makes naming one mandatory
+	DefaultTenant string `env:"DEFAULT_TENANT" yaml:"defaultTenant" default:"default"`
+	// TenantsFile lists the tenants and their own settings, see loadTenants; without it the
+	// default tenant is the only one
+	TenantsFile string `env:"TENANTS_FILE" yaml:"tenantsFile" default:""`
+
+	// AuditHistoryLimit is how many audit entries are kept for admin actions and, per product,
+	// for its versions and for its stock changes
+	AuditHistoryLimit int `env:"AUDIT_HISTORY_LIMIT" yaml:"auditHistoryLimit" default:"100" reload:"true"`
+	// ImportJobRetention is how long an import job can be polled after its last progress
+	ImportJobRetention time.Duration `env:"IMPORT_JOB_RETENTION_SECONDS" yaml:"importJobRetentionSeconds" default:"86400" unit:"s" reload:"true"`
+
+	// StorefrontURL is used to build product links in the merchant feed
+	StorefrontURL string `env:"STOREFRONT_URL" yaml:"storefrontUrl" default:"http://localhost:3000"`
+	// MerchantCurrency is the ISO 4217 currency code prices are quoted in
+	MerchantCurrency string `env:"MERCHANT_CURRENCY" yaml:"merchantCurrency" default:"USD"`
+
+	// AuthDisabled lets every caller in as an admin, only meant for local runs; otherwise
+	// API_KEYS or JWKS_FILE must be set
+	AuthDisabled bool `env:"AUTH_DISABLED" yaml:"authDisabled" default:"false"`
+	// APIKeys are comma-separated name:key:role+role entries; with JWKSFile, setting either
+	// turns authentication on
+	APIKeys       string `env:"API_KEYS" yaml:"apiKeys" default:"" secret:"true"`
+	JWKSFile      string `env:"JWKS_FILE" yaml:"jwksFile" default:""`
+	JWTIssuer     string `env:"JWT_ISSUER" yaml:"jwtIssuer" default:""`
+	JWTAudience   string `env:"JWT_AUDIENCE" yaml:"jwtAudience" default:""`
+	JWTRolesClaim string `env:"JWT_ROLES_CLAIM" yaml:"jwtRolesClaim" default:"roles"`
+	// JWTTenantClaim binds a token holding it to that tenant
+	JWTTenantClaim string `env:"JWT_TENANT_CLAIM" yaml:"jwtTenantClaim" default:"tenant"`
+	// AppAPIToken is set by Dapr, which sends it with every call to the app
+	AppAPIToken string `env:"APP_API_TOKEN" yaml:"appApiToken" default:"" secret:"true"`
+
+	// sources records where each setting came from, by environment variable name
+	sources map[string]string
+}
+
+// Where a setting came from
+const (
+	configSourceDefault = "default"
+	configSourceFile    = "file"
+	configSourceEnv     = "env"
+	configSourceFlag    = "flag"
+	configSourceDapr    = "dapr"
+)
+
+var (
+	currentConfig atomic.Pointer[Config]
+
+	// configReloadMu serializes reloads so concurrent updates do not overwrite each other
+	configReloadMu sync.Mutex
+
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+func init() {
+	// Defaults are in place until main loads the configuration
+	cfg := &Config{sources: map[string]string{}}
+	for _, field := range configFields() {
+		if err := cfg.set(field, field.Default, configSourceDefault); err != nil {
+			panic(err)
+		}
+	}
+	currentConfig.Store(cfg)
+}
+
+// config returns the settings in effect. The result must not be modified.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// ConfigErrors lists every problem found while loading the configuration
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+func (e *ConfigErrors) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// configField describes one setting of Config
+type configField struct {
+	Index    int
+	Env      string
+	YAML     string
+	Flag     string
+	Default  string
+	Unit     time.Duration
+	Reload   bool
+	Secret   bool
+	Duration bool
+}
+
+var configFields = sync.OnceValue(func() []configField {
+	t := reflect.TypeOf(Config{})
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		env := f.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		field := configField{
+			Index:    i,
+			Env:      env,
+			YAML:     f.Tag.Get("yaml"),
+			Flag:     strings.ToLower(strings.ReplaceAll(env, "_", "-")),
+			Default:  f.Tag.Get("default"),
+			Reload:   f.Tag.Get("reload") == "true",
+			Secret:   f.Tag.Get("secret") == "true",
+			Duration: f.Type == reflect.TypeOf(time.Duration(0)),
+		}
+		switch f.Tag.Get("unit") {
+		case "ms":
+			field.Unit = time.Millisecond
+		case "s":
+			field.Unit = time.Second
+		}
+		fields = append(fields, field)
+	}
+	return fields
+})
+
+// loadConfig reads the configuration from its defaults, the config file, the environment and
+// the command line, and validates it. The arguments left after the flags are returned.
+func loadConfig(args []string) (*Config, []string, error) {
+	cfg := config().clone()
+	var errs ConfigErrors
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML file with settings, overridden by the environment and flags")
+	type flagValue struct {
+		field configField
+		value string
+	}
+	var flagValues []flagValue
+	for _, field := range configFields() {
+		field := field
+		fs.Func(field.Flag, fmt.Sprintf("overrides %s (default %q)", field.Env, field.Default), func(value string) error {
+			flagValues = append(flagValues, flagValue{field, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, field := range configFields() {
+			if value, ok := values[field.YAML]; ok {
+				if err := cfg.set(field, value, configSourceFile); err != nil {
+					errs.add("%s: %v (from %s)", field.YAML, err, *configFile)
+				}
+			}
+		}
+	}
+
+	for _, field := range configFields() {
+		if value, ok := os.LookupEnv(field.Env); ok {
+			if err := cfg.set(field, value, configSourceEnv); err != nil {
+				errs.add("%s: %v (from the environment)", field.Env, err)
+			}
+		}
+	}
+
+	for _, fv := range flagValues {
+		if err := cfg.set(fv.field, fv.value, configSourceFlag); err != nil {
+			errs.add("--%s: %v", fv.field.Flag, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		errs = cfg.validate()
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readConfigFile reads a flat YAML mapping of setting names to values. Unknown names are
+// rejected so a misspelled setting is not silently ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var doc map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	known := make(map[string]bool)
+	for _, field := range configFields() {
+		known[field.YAML] = true
+	}
+	values := make(map[string]string, len(doc))
+	var errs ConfigErrors
+	for key, node := range doc {
+		switch {
+		case !known[key]:
+			errs.add("%s: unknown setting (from %s)", key, path)
+		case node.Kind != yaml.ScalarNode:
+			errs.add("%s: must be a single value (from %s)", key, path)
+		default:
+			values[key] = node.Value
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errs
+	}
+	return values, nil
+}
+
+// set parses a raw value into the field and records its source
+func (c *Config) set(field configField, raw string, source string) error {
+	v := reflect.ValueOf(c).Elem().Field(field.Index)
+	raw = strings.TrimSpace(raw)
+
+	switch {
+	case field.Duration:
+		d, err := parseConfigDuration(raw, field.Unit)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Kind())
+	}
+	c.sources[field.Env] = source
+	return nil
+}
+
+// parseConfigDuration accepts a whole number of units or a Go duration
+func parseConfigDuration(raw string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: expected a whole number of %s or a duration such as 1.5s", raw, unitName(unit))
+	}
+	return d, nil
+}
+
+func unitName(unit time.Duration) string {
+	if unit == time.Millisecond {
+		return "milliseconds"
+	}
+	return "seconds"
+}
+
+// validate checks the settings against each other and their allowed ranges
+func (c *Config) validate() ConfigErrors {
+	var errs ConfigErrors
+	notEmpty := func(name, value string) {
+		if value == "" {
+			errs.add("%s: must not be empty", name)
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		errs.add("%s: %q is not one of %s", name, value, strings.Join(allowed, ", "))
+	}
+	atLeast := func(name string, value, min int) {
+		if value < min {
+			errs.add("%s: must be at least %d, got %d", name, min, value)
+		}
+	}
+	positive := func(name string, value time.Duration) {
+		if value <= 0 {
+			errs.add("%s: must be positive, got %s", name, value)
+		}
+	}
+	notNegative := func(name string, value time.Duration) {
+		if value < 0 {
+			errs.add("%s: must not be negative, got %s", name, value)
+		}
+	}
+	tcpPort := func(name, value string) {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			errs.add("%s: %q is not a port number", name, value)
+		}
+	}
+	absoluteURL := func(name, value string) {
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add("%s: %q is not an absolute URL", name, value)
+		}
+	}
+
+	tcpPort("PORT", c.Port)
+	tcpPort("GRPC_PORT", c.GRPCPort)
+	if c.Port == c.GRPCPort {
+		errs.add("GRPC_PORT: must differ from PORT")
+	}
+	atLeast("MAX_RETRIES", c.MaxRetries, 1)
+	notEmpty("STATE_STORE_NAME", c.StateStoreName)
+	notEmpty("PUBSUB_NAME", c.PubsubName)
+
+	oneOf("DAPR_APP_PROTOCOL", c.DaprAppProtocol, appProtocolHTTP, appProtocolGRPC)
+	notEmpty("STOCK_UPDATE_TOPIC", c.StockUpdateTopic)
+	notEmpty("STOCK_UPDATE_DEAD_LETTER_TOPIC", c.StockUpdateDeadLetterTopic)
+	if c.StockUpdateTopic == c.StockUpdateDeadLetterTopic {
+		errs.add("STOCK_UPDATE_DEAD_LETTER_TOPIC: must differ from STOCK_UPDATE_TOPIC")
+	}
+	atLeast("STOCK_UPDATE_BULK_MAX_MESSAGES", c.StockUpdateBulkMaxMessages, 0)
+	if c.StockUpdateBulkMaxMessages > 0 {
+		positive("STOCK_UPDATE_BULK_MAX_AWAIT_MS", c.StockUpdateBulkMaxAwait)
+	}
+
+	oneOf("SEED_MODE", c.SeedMode, seedModeNone, seedModeIfEmpty, seedModeUpsert)
+	positive("STARTUP_JOB_LEASE_SECONDS", c.StartupJobLease)
+	positive("STARTUP_JOB_WAIT_SECONDS", c.StartupJobWait)
+	atLeast("LEGACY_PRODUCT_SCAN_LIMIT", c.LegacyProductScanLimit, 0)
+
+	positive("SHUTDOWN_TIMEOUT_SECONDS", c.ShutdownTimeout)
+	notNegative("SHUTDOWN_READINESS_DELAY_SECONDS", c.ShutdownReadinessDelay)
+	if c.ShutdownReadinessDelay >= c.ShutdownTimeout {
+		errs.add("SHUTDOWN_READINESS_DELAY_SECONDS: must be shorter than SHUTDOWN_TIMEOUT_SECONDS, leaving time to drain")
+	}
+	notNegative("READINESS_CACHE_SECONDS", c.ReadinessCacheTTL)
+	positive("READINESS_CHECK_TIMEOUT_MS", c.ReadinessCheckTimeout)
+
+	positive("STATE_STORE_READ_TIMEOUT_MS", c.StateStoreReadTimeout)
+	positive("STATE_STORE_WRITE_TIMEOUT_MS", c.StateStoreWriteTimeout)
+	positive("PUBSUB_PUBLISH_TIMEOUT_MS", c.PubsubPublishTimeout)
+	atLeast("CIRCUIT_BREAKER_FAILURES", c.CircuitBreakerFailures, 1)
+	positive("CIRCUIT_BREAKER_OPEN_SECONDS", c.CircuitBreakerCoolDown)
+
+	var level slog.Level
+	if level.UnmarshalText([]byte(c.LogLevel)) != nil {
+		errs.add("LOG_LEVEL: %q is not one of debug, info, warn, error", c.LogLevel)
+	}
+	atLeast("LOG_PAYLOAD_LIMIT", c.LogPayloadLimit, -1)
+
+	oneOf("TRACING_EXPORTER", c.TracingExporter, "zipkin", "otlp", "none")
+	if c.TracingExporter == "zipkin" {
+		absoluteURL("ZIPKIN_ENDPOINT", c.ZipkinEndpoint)
+	}
+	if c.TracingExporter == "otlp" {
+		notEmpty("OTLP_ENDPOINT", c.OTLPEndpoint)
+	}
+	if c.TracingSamplePercent < 0 || c.TracingSamplePercent > 100 {
+		errs.add("TRACING_SAMPLE_PERCENT: must be between 0 and 100, got %d", c.TracingSamplePercent)
+	}
+	notEmpty("OTEL_SERVICE_NAME", c.ServiceName)
+
+	notNegative("INVENTORY_METRICS_RESYNC_SECONDS", c.InventoryResyncInterval)
+
+	atLeast("MAX_PRODUCT_NAME_LENGTH", c.MaxProductNameLength, 1)
+	atLeast("MAX_PRODUCT_TAGS", c.MaxProductTags, 0)
+	atLeast("MAX_PRODUCT_TAG_LENGTH", c.MaxProductTagLength, 1)
+	atLeast("MAX_STOCK_UPDATES", c.MaxStockUpdates, 1)
+
+	atLeast("MAX_REQUEST_BODY_BYTES", c.MaxRequestBodyBytes, 0)
+	atLeast("MAX_IMPORT_BODY_BYTES", c.MaxImportBodyBytes, 0)
+	atLeast("RATE_LIMIT_READ_PER_MINUTE", c.RateLimitReadPerMinute, 0)
+	atLeast("RATE_LIMIT_WRITE_PER_MINUTE", c.RateLimitWritePerMinute, 0)
+	atLeast("RATE_LIMIT_EXPORT_PER_MINUTE", c.RateLimitExportPerMinute, 0)
+	atLeast("RATE_LIMIT_ADMIN_PER_MINUTE", c.RateLimitAdminPerMinute, 0)
+	atLeast("RATE_LIMIT_BURST_SECONDS", c.RateLimitBurstSeconds, 1)
+	atLeast("AUDIT_HISTORY_LIMIT", c.AuditHistoryLimit, 1)
+	positive("IMPORT_JOB_RETENTION_SECONDS", c.ImportJobRetention)
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs.add("TRUSTED_PROXIES: %v", err)
+	}
+
+	if c.DefaultTenant != "" && !tenantIDPattern.MatchString(c.DefaultTenant) {
+		errs.add("DEFAULT_TENANT: %q is not lowercase letters, digits and dashes", c.DefaultTenant)
+	}
+	if c.DefaultTenant == "" && c.TenantsFile == "" {
+		errs.add("DEFAULT_TENANT: must not be empty without TENANTS_FILE")
+	}
+	tenants, err := loadTenants(c)
+	if err != nil && c.TenantsFile != "" {
+		errs.add("TENANTS_FILE: %v", err)
+	}
+
+	if c.APIKeys != "" {
+		keys, err := parseAPIKeys(c.APIKeys)
+		if err != nil {
+			errs.add("API_KEYS: %v", err)
+		}
+		for _, p := range keys {
+			if _, ok := tenants[p.Tenant]; p.Tenant != "" && tenants != nil && !ok {
+				errs.add("API_KEYS: key %s is bound to tenant %s, which is not served", p.Name, p.Tenant)
+			}
+		}
+	}
+	if c.JWKSFile != "" {
+		if _, err := loadJWKS(c.JWKSFile); err != nil {
+			errs.add("JWKS_FILE: %v", err)
+		}
+		notEmpty("JWT_ROLES_CLAIM", c.JWTRolesClaim)
+		notEmpty("JWT_TENANT_CLAIM", c.JWTTenantClaim)
+	}
+	switch credentials := c.APIKeys != "" || c.JWKSFile != ""; {
+	case !credentials && !c.AuthDisabled:
+		errs.add("API_KEYS: set API_KEYS or JWKS_FILE to authenticate callers, or AUTH_DISABLED=true to let every caller in as an admin")
+	case credentials && c.AuthDisabled:
+		errs.add("AUTH_DISABLED: must not be true while API_KEYS or JWKS_FILE are set")
+	}
+	// Event deliveries carry no caller credentials, only the app API token tells them apart
+	if (c.APIKeys != "" || c.JWKSFile != "") && c.AppAPIToken == "" {
+		errs.add("APP_API_TOKEN: must be set once API_KEYS or JWKS_FILE turn authentication on, event deliveries are verified with it")
+	}
+
+	absoluteURL("STOREFRONT_URL", c.StorefrontURL)
+	if !currencyPattern.MatchString(c.MerchantCurrency) {
+		errs.add("MERCHANT_CURRENCY: %q is not an ISO 4217 code such as USD", c.MerchantCurrency)
+	}
+	return errs
+}
+
+func (c *Config) clone() *Config {
+	cp := *c
+	cp.sources = make(map[string]string, len(c.sources))
+	for key, source := range c.sources {
+		cp.sources[key] = source
+	}
+	return &cp
+}
+
+// configSetting is one effective setting as shown by GET /admin/config
+type configSetting struct {
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+	Source     string `json:"source"`
+	Reloadable bool   `json:"reloadable"`
+}
+
+// settings lists every setting by name with secrets and URL passwords redacted
+func (c *Config) settings() []configSetting {
+	v := reflect.ValueOf(c).Elem()
+	settings := make([]configSetting, 0, len(configFields()))
+	for _, field := range configFields() {
+		value := fmt.Sprint(v.Field(field.Index).Interface())
+		switch {
+		case field.Secret && value != "":
+			value = "[REDACTED]"
+		case strings.Contains(value, "@"):
+			if u, err := url.Parse(value); err == nil && u.User != nil {
+				value = u.Redacted()
+			}
+		}
+		settings = append(settings, configSetting{
+			Name:       field.Env,
+			Value:      value,
+			Source:     c.sources[field.Env],
+			Reloadable: field.Reload,
+		})
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings
+}
+
+// getConfig shows the settings in effect and where each came from
+func getConfig(c *gin.Context) {
+	respond(c, http.StatusOK, config().settings(), "")
+}
+
+// reloadConfig applies values from the Dapr configuration store to the reloadable settings.
+// Values that fail to parse or validate are rejected as a whole and the settings are kept.
+func reloadConfig(items map[string]*dapr.ConfigurationItem) error {
+	configReloadMu.Lock()
+	defer configReloadMu.Unlock()
+
+	old := config()
+	cfg := old.clone()
+	var errs ConfigErrors
+	for _, field := range configFields() {
+		item, ok := items[field.Env]
+		if !ok || item == nil || !field.Reload {
+			continue
+		}
+		if err := cfg.set(field, item.Value, configSourceDapr); err != nil {
+			errs.add("%s: %v (from the configuration store)", field.Env, err)
+		}
+	}
+	if len(errs) == 0 {
+		errs = cfg.validate()
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	currentConfig.Store(cfg)
+	applyLogLevel(cfg)
+	for _, changed := range diffSettings(old, cfg) {
+		slog.Info("Setting reloaded", "name", changed.Name, "value", changed.Value)
+	}
+	return nil
+}
+
+func diffSettings(old, cfg *Config) []configSetting {
+	before := make(map[string]string)
+	for _, setting := range old.settings() {
+		before[setting.Name] = setting.Value
+	}
+	var changed []configSetting
+	for _, setting := range cfg.settings() {
+		if before[setting.Name] != setting.Value {
+			changed = append(changed, setting)
+		}
+	}
+	return changed
+}
+
+// watchConfiguration applies the reloadable settings held in the Dapr configuration store and
+// keeps following their changes until ctx is done
+func watchConfiguration(ctx context.Context, client dapr.Client, storeName string) {
+	var keys []string
+	for _, field := range configFields() {
+		if field.Reload {
+			keys = append(keys, field.Env)
+		}
+	}
+	followConfigurationStore(ctx, client, storeName, keys, reloadConfig)
+}
+
+// followConfigurationStore passes the current values of keys in a Dapr configuration store to
+// apply, then every change to them until ctx is done
+func followConfigurationStore(ctx context.Context, client dapr.Client, storeName string, keys []string, apply func(items map[string]*dapr.ConfigurationItem) error) {
+	items, err := client.GetConfigurationItems(ctx, storeName, keys)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read the configuration store, keeping the current values", "store", storeName, "error", err)
+	} else if err := apply(items); err != nil {
+		slog.WarnContext(ctx, "Rejected values from the configuration store", "store", storeName, "error", err)
+	}
+
+	// The SDK blocks until the first update arrives, so subscribe without holding up the caller
+	go func() {
+		id, err := client.SubscribeConfigurationItems(ctx, storeName, keys, func(_ string, items map[string]*dapr.ConfigurationItem) {
+			if err := apply(items); err != nil {
+				slog.Warn("Rejected values from the configuration store", "store", storeName, "error", err)
+			}
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Failed to subscribe to the configuration store", "store", storeName, "error", err)
+			}
+			return
+		}
+
+		<-ctx.Done()
+		unsubscribeCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := client.UnsubscribeConfigurationItems(unsubscribeCtx, storeName, id); err != nil {
+			slog.Debug("Failed to unsubscribe from the configuration store", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,727 @@
+// stock-management-app/daprtest/sidecar.go
+
+// Package daprtest runs an in-memory fake of the Dapr sidecar so end-to-end
+// tests can exercise the real Dapr client wiring without Docker or Redis.
+//
+// The sidecar implements the subset of the Dapr gRPC runtime API used by the
+// stock service (state get/save/bulk/delete/transaction, publish and bulk
+// publish, configuration get/subscribe and distributed locks) and can deliver
+// CloudEvents to the subscription routes advertised by the app on
+// /dapr/subscribe.
+//
+// Note that dapr.NewClient caches the first client it creates for the whole
+// process, so tests in one package should share a single Sidecar or connect
+// with dapr.NewClientWithAddress(sidecar.Address()).
+package daprtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	commonv1 "github.com/dapr/dapr/pkg/proto/common/v1"
+	pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Event is a message published through the sidecar
+type Event struct {
+	PubsubName      string
+	Topic           string
+	Data            []byte
+	DataContentType string
+	Metadata        map[string]string
+}
+
+// Subscription is a topic subscription advertised by the app on /dapr/subscribe
+type Subscription struct {
+	PubsubName string
+	Topic      string
+	Route      string
+}
+
+type stateEntry struct {
+	value   []byte
+	etag    int
+	expires time.Time
+}
+
+type configSubscription struct {
+	storeName string
+	keys      []string
+	updates   chan map[string]*commonv1.ConfigurationItem
+	done      chan struct{}
+}
+
+type lockEntry struct {
+	owner   string
+	expires time.Time
+}
+
+// Sidecar is an in-memory implementation of the Dapr runtime gRPC API
+type Sidecar struct {
+	pb.UnimplementedDaprServer
+
+	mu                  sync.Mutex
+	stores              map[string]map[string]*stateEntry
+	configs             map[string]map[string]*commonv1.ConfigurationItem
+	configVersion       int
+	configSubscriptions map[string]*configSubscription
+	subscriptionCount   int
+	locks               map[string]*lockEntry
+	published           []Event
+	appAddress          string
+	appID               string
+
+	listener   net.Listener
+	server     *grpc.Server
+	httpClient *http.Client
+}
+
+// New starts a sidecar listening on a random local port
+func New() (*Sidecar, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Sidecar{
+		stores:              make(map[string]map[string]*stateEntry),
+		configs:             make(map[string]map[string]*commonv1.ConfigurationItem),
+		configSubscriptions: make(map[string]*configSubscription),
+		locks:               make(map[string]*lockEntry),
+		appID:               "stock-management-app",
+		listener:            listener,
+		server:              grpc.NewServer(),
+		httpClient:          &http.Client{Timeout: 10 * time.Second},
+	}
+	pb.RegisterDaprServer(s.server, s)
+
+	go func() {
+		_ = s.server.Serve(listener)
+	}()
+
+	return s, nil
+}
+
+// Start starts a sidecar for the duration of a test and points DAPR_GRPC_PORT at it
+func Start(t testing.TB) *Sidecar {
+	t.Helper()
+
+	s, err := New()
+	if err != nil {
+		t.Fatalf("failed to start fake Dapr sidecar: %v", err)
+	}
+	t.Setenv("DAPR_GRPC_PORT", s.Port())
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Address returns the host:port the sidecar is listening on
+func (s *Sidecar) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Port returns the port the sidecar is listening on
+func (s *Sidecar) Port() string {
+	return strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Close ends the configuration subscriptions and stops the gRPC server
+func (s *Sidecar) Close() {
+	s.mu.Lock()
+	for id, sub := range s.configSubscriptions {
+		close(sub.done)
+		delete(s.configSubscriptions, id)
+	}
+	s.mu.Unlock()
+	s.server.Stop()
+}
+
+// SetAppAddress sets the base URL of the app, e.g. an httptest.Server URL
+func (s *Sidecar) SetAppAddress(baseURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appAddress = strings.TrimSuffix(baseURL, "/")
+}
+
+// State returns the raw value stored under key
+func (s *Sidecar) State(storeName, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.lookup(storeName, key)
+	if entry == nil {
+		return nil, false
+	}
+	return append([]byte(nil), entry.value...), true
+}
+
+// Expiry returns when the value stored under key expires, the zero time when it has no TTL
+func (s *Sidecar) Expiry(storeName, key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.lookup(storeName, key)
+	if entry == nil {
+		return time.Time{}, false
+	}
+	return entry.expires, true
+}
+
+// SetState stores a raw value under key, bypassing concurrency checks
+func (s *Sidecar) SetState(storeName, key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(storeName, key, value, nil)
+}
+
+// Keys returns all live keys in a state store
+func (s *Sidecar) Keys(storeName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0)
+	for key := range s.stores[storeName] {
+		if s.lookup(storeName, key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// SetConfiguration sets a key in a configuration store and notifies the subscribers
+// watching it. An empty value is sent as is, as Dapr does when a key is deleted.
+func (s *Sidecar) SetConfiguration(storeName, key, value string) {
+	s.mu.Lock()
+	store, ok := s.configs[storeName]
+	if !ok {
+		store = make(map[string]*commonv1.ConfigurationItem)
+		s.configs[storeName] = store
+	}
+	s.configVersion++
+	item := &commonv1.ConfigurationItem{Value: value, Version: strconv.Itoa(s.configVersion)}
+	if value == "" {
+		delete(store, key)
+	} else {
+		store[key] = item
+	}
+
+	var subscribers []*configSubscription
+	for _, sub := range s.configSubscriptions {
+		if sub.storeName == storeName && watches(sub.keys, key) {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	// Sent without the lock, as a subscription that goes away takes it to unsubscribe
+	for _, sub := range subscribers {
+		select {
+		case sub.updates <- map[string]*commonv1.ConfigurationItem{key: item}:
+		case <-sub.done:
+		}
+	}
+}
+
+// LockOwner returns the owner holding a lock, if any
+func (s *Sidecar) LockOwner(storeName, resourceID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock := s.lock(storeName, resourceID)
+	if lock == nil {
+		return "", false
+	}
+	return lock.owner, true
+}
+
+// Published returns the events published to a topic
+func (s *Sidecar) Published(topic string) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make([]Event, 0)
+	for _, event := range s.published {
+		if event.Topic == topic {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Subscriptions fetches the subscriptions advertised by the app
+func (s *Sidecar) Subscriptions(ctx context.Context) ([]Subscription, error) {
+	s.mu.Lock()
+	appAddress := s.appAddress
+	s.mu.Unlock()
+
+	if appAddress == "" {
+		return nil, fmt.Errorf("app address not set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, appAddress+"/dapr/subscribe", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch subscriptions: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("app returned status %d from /dapr/subscribe", resp.StatusCode)
+	}
+
+	var raw []struct {
+		PubsubName string `json:"pubsubname"`
+		Topic      string `json:"topic"`
+		Route      string `json:"route"`
+		Routes     struct {
+			Default string `json:"default"`
+		} `json:"routes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode subscriptions: %w", err)
+	}
+
+	subscriptions := make([]Subscription, 0, len(raw))
+	for _, sub := range raw {
+		route := sub.Route
+		if route == "" {
+			route = sub.Routes.Default
+		}
+		subscriptions = append(subscriptions, Subscription{PubsubName: sub.PubsubName, Topic: sub.Topic, Route: route})
+	}
+	return subscriptions, nil
+}
+
+// Deliver wraps data in a CloudEvent and posts it to the app route subscribed to the topic
+func (s *Sidecar) Deliver(ctx context.Context, pubsubName, topic string, data []byte, contentType string) (*http.Response, error) {
+	subscriptions, err := s.Subscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subscriptions {
+		if sub.PubsubName == pubsubName && sub.Topic == topic {
+			return s.post(ctx, sub.Route, newCloudEvent(pubsubName, topic, data, contentType))
+		}
+	}
+	return nil, fmt.Errorf("app is not subscribed to %s/%s", pubsubName, topic)
+}
+
+// Publish records an event and delivers it to the app, as a publisher going through Dapr would
+func (s *Sidecar) Publish(ctx context.Context, pubsubName, topic string, data interface{}) (*http.Response, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event data: %w", err)
+	}
+
+	s.record(Event{PubsubName: pubsubName, Topic: topic, Data: payload, DataContentType: "application/json"})
+	return s.Deliver(ctx, pubsubName, topic, payload, "application/json")
+}
+
+func (s *Sidecar) post(ctx context.Context, route string, event map[string]interface{}) (*http.Response, error) {
+	s.mu.Lock()
+	appAddress := s.appAddress
+	s.mu.Unlock()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, appAddress+"/"+strings.TrimPrefix(route, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deliver event to %s: %w", route, err)
+	}
+
+	// Buffer the body so callers can inspect it after the connection is released
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	return resp, nil
+}
+
+func (s *Sidecar) record(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = append(s.published, event)
+}
+
+func newCloudEvent(pubsubName, topic string, data []byte, contentType string) map[string]interface{} {
+	event := map[string]interface{}{
+		"specversion":     "1.0",
+		"id":              strconv.FormatInt(time.Now().UnixNano(), 10),
+		"source":          "daprtest",
+		"type":            "com.dapr.event.sent",
+		"datacontenttype": contentType,
+		"pubsubname":      pubsubName,
+		"topic":           topic,
+	}
+	if strings.Contains(contentType, "json") && json.Valid(data) {
+		event["data"] = json.RawMessage(data)
+	} else {
+		event["data"] = string(data)
+	}
+	return event
+}
+
+// watches reports whether a subscription to keys covers key. No keys means every key.
+func watches(keys []string, key string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// lock returns a held lock, dropping it if it has expired. Callers hold s.mu.
+func (s *Sidecar) lock(storeName, resourceID string) *lockEntry {
+	key := storeName + "||" + resourceID
+	lock, ok := s.locks[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(lock.expires) {
+		delete(s.locks, key)
+		return nil
+	}
+	return lock
+}
+
+// lookup returns a live entry, dropping it if its TTL has passed. Callers hold s.mu.
+func (s *Sidecar) lookup(storeName, key string) *stateEntry {
+	entry, ok := s.stores[storeName][key]
+	if !ok {
+		return nil
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(s.stores[storeName], key)
+		return nil
+	}
+	return entry
+}
+
+// put stores a value and bumps its etag. Callers hold s.mu.
+func (s *Sidecar) put(storeName, key string, value []byte, metadata map[string]string) {
+	store, ok := s.stores[storeName]
+	if !ok {
+		store = make(map[string]*stateEntry)
+		s.stores[storeName] = store
+	}
+
+	etag := 1
+	if entry := s.lookup(storeName, key); entry != nil {
+		etag = entry.etag + 1
+	}
+
+	entry := &stateEntry{value: append([]byte(nil), value...), etag: etag}
+	if ttl, err := strconv.Atoi(metadata["ttlInSeconds"]); err == nil && ttl > 0 {
+		entry.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	store[key] = entry
+}
+
+// checkEtag rejects writes whose etag does not match the stored one. Callers hold s.mu.
+func (s *Sidecar) checkEtag(storeName, key string, etag *commonv1.Etag) error {
+	if etag == nil || etag.GetValue() == "" {
+		return nil
+	}
+	entry := s.lookup(storeName, key)
+	if entry == nil || strconv.Itoa(entry.etag) != etag.GetValue() {
+		return status.Errorf(codes.Aborted, "failed saving state in state store %s: possible etag mismatch", storeName)
+	}
+	return nil
+}
+
+// checkConcurrency enforces etag and first-write semantics for upserts. Callers hold s.mu.
+func (s *Sidecar) checkConcurrency(storeName string, item *commonv1.StateItem) error {
+	if item.GetEtag() != nil && item.GetEtag().GetValue() != "" {
+		return s.checkEtag(storeName, item.GetKey(), item.GetEtag())
+	}
+
+	if item.GetOptions().GetConcurrency() == commonv1.StateOptions_CONCURRENCY_FIRST_WRITE && s.lookup(storeName, item.GetKey()) != nil {
+		return status.Errorf(codes.Aborted, "failed saving state in state store %s: key %s already exists", storeName, item.GetKey())
+	}
+	return nil
+}
+
+// GetState implements the Dapr runtime API
+func (s *Sidecar) GetState(ctx context.Context, req *pb.GetStateRequest) (*pb.GetStateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.lookup(req.GetStoreName(), req.GetKey())
+	if entry == nil {
+		return &pb.GetStateResponse{}, nil
+	}
+	return &pb.GetStateResponse{Data: append([]byte(nil), entry.value...), Etag: strconv.Itoa(entry.etag)}, nil
+}
+
+// GetBulkState implements the Dapr runtime API
+func (s *Sidecar) GetBulkState(ctx context.Context, req *pb.GetBulkStateRequest) (*pb.GetBulkStateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &pb.GetBulkStateResponse{}
+	for _, key := range req.GetKeys() {
+		item := &pb.BulkStateItem{Key: key}
+		if entry := s.lookup(req.GetStoreName(), key); entry != nil {
+			item.Data = append([]byte(nil), entry.value...)
+			item.Etag = strconv.Itoa(entry.etag)
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	return resp, nil
+}
+
+// SaveState implements the Dapr runtime API
+func (s *Sidecar) SaveState(ctx context.Context, req *pb.SaveStateRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range req.GetStates() {
+		if err := s.checkConcurrency(req.GetStoreName(), item); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range req.GetStates() {
+		s.put(req.GetStoreName(), item.GetKey(), item.GetValue(), item.GetMetadata())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// DeleteState implements the Dapr runtime API
+func (s *Sidecar) DeleteState(ctx context.Context, req *pb.DeleteStateRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkEtag(req.GetStoreName(), req.GetKey(), req.GetEtag()); err != nil {
+		return nil, err
+	}
+	delete(s.stores[req.GetStoreName()], req.GetKey())
+	return &emptypb.Empty{}, nil
+}
+
+// ExecuteStateTransaction implements the Dapr runtime API, applying all operations or none
+func (s *Sidecar) ExecuteStateTransaction(ctx context.Context, req *pb.ExecuteStateTransactionRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, op := range req.GetOperations() {
+		switch op.GetOperationType() {
+		case "upsert":
+			if err := s.checkConcurrency(req.GetStoreName(), op.GetRequest()); err != nil {
+				return nil, err
+			}
+		case "delete":
+			if err := s.checkEtag(req.GetStoreName(), op.GetRequest().GetKey(), op.GetRequest().GetEtag()); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported operation type %q", op.GetOperationType())
+		}
+	}
+
+	for _, op := range req.GetOperations() {
+		item := op.GetRequest()
+		if op.GetOperationType() == "delete" {
+			delete(s.stores[req.GetStoreName()], item.GetKey())
+			continue
+		}
+		s.put(req.GetStoreName(), item.GetKey(), item.GetValue(), item.GetMetadata())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// PublishEvent implements the Dapr runtime API. Events are recorded and, when
+// the app address is set, delivered synchronously to the subscribed route.
+func (s *Sidecar) PublishEvent(ctx context.Context, req *pb.PublishEventRequest) (*emptypb.Empty, error) {
+	s.record(Event{
+		PubsubName:      req.GetPubsubName(),
+		Topic:           req.GetTopic(),
+		Data:            append([]byte(nil), req.GetData()...),
+		DataContentType: req.GetDataContentType(),
+		Metadata:        req.GetMetadata(),
+	})
+
+	s.mu.Lock()
+	appAddress := s.appAddress
+	s.mu.Unlock()
+	if appAddress == "" {
+		return &emptypb.Empty{}, nil
+	}
+
+	resp, err := s.Deliver(ctx, req.GetPubsubName(), req.GetTopic(), req.GetData(), req.GetDataContentType())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error when publishing to topic %s: %v", req.GetTopic(), err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, status.Errorf(codes.Internal, "app returned status %d for topic %s", resp.StatusCode, req.GetTopic())
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// GetMetadata implements the Dapr runtime API
+func (s *Sidecar) GetMetadata(ctx context.Context, _ *pb.GetMetadataRequest) (*pb.GetMetadataResponse, error) {
+	return &pb.GetMetadataResponse{
+		Id: s.appID,
+		RegisteredComponents: []*pb.RegisteredComponents{
+			{Name: "statestore", Type: "state.in-memory", Version: "v1"},
+			{Name: "orderpubsub", Type: "pubsub.in-memory", Version: "v1"},
+		},
+	}, nil
+}
+
+// BulkPublishEventAlpha1 implements the Dapr runtime API. Each entry is recorded and
+// delivered like a single event; the entries the app rejects are reported as failed.
+func (s *Sidecar) BulkPublishEventAlpha1(ctx context.Context, req *pb.BulkPublishRequest) (*pb.BulkPublishResponse, error) {
+	resp := &pb.BulkPublishResponse{}
+	for _, entry := range req.GetEntries() {
+		_, err := s.PublishEvent(ctx, &pb.PublishEventRequest{
+			PubsubName:      req.GetPubsubName(),
+			Topic:           req.GetTopic(),
+			Data:            entry.GetEvent(),
+			DataContentType: entry.GetContentType(),
+			Metadata:        entry.GetMetadata(),
+		})
+		if err != nil {
+			resp.FailedEntries = append(resp.FailedEntries, &pb.BulkPublishResponseFailedEntry{EntryId: entry.GetEntryId(), Error: err.Error()})
+		}
+	}
+	return resp, nil
+}
+
+// GetConfiguration implements the Dapr runtime API. No keys returns the whole store.
+func (s *Sidecar) GetConfiguration(ctx context.Context, req *pb.GetConfigurationRequest) (*pb.GetConfigurationResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &pb.GetConfigurationResponse{Items: make(map[string]*commonv1.ConfigurationItem)}
+	for key, item := range s.configs[req.GetStoreName()] {
+		if watches(req.GetKeys(), key) {
+			resp.Items[key] = &commonv1.ConfigurationItem{Value: item.GetValue(), Version: item.GetVersion()}
+		}
+	}
+	return resp, nil
+}
+
+// SubscribeConfiguration implements the Dapr runtime API. The first response carries only
+// the subscription ID, then every change made with SetConfiguration is streamed.
+func (s *Sidecar) SubscribeConfiguration(req *pb.SubscribeConfigurationRequest, stream pb.Dapr_SubscribeConfigurationServer) error {
+	s.mu.Lock()
+	s.subscriptionCount++
+	id := "subscription-" + strconv.Itoa(s.subscriptionCount)
+	sub := &configSubscription{
+		storeName: req.GetStoreName(),
+		keys:      req.GetKeys(),
+		updates:   make(chan map[string]*commonv1.ConfigurationItem),
+		done:      make(chan struct{}),
+	}
+	s.configSubscriptions[id] = sub
+	s.mu.Unlock()
+
+	defer s.unsubscribe(id)
+
+	if err := stream.Send(&pb.SubscribeConfigurationResponse{Id: id}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case items := <-sub.updates:
+			if err := stream.Send(&pb.SubscribeConfigurationResponse{Id: id, Items: items}); err != nil {
+				return err
+			}
+		case <-sub.done:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// UnsubscribeConfiguration implements the Dapr runtime API
+func (s *Sidecar) UnsubscribeConfiguration(ctx context.Context, req *pb.UnsubscribeConfigurationRequest) (*pb.UnsubscribeConfigurationResponse, error) {
+	if !s.unsubscribe(req.GetId()) {
+		return &pb.UnsubscribeConfigurationResponse{Message: "subscription " + req.GetId() + " does not exist"}, nil
+	}
+	return &pb.UnsubscribeConfigurationResponse{Ok: true}, nil
+}
+
+func (s *Sidecar) unsubscribe(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, ok := s.configSubscriptions[id]
+	if !ok {
+		return false
+	}
+	close(sub.done)
+	delete(s.configSubscriptions, id)
+	return true
+}
+
+// TryLockAlpha1 implements the Dapr runtime API
+func (s *Sidecar) TryLockAlpha1(ctx context.Context, req *pb.TryLockRequest) (*pb.TryLockResponse, error) {
+	if req.GetResourceId() == "" || req.GetLockOwner() == "" || req.GetExpiryInSeconds() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "resource ID, lock owner and a positive expiry are required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lock(req.GetStoreName(), req.GetResourceId()) != nil {
+		return &pb.TryLockResponse{Success: false}, nil
+	}
+	s.locks[req.GetStoreName()+"||"+req.GetResourceId()] = &lockEntry{
+		owner:   req.GetLockOwner(),
+		expires: time.Now().Add(time.Duration(req.GetExpiryInSeconds()) * time.Second),
+	}
+	return &pb.TryLockResponse{Success: true}, nil
+}
+
+// UnlockAlpha1 implements the Dapr runtime API
+func (s *Sidecar) UnlockAlpha1(ctx context.Context, req *pb.UnlockRequest) (*pb.UnlockResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock := s.lock(req.GetStoreName(), req.GetResourceId())
+	switch {
+	case lock == nil:
+		return &pb.UnlockResponse{Status: pb.UnlockResponse_LOCK_DOES_NOT_EXIST}, nil
+	case lock.owner != req.GetLockOwner():
+		return &pb.UnlockResponse{Status: pb.UnlockResponse_LOCK_BELONGS_TO_OTHERS}, nil
+	}
+	delete(s.locks, req.GetStoreName()+"||"+req.GetResourceId())
+	return &pb.UnlockResponse{Status: pb.UnlockResponse_SUCCESS}, nil
+}
@@ -0,0 +1,172 @@
+// stock-management-app/daprtest/sidecar_test.go
+
+package daprtest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// connect starts a sidecar and a client connected to it
+func connect(t *testing.T) (*Sidecar, dapr.Client) {
+	t.Helper()
+	sidecar := Start(t)
+	client, err := dapr.NewClientWithAddress(sidecar.Address())
+	if err != nil {
+		t.Fatalf("connecting to the sidecar: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return sidecar, client
+}
+
+func TestStateETags(t *testing.T) {
+	_, client := connect(t)
+	ctx := context.Background()
+
+	if err := client.SaveState(ctx, "statestore", "key", []byte("v1"), nil); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+	item, err := client.GetState(ctx, "statestore", "key", nil)
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if string(item.Value) != "v1" || item.Etag == "" {
+		t.Fatalf("GetState = %q etag %q, want v1 with an etag", item.Value, item.Etag)
+	}
+
+	if err := client.SaveStateWithETag(ctx, "statestore", "key", []byte("v2"), item.Etag, nil); err != nil {
+		t.Fatalf("SaveStateWithETag with the current etag: %v", err)
+	}
+	err = client.SaveStateWithETag(ctx, "statestore", "key", []byte("v3"), item.Etag, nil)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("SaveStateWithETag with a stale etag = %v, want Aborted", err)
+	}
+}
+
+func TestConfiguration(t *testing.T) {
+	sidecar, client := connect(t)
+	ctx := context.Background()
+	sidecar.SetConfiguration("configstore", "watched", "1")
+	sidecar.SetConfiguration("configstore", "other", "2")
+
+	items, err := client.GetConfigurationItems(ctx, "configstore", []string{"watched"})
+	if err != nil {
+		t.Fatalf("GetConfigurationItems: %v", err)
+	}
+	if len(items) != 1 || items["watched"].Value != "1" {
+		t.Fatalf("GetConfigurationItems = %v, want watched=1 only", items)
+	}
+
+	updates := make(chan string, 4)
+	id, err := client.SubscribeConfigurationItems(ctx, "configstore", []string{"watched"}, func(_ string, items map[string]*dapr.ConfigurationItem) {
+		for key, item := range items {
+			updates <- key + "=" + item.Value
+		}
+	})
+	if err != nil {
+		t.Fatalf("SubscribeConfigurationItems: %v", err)
+	}
+
+	sidecar.SetConfiguration("configstore", "other", "3")
+	sidecar.SetConfiguration("configstore", "watched", "4")
+	select {
+	case got := <-updates:
+		if got != "watched=4" {
+			t.Errorf("update = %s, want watched=4", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+
+	if err := client.UnsubscribeConfigurationItems(ctx, "configstore", id); err != nil {
+		t.Fatalf("UnsubscribeConfigurationItems: %v", err)
+	}
+	if err := client.UnsubscribeConfigurationItems(ctx, "configstore", id); err == nil {
+		t.Error("unsubscribing twice succeeded")
+	}
+}
+
+func TestLocks(t *testing.T) {
+	sidecar, client := connect(t)
+	ctx := context.Background()
+	lock := func(owner string) bool {
+		t.Helper()
+		resp, err := client.TryLockAlpha1(ctx, "lockstore", &dapr.LockRequest{ResourceID: "job", LockOwner: owner, ExpiryInSeconds: 60})
+		if err != nil {
+			t.Fatalf("TryLockAlpha1: %v", err)
+		}
+		return resp.Success
+	}
+
+	if !lock("a") {
+		t.Fatal("first lock failed")
+	}
+	if lock("b") {
+		t.Fatal("lock held by a was taken by b")
+	}
+	if owner, ok := sidecar.LockOwner("lockstore", "job"); !ok || owner != "a" {
+		t.Fatalf("LockOwner = %q, %v, want a", owner, ok)
+	}
+
+	resp, err := client.UnlockAlpha1(ctx, "lockstore", &dapr.UnlockRequest{ResourceID: "job", LockOwner: "b"})
+	if err != nil || resp.Status != "LOCK_BELONGS_TO_OTHERS" {
+		t.Fatalf("UnlockAlpha1 by b = %v, %v, want LOCK_BELONGS_TO_OTHERS", resp, err)
+	}
+	resp, err = client.UnlockAlpha1(ctx, "lockstore", &dapr.UnlockRequest{ResourceID: "job", LockOwner: "a"})
+	if err != nil || resp.Status != "SUCCESS" {
+		t.Fatalf("UnlockAlpha1 by a = %v, %v, want SUCCESS", resp, err)
+	}
+	if !lock("b") {
+		t.Fatal("lock could not be taken once released")
+	}
+}
+
+func TestBulkPublishDeliversEachEntry(t *testing.T) {
+	sidecar, client := connect(t)
+
+	var delivered []int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dapr/subscribe", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"pubsubname":"orderpubsub","topic":"orders","route":"/orders"}]`))
+	})
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		var event struct {
+			Data struct {
+				Id int `json:"id"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if event.Data.Id < 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		delivered = append(delivered, event.Data.Id)
+	})
+	app := httptest.NewServer(mux)
+	t.Cleanup(app.Close)
+	sidecar.SetAppAddress(app.URL)
+
+	resp := client.PublishEvents(context.Background(), "orderpubsub", "orders", []interface{}{
+		map[string]int{"id": 1}, map[string]int{"id": -1}, map[string]int{"id": 2},
+	})
+	if resp.Error == nil || len(resp.FailedEvents) != 1 {
+		t.Fatalf("PublishEvents failed %d events (%v), want 1", len(resp.FailedEvents), resp.Error)
+	}
+	if len(delivered) != 2 || delivered[0] != 1 || delivered[1] != 2 {
+		t.Errorf("delivered %v, want [1 2]", delivered)
+	}
+	if got := len(sidecar.Published("orders")); got != 3 {
+		t.Errorf("recorded %d events, want 3", got)
+	}
+}
@@ -0,0 +1,180 @@
+// stock-management-app/events_test.go
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+
+	"stock-management-app/daprtest"
+)
+
+// connectSidecar starts a fake sidecar and connects a Dapr client to it
+func connectSidecar(t *testing.T) (*daprtest.Sidecar, dapr.Client) {
+	t.Helper()
+	sidecar := daprtest.Start(t)
+	client, err := dapr.NewClientWithAddress(sidecar.Address())
+	if err != nil {
+		t.Fatalf("connecting to the sidecar: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return sidecar, client
+}
+
+// newSidecarApp connects a Dapr client to a fake sidecar and serves the callback channel
+// of the default tenant's catalog, holding products, on a local port the sidecar delivers to
+func newSidecarApp(t *testing.T, products ...Product) (*daprtest.Sidecar, dapr.Client, ProductRepository) {
+	t.Helper()
+	cfg, auth := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+
+	repo := newAuditedProductRepository(newDaprProductRepository(client), newMemoryAuditStore())
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	for _, product := range products {
+		if _, _, err := saveProduct(ctx, repo, product); err != nil {
+			t.Fatalf("saveProduct(%d): %v", product.Id, err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	gin.SetMode(gin.TestMode)
+	service, err := newHTTPCallbackService(address, gin.New(), stockSubscriptions(repo), auth)
+	if err != nil {
+		t.Fatalf("newHTTPCallbackService: %v", err)
+	}
+	go func() {
+		_ = service.Start()
+	}()
+	t.Cleanup(func() { _ = service.Stop() })
+
+	sidecar.SetAppAddress("http://" + address)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := sidecar.Subscriptions(context.Background()); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("callback service did not come up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return sidecar, client, repo
+}
+
+// expectQuantity checks the stock of a product of the default tenant
+func expectQuantity(t *testing.T, repo ProductRepository, id, want int) {
+	t.Helper()
+	ctx := withTenant(context.Background(), config().DefaultTenant, tenantSourceJob)
+	product, err := repo.GetProduct(ctx, id)
+	if err != nil {
+		t.Fatalf("GetProduct(%d): %v", id, err)
+	}
+	if product.Quantity != want {
+		t.Errorf("quantity of product %d = %d, want %d", id, product.Quantity, want)
+	}
+}
+
+func TestStockUpdateEventDeliveredBySidecar(t *testing.T) {
+	sidecar, _, repo := newSidecarApp(t,
+		Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 5},
+		Product{Id: 2, Name: "Lamp", Category: "lighting", Price: 45, Quantity: 7},
+	)
+
+	resp, err := sidecar.Publish(context.Background(), config().PubsubName, config().StockUpdateTopic, StockUpdateRequest{
+		Updates: []ProductUpdate{{Id: 1, PurchaseQty: 2}, {Id: 2, PurchaseQty: 7}},
+	})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delivery status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	expectQuantity(t, repo, 1, 3)
+	expectQuantity(t, repo, 2, 0)
+}
+
+func TestStockUpdateEventPublishedThroughClient(t *testing.T) {
+	sidecar, client, repo := newSidecarApp(t, Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 5})
+
+	err := client.PublishEvent(context.Background(), config().PubsubName, config().StockUpdateTopic, StockUpdateRequest{
+		Updates: []ProductUpdate{{Id: 1, PurchaseQty: 1}},
+	})
+	if err != nil {
+		t.Fatalf("PublishEvent: %v", err)
+	}
+
+	if got := len(sidecar.Published(config().StockUpdateTopic)); got != 1 {
+		t.Errorf("published %d events, want 1", got)
+	}
+	expectQuantity(t, repo, 1, 4)
+}
+
+func TestStockUpdateEventForUnknownProductIsDropped(t *testing.T) {
+	sidecar, _, repo := newSidecarApp(t, Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 5})
+
+	resp, err := sidecar.Publish(context.Background(), config().PubsubName, config().StockUpdateTopic, StockUpdateRequest{
+		Updates: []ProductUpdate{{Id: 99, PurchaseQty: 1}},
+	})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("delivery status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	expectQuantity(t, repo, 1, 5)
+}
+
+func TestOversizedStockUpdateEventIsRejected(t *testing.T) {
+	sidecar, _, repo := newSidecarApp(t, Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 5})
+	cfg := *config()
+	cfg.MaxRequestBodyBytes = 128
+	currentConfig.Store(&cfg)
+
+	updates := make([]ProductUpdate, 20)
+	for i := range updates {
+		updates[i] = ProductUpdate{Id: 1, PurchaseQty: 1}
+	}
+	resp, err := sidecar.Publish(context.Background(), cfg.PubsubName, cfg.StockUpdateTopic, StockUpdateRequest{Updates: updates})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("delivery status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	expectQuantity(t, repo, 1, 5)
+}
+
+func TestFeatureFlagsFollowConfigurationStore(t *testing.T) {
+	sidecar, client, _ := newSidecarApp(t)
+	t.Cleanup(resetFeatureFlags)
+	sidecar.SetConfiguration("configstore", featureFlagKeyPrefix+featureBackorders, "false")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchFeatureFlags(ctx, client, "configstore")
+	if featureEnabled(featureBackorders) {
+		t.Fatal("backorders enabled, want the value read from the store")
+	}
+
+	// The subscription is made in the background, so keep changing the flag until it is seen
+	deadline := time.Now().Add(5 * time.Second)
+	for !featureEnabled(featureBackorders) {
+		if time.Now().After(deadline) {
+			t.Fatal("flag change was not picked up from the subscription")
+		}
+		sidecar.SetConfiguration("configstore", featureFlagKeyPrefix+featureBackorders, "true")
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,356 @@
+// stock-management-app/export.go
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Export formats accepted by GET /export/products
+const (
+	exportFormatCSV         = "csv"
+	exportFormatJSONL       = "jsonl"
+	exportFormatMerchantXML = "merchant-xml"
+)
+
+// exportFields are the fields that can be selected with ?fields=, in default column order
+var exportFields = []string{"id", "name", "category", "price", "description", "imageUrl", "quantity", "tags", "availability"}
+
+// productFilter narrows product listings and exports
+type productFilter struct {
+	Category string
+	Tag      string
+	InStock  *bool
+	MinPrice *float64
+	MaxPrice *float64
+}
+
+// parseProductFilter reads the category, tag, inStock, minPrice and maxPrice query parameters
+func parseProductFilter(c *gin.Context) (productFilter, error) {
+	filter := productFilter{
+		Category: c.Query("category"),
+		Tag:      c.Query("tag"),
+	}
+
+	if value := c.Query("inStock"); value != "" {
+		inStock, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid inStock value %q", value)
+		}
+		filter.InStock = &inStock
+	}
+	for name, target := range map[string]**float64{"minPrice": &filter.MinPrice, "maxPrice": &filter.MaxPrice} {
+		if value := c.Query(name); value != "" {
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s value %q", name, value)
+			}
+			*target = &price
+		}
+	}
+	return filter, nil
+}
+
+// matches reports whether a product passes every filter that is set
+func (f productFilter) matches(product Product) bool {
+	if f.Category != "" && !strings.EqualFold(product.Category, f.Category) {
+		return false
+	}
+	if f.Tag != "" {
+		found := false
+		for _, tag := range product.Tags {
+			if strings.EqualFold(tag, f.Tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.InStock != nil && (product.Quantity > 0) != *f.InStock {
+		return false
+	}
+	if f.MinPrice != nil && product.Price < *f.MinPrice {
+		return false
+	}
+	if f.MaxPrice != nil && product.Price > *f.MaxPrice {
+		return false
+	}
+	return true
+}
+
+// productAvailability derives the feed availability value from the stock level
+func productAvailability(product Product) string {
+	if product.Quantity > 0 {
+		return "in stock"
+	}
+	return "out of stock"
+}
+
+// exportProducts streams the catalog as CSV, JSON Lines or a Google Merchant RSS feed.
+// Products are read and written one at a time so the whole catalog is never held in memory.
+func exportProducts(c *gin.Context, repo ProductRepository) {
+	format := c.DefaultQuery("format", exportFormatCSV)
+	if format != exportFormatCSV && format != exportFormatJSONL && format != exportFormatMerchantXML {
+		abortWithError(c, newBadRequestError("Unsupported export format %q: expected %s, %s or %s", format, exportFormatCSV, exportFormatJSONL, exportFormatMerchantXML))
+		return
+	}
+
+	filter, err := parseProductFilter(c)
+	if err != nil {
+		abortWithError(c, newBadRequestError("%v", err))
+		return
+	}
+
+	fields := exportFields
+	if value := c.Query("fields"); value != "" {
+		if format == exportFormatMerchantXML {
+			abortWithError(c, newBadRequestError("Field selection is not supported for the merchant feed"))
+			return
+		}
+		fields = strings.Split(value, ",")
+		for _, field := range fields {
+			if !containsString(exportFields, field) {
+				abortWithError(c, newBadRequestError("Unknown field %q", field))
+				return
+			}
+		}
+	}
+
+	ctx := c.Request.Context()
+	productIDs, err := repo.GetProductIDs(ctx)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	var writer productExportWriter
+	switch format {
+	case exportFormatCSV:
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="products.csv"`)
+		writer = &csvExportWriter{writer: csv.NewWriter(c.Writer), fields: fields}
+	case exportFormatJSONL:
+		c.Header("Content-Type", "application/x-ndjson")
+		writer = &jsonlExportWriter{encoder: json.NewEncoder(c.Writer), fields: fields}
+	default:
+		c.Header("Content-Type", "application/xml; charset=utf-8")
+		settings := tenantConfig(c.Request.Context())
+		writer = &merchantFeedWriter{encoder: xml.NewEncoder(c.Writer), storefrontURL: settings.StorefrontURL, currency: settings.MerchantCurrency}
+	}
+	c.Status(http.StatusOK)
+
+	if err := writer.Begin(); err != nil {
+		slog.WarnContext(ctx, "Failed to start export", "format", format, "error", err)
+		return
+	}
+
+	exported := 0
+	for _, id := range productIDs {
+		product, err := repo.GetProduct(ctx, id)
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "Client went away during export", "format", format, "exported", exported)
+			return
+		}
+		if errors.Is(err, errProductNotFound) {
+			// Deleted since the IDs were read
+			continue
+		}
+		if err != nil {
+			// Leave the export unfinished so the client does not take it for the whole catalog
+			slog.ErrorContext(ctx, "Failed to retrieve product, aborting export", "productId", id, "format", format, "exported", exported, "error", err)
+			_ = c.Error(fmt.Errorf("%w: %w", errResponseTruncated, err))
+			return
+		}
+		if !filter.matches(product) {
+			continue
+		}
+
+		if err := writer.Write(product); err != nil {
+			// The client has most likely gone away, there is no way to report an error mid-stream
+			slog.InfoContext(ctx, "Failed to write product to export", "productId", id, "format", format, "error", err)
+			return
+		}
+		c.Writer.Flush()
+		exported++
+	}
+
+	if err := writer.End(); err != nil {
+		slog.WarnContext(ctx, "Failed to finish export", "format", format, "error", err)
+		return
+	}
+	c.Writer.Flush()
+	slog.InfoContext(ctx, "Exported products", "format", format, "exported", exported)
+}
+
+// productExportWriter writes products to an export stream
+type productExportWriter interface {
+	Begin() error
+	Write(product Product) error
+	End() error
+}
+
+// exportFieldValue returns the value of a selectable export field
+func exportFieldValue(product Product, field string) interface{} {
+	switch field {
+	case "id":
+		return product.Id
+	case "name":
+		return product.Name
+	case "category":
+		return product.Category
+	case "price":
+		return product.Price
+	case "description":
+		return product.Description
+	case "imageUrl":
+		return product.ImageUrl
+	case "quantity":
+		return product.Quantity
+	case "tags":
+		if product.Tags == nil {
+			return []string{}
+		}
+		return product.Tags
+	case "availability":
+		return productAvailability(product)
+	}
+	return nil
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+	fields []string
+}
+
+func (w *csvExportWriter) Begin() error {
+	return w.flush(w.writer.Write(w.fields))
+}
+
+func (w *csvExportWriter) Write(product Product) error {
+	record := make([]string, len(w.fields))
+	for i, field := range w.fields {
+		switch value := exportFieldValue(product, field).(type) {
+		case []string:
+			record[i] = strings.Join(value, "|")
+		case float64:
+			record[i] = strconv.FormatFloat(value, 'f', 2, 64)
+		default:
+			record[i] = fmt.Sprint(value)
+		}
+	}
+	return w.flush(w.writer.Write(record))
+}
+
+func (w *csvExportWriter) End() error {
+	return nil
+}
+
+func (w *csvExportWriter) flush(err error) error {
+	if err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type jsonlExportWriter struct {
+	encoder *json.Encoder
+	fields  []string
+}
+
+func (w *jsonlExportWriter) Begin() error {
+	return nil
+}
+
+func (w *jsonlExportWriter) Write(product Product) error {
+	record := make(map[string]interface{}, len(w.fields))
+	for _, field := range w.fields {
+		record[field] = exportFieldValue(product, field)
+	}
+	return w.encoder.Encode(record)
+}
+
+func (w *jsonlExportWriter) End() error {
+	return nil
+}
+
+// merchantFeedItem is a product in the Google Merchant Center RSS 2.0 format
+type merchantFeedItem struct {
+	XMLName      xml.Name `xml:"item"`
+	Id           string   `xml:"g:id"`
+	Title        string   `xml:"g:title"`
+	Description  string   `xml:"g:description"`
+	Link         string   `xml:"g:link"`
+	ImageLink    string   `xml:"g:image_link"`
+	Availability string   `xml:"g:availability"`
+	Price        string   `xml:"g:price"`
+	ProductType  string   `xml:"g:product_type,omitempty"`
+}
+
+type merchantFeedWriter struct {
+	encoder       *xml.Encoder
+	storefrontURL string
+	currency      string
+}
+
+func (w *merchantFeedWriter) Begin() error {
+	tokens := []xml.Token{
+		xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)},
+		xml.StartElement{Name: xml.Name{Local: "rss"}, Attr: []xml.Attr{
+			{Name: xml.Name{Local: "version"}, Value: "2.0"},
+			{Name: xml.Name{Local: "xmlns:g"}, Value: "http://base.google.com/ns/1.0"},
+		}},
+		xml.StartElement{Name: xml.Name{Local: "channel"}},
+	}
+	for _, token := range tokens {
+		if err := w.encoder.EncodeToken(token); err != nil {
+			return err
+		}
+	}
+
+	channel := [][2]string{{"title", "Product catalog"}, {"link", w.storefrontURL}, {"description", "Stock management product feed"}}
+	for _, element := range channel {
+		if err := w.encoder.EncodeElement(element[1], xml.StartElement{Name: xml.Name{Local: element[0]}}); err != nil {
+			return err
+		}
+	}
+	return w.encoder.Flush()
+}
+
+func (w *merchantFeedWriter) Write(product Product) error {
+	item := merchantFeedItem{
+		Id:           strconv.Itoa(product.Id),
+		Title:        product.Name,
+		Description:  product.Description,
+		Link:         strings.TrimSuffix(w.storefrontURL, "/") + "/products?id=" + strconv.Itoa(product.Id),
+		ImageLink:    product.ImageUrl,
+		Availability: productAvailability(product),
+		Price:        strconv.FormatFloat(product.Price, 'f', 2, 64) + " " + w.currency,
+		ProductType:  product.Category,
+	}
+	if err := w.encoder.Encode(item); err != nil {
+		return err
+	}
+	return w.encoder.Flush()
+}
+
+func (w *merchantFeedWriter) End() error {
+	for _, name := range []string{"channel", "rss"} {
+		if err := w.encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
+		}
+	}
+	return w.encoder.Flush()
+}
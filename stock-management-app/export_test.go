@@ -0,0 +1,66 @@
+// stock-management-app/export_test.go
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// unavailableRepository fails to read one product as when the sidecar cannot be reached
+type unavailableRepository struct {
+	ProductRepository
+	id int
+}
+
+func (r *unavailableRepository) GetProduct(ctx context.Context, id int) (Product, error) {
+	if id == r.id {
+		return Product{}, &unavailableError{Err: context.DeadlineExceeded}
+	}
+	return r.ProductRepository.GetProduct(ctx, id)
+}
+
+func TestExportIsAbortedWhenTheStateStoreFails(t *testing.T) {
+	for _, format := range []string{exportFormatCSV, exportFormatJSONL, exportFormatMerchantXML} {
+		t.Run(format, func(t *testing.T) {
+			audit := newMemoryAuditStore()
+			repo := &unavailableRepository{ProductRepository: newAuditedProductRepository(newMemoryProductRepository(), audit), id: 2}
+			server := httptest.NewServer(newTestAPIWithRepository(t, repo, audit,
+				Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 3},
+				Product{Id: 2, Name: "Lamp", Category: "lighting", Price: 45, Quantity: 7},
+			))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/export/products?format=" + format)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err == nil {
+				t.Fatalf("export read to the end, want it aborted: %s", body)
+			}
+			if !strings.Contains(string(body), "Mug") {
+				t.Errorf("export %q, want the products read before the failure", body)
+			}
+		})
+	}
+}
+
+func TestExportSkipsDeletedProducts(t *testing.T) {
+	api, repo := newTestAPI(t, Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 3})
+	ctx := withTenant(context.Background(), config().DefaultTenant, tenantSourceJob)
+	productIDs, _ := repo.GetProductIDs(ctx)
+	if err := repo.SaveProductIDs(ctx, append(productIDs, 2)); err != nil {
+		t.Fatalf("indexing a deleted product: %v", err)
+	}
+
+	w := serve(t, api, http.MethodGet, "/export/products?format=jsonl", "")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "\n") != 1 {
+		t.Fatalf("export = %d %q, want the one product", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,146 @@
+// stock-management-app/features.go
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+)
+
+// Feature flags handlers can branch on
+const (
+	// featureBackorders lets purchases take stock below zero, turned off they are rejected instead
+	featureBackorders = "backorders"
+	// featurePriceRounding rounds the prices of stored products to whole cents
+	featurePriceRounding = "price-rounding"
+)
+
+// featureFlagKeyPrefix prefixes the name of each flag in the configuration store
+const featureFlagKeyPrefix = "feature."
+
+// featureFlag describes a flag and its value while the configuration store has none
+type featureFlag struct {
+	Name        string
+	Description string
+	Default     bool
+}
+
+var featureFlags = []featureFlag{
+	{Name: featureBackorders, Description: "Accept purchases beyond the stock on hand", Default: true},
+	{Name: featurePriceRounding, Description: "Round product prices to whole cents when stored", Default: false},
+}
+
+// FeatureFlagState is the current value of a flag as shown by GET /admin/features
+type FeatureFlagState struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	Source      string `json:"source"`
+}
+
+var (
+	currentFeatureFlags atomic.Pointer[map[string]FeatureFlagState]
+
+	// featureFlagsMu serializes updates so concurrent ones do not overwrite each other
+	featureFlagsMu sync.Mutex
+)
+
+func init() {
+	resetFeatureFlags()
+}
+
+// featureEnabled reports whether a flag is on. Unknown flags are off.
+func featureEnabled(name string) bool {
+	return (*currentFeatureFlags.Load())[name].Enabled
+}
+
+// resetFeatureFlags puts every flag back to its default
+func resetFeatureFlags() {
+	featureFlagsMu.Lock()
+	defer featureFlagsMu.Unlock()
+
+	flags := make(map[string]FeatureFlagState, len(featureFlags))
+	for _, flag := range featureFlags {
+		flags[flag.Name] = FeatureFlagState{
+			Name:        flag.Name,
+			Description: flag.Description,
+			Enabled:     flag.Default,
+			Default:     flag.Default,
+			Source:      configSourceDefault,
+		}
+	}
+	currentFeatureFlags.Store(&flags)
+}
+
+// applyFeatureFlags updates the flags found in items. An empty value, as sent when a key is
+// deleted, restores the default; values that are not booleans are ignored.
+func applyFeatureFlags(items map[string]*dapr.ConfigurationItem) {
+	featureFlagsMu.Lock()
+	defer featureFlagsMu.Unlock()
+
+	old := *currentFeatureFlags.Load()
+	flags := make(map[string]FeatureFlagState, len(old))
+	for name, state := range old {
+		flags[name] = state
+	}
+
+	for _, flag := range featureFlags {
+		item, ok := items[featureFlagKeyPrefix+flag.Name]
+		if !ok || item == nil {
+			continue
+		}
+		state := flags[flag.Name]
+		value := strings.TrimSpace(item.Value)
+		if value == "" {
+			state.Enabled, state.Source = flag.Default, configSourceDefault
+		} else if enabled, err := strconv.ParseBool(value); err == nil {
+			state.Enabled, state.Source = enabled, configSourceDapr
+		} else {
+			slog.Warn("Ignoring feature flag with a value that is not a boolean", "flag", flag.Name, "value", value)
+			continue
+		}
+		if state.Enabled != old[flag.Name].Enabled {
+			slog.Info("Feature flag changed", "flag", flag.Name, "enabled", state.Enabled, "source", state.Source)
+		}
+		flags[flag.Name] = state
+	}
+	currentFeatureFlags.Store(&flags)
+}
+
+// featureFlagStates lists the flags by name
+func featureFlagStates() []FeatureFlagState {
+	flags := *currentFeatureFlags.Load()
+	states := make([]FeatureFlagState, 0, len(featureFlags))
+	for _, flag := range featureFlags {
+		states = append(states, flags[flag.Name])
+	}
+	return states
+}
+
+// getFeatureFlags shows the current value of every flag and where it came from
+func getFeatureFlags(c *gin.Context) {
+	respond(c, http.StatusOK, featureFlagStates(), "")
+}
+
+// watchFeatureFlags reads the flags from the Dapr configuration store and follows their
+// changes until ctx is done. The defaults stay in effect while the store cannot be read.
+func watchFeatureFlags(ctx context.Context, client dapr.Client, storeName string) {
+	keys := make([]string, len(featureFlags))
+	for i, flag := range featureFlags {
+		keys[i] = featureFlagKeyPrefix + flag.Name
+	}
+
+	followConfigurationStore(ctx, client, storeName, keys, func(items map[string]*dapr.ConfigurationItem) error {
+		applyFeatureFlags(items)
+		return nil
+	})
+}
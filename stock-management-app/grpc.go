@@ -0,0 +1,371 @@
+// stock-management-app/grpc.go
+
+package main
+
+//go:generate protoc -I proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative stock.proto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dapr/go-sdk/service/common"
+	daprd "github.com/dapr/go-sdk/service/grpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// newGRPCService registers the catalog and inventory services, server reflection and the Dapr
+// app callback on one gRPC server. Dapr can reach the RPCs through gRPC proxying or invoke
+// them by name, e.g. "stock.v1.CatalogService/GetProduct", with a JSON or protobuf payload.
+// Topic subscriptions are only passed in when the callback channel uses gRPC. RPCs draw from
+// the rate limits of limiter, which the HTTP API shares.
+func newGRPCService(lis net.Listener, repo ProductRepository, subscriptions []topicSubscription, auth *authChain, limiter *rateLimiter) (*grpc.Server, common.Service, error) {
+	server := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(
+			correlationUnaryInterceptor,
+			authUnaryInterceptor(auth),
+			rateLimitUnaryInterceptor(limiter),
+			eventTraceInterceptor,
+			tenantUnaryInterceptor,
+			subscriptionsInterceptor(subscriptions),
+			bulkEventInterceptor(subscriptions),
+		),
+		grpc.ChainStreamInterceptor(correlationStreamInterceptor, authStreamInterceptor(auth), tenantStreamInterceptor),
+	)
+
+	catalog := &catalogServer{repo: repo}
+	inventory := &inventoryServer{repo: repo}
+	RegisterCatalogServiceServer(server, catalog)
+	RegisterInventoryServiceServer(server, inventory)
+	reflection.Register(server)
+
+	service := daprd.NewServiceWithGrpcServer(lis, server)
+	handlers := map[string]common.ServiceInvocationHandler{
+		CatalogService_GetProduct_FullMethodName: daprInvocationHandler(
+			func() proto.Message { return &GetProductRequest{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return catalog.GetProduct(ctx, req.(*GetProductRequest))
+			}),
+		CatalogService_ListProducts_FullMethodName: daprInvocationHandler(
+			func() proto.Message { return &ListProductsRequest{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return catalog.ListProducts(ctx, req.(*ListProductsRequest))
+			}),
+		CatalogService_UpsertProduct_FullMethodName: daprInvocationHandler(
+			func() proto.Message { return &UpsertProductRequest{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return catalog.UpsertProduct(ctx, req.(*UpsertProductRequest))
+			}),
+		InventoryService_ApplyStockUpdates_FullMethodName: daprInvocationHandler(
+			func() proto.Message { return &ApplyStockUpdatesRequest{} },
+			func(ctx context.Context, req proto.Message) (proto.Message, error) {
+				return inventory.ApplyStockUpdates(ctx, req.(*ApplyStockUpdatesRequest))
+			}),
+	}
+	for method, handler := range handlers {
+		if err := service.AddServiceInvocationHandler(strings.TrimPrefix(method, "/"), handler); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := registerTopicHandlers(service, subscriptions); err != nil {
+		return nil, nil, err
+	}
+	return server, service, nil
+}
+
+// daprInvocationHandler adapts a unary RPC to Dapr service invocation. Payloads are protobuf
+// when the content type says so and protobuf JSON otherwise; the reply uses the same encoding.
+func daprInvocationHandler(newRequest func() proto.Message, call func(ctx context.Context, req proto.Message) (proto.Message, error)) common.ServiceInvocationHandler {
+	return func(ctx context.Context, in *common.InvocationEvent) (*common.Content, error) {
+		binary := in.ContentType == "application/x-protobuf" || in.ContentType == "application/protobuf"
+
+		req := newRequest()
+		if len(in.Data) > 0 {
+			var err error
+			if binary {
+				err = proto.Unmarshal(in.Data, req)
+			} else {
+				err = protojson.Unmarshal(in.Data, req)
+			}
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid request payload: %v", err)
+			}
+		}
+
+		resp, err := call(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if binary {
+			data, err := proto.Marshal(resp)
+			return &common.Content{Data: data, ContentType: in.ContentType}, err
+		}
+		data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(resp)
+		return &common.Content{Data: data, ContentType: "application/json"}, err
+	}
+}
+
+// catalogServer implements CatalogService on top of the same repository as the HTTP API
+type catalogServer struct {
+	UnimplementedCatalogServiceServer
+	repo ProductRepository
+}
+
+func (s *catalogServer) GetProduct(ctx context.Context, req *GetProductRequest) (*CatalogProduct, error) {
+	product, err := s.repo.GetProduct(ctx, int(req.GetId()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return productToProto(product), nil
+}
+
+func (s *catalogServer) ListProducts(ctx context.Context, req *ListProductsRequest) (*ListProductsResponse, error) {
+	filter := productFilter{
+		Category: req.GetCategory(),
+		Tag:      req.GetTag(),
+		InStock:  req.InStock,
+		MinPrice: req.MinPrice,
+		MaxPrice: req.MaxPrice,
+	}
+	products, err := listProducts(ctx, s.repo, filter)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	resp := &ListProductsResponse{Products: make([]*CatalogProduct, len(products))}
+	for i, product := range products {
+		resp.Products[i] = productToProto(product)
+	}
+	return resp, nil
+}
+
+func (s *catalogServer) UpsertProduct(ctx context.Context, req *UpsertProductRequest) (*CatalogProduct, error) {
+	if req.GetProduct() == nil {
+		return nil, status.Error(codes.InvalidArgument, "product is required")
+	}
+
+	product := productFromProto(req.GetProduct())
+	if errs := validateProduct(product); len(errs) > 0 {
+		return nil, grpcError(ctx, newValidationError(errs))
+	}
+	product, _, err := saveProduct(ctx, s.repo, product)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return productToProto(product), nil
+}
+
+// inventoryServer implements InventoryService with the stock update logic used by /updateStock
+type inventoryServer struct {
+	UnimplementedInventoryServiceServer
+	repo ProductRepository
+}
+
+func (s *inventoryServer) ApplyStockUpdates(ctx context.Context, req *ApplyStockUpdatesRequest) (*ApplyStockUpdatesResponse, error) {
+	updates := make([]ProductUpdate, len(req.GetUpdates()))
+	for i, update := range req.GetUpdates() {
+		updates[i] = ProductUpdate{Id: int(update.GetId()), PurchaseQty: int(update.GetPurchaseQty())}
+	}
+	if errs := validateStockUpdateRequest(StockUpdateRequest{Updates: updates}); len(errs) > 0 {
+		countStockUpdate(stockUpdateSourceGRPC, stockUpdateFailed)
+		return nil, grpcError(ctx, newValidationError(errs))
+	}
+
+	products, err := applyStockUpdates(ctx, s.repo, updates)
+	countStockUpdate(stockUpdateSourceGRPC, stockUpdateResult(err, false))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	resp := &ApplyStockUpdatesResponse{Levels: make([]*StockLevel, len(products))}
+	for i, product := range products {
+		resp.Levels[i] = stockLevel(product)
+	}
+	return resp, nil
+}
+
+func (s *inventoryServer) WatchStock(req *WatchStockRequest, stream InventoryService_WatchStockServer) error {
+	// Subscribe before reading the current levels so no change in between is missed
+	tenant, _ := tenantFromContext(stream.Context())
+	changes := stockWatchers.subscribe(tenant)
+	defer stockWatchers.unsubscribe(changes)
+
+	watched := make(map[int]bool, len(req.GetProductIds()))
+	for _, id := range req.GetProductIds() {
+		watched[int(id)] = true
+
+		product, err := s.repo.GetProduct(stream.Context(), int(id))
+		if err != nil {
+			return grpcError(stream.Context(), err)
+		}
+		if err := stream.Send(stockLevel(product)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-stockWatchers.done:
+			return status.Error(codes.Unavailable, "server is shutting down, reconnect to watch stock")
+		case product := <-changes:
+			if len(watched) > 0 && !watched[product.Id] {
+				continue
+			}
+			if err := stream.Send(stockLevel(product)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// stockWatchHub fans stock changes made by this replica out to the WatchStock streams of
+// the same tenant
+type stockWatchHub struct {
+	mu       sync.Mutex
+	watchers map[chan Product]string
+	done     chan struct{}
+	once     sync.Once
+}
+
+var stockWatchers = &stockWatchHub{watchers: make(map[chan Product]string), done: make(chan struct{})}
+
+func (h *stockWatchHub) subscribe(tenant string) chan Product {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changes := make(chan Product, 64)
+	h.watchers[changes] = tenant
+	return changes
+}
+
+func (h *stockWatchHub) unsubscribe(changes chan Product) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.watchers, changes)
+}
+
+// close ends every WatchStock stream, used when the server shuts down
+func (h *stockWatchHub) close() {
+	h.once.Do(func() { close(h.done) })
+}
+
+// publish passes a change to the watchers of the tenant ctx is scoped to. It never blocks,
+// a watcher that is not keeping up misses the change.
+func (h *stockWatchHub) publish(ctx context.Context, product Product) {
+	tenant, ok := tenantFromContext(ctx)
+	if !ok {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for changes, watching := range h.watchers {
+		if watching != tenant {
+			continue
+		}
+		select {
+		case changes <- copyProduct(product):
+		default:
+			slog.Warn("Dropping stock change, a watcher is not keeping up", "productId", product.Id)
+		}
+	}
+}
+
+// grpcError maps an error onto a gRPC status, with field violations for validation errors
+func grpcError(ctx context.Context, err error) error {
+	apiErr := toAPIError(err)
+
+	code := codes.Internal
+	switch apiErr.Code {
+	case codeBadRequest, codeValidation, codeUnsupportedMediaType:
+		code = codes.InvalidArgument
+	case codeUnauthorized:
+		code = codes.Unauthenticated
+	case codeForbidden:
+		code = codes.PermissionDenied
+	case codeNotFound:
+		code = codes.NotFound
+	case codeConflict:
+		code = codes.AlreadyExists
+		if errors.Is(err, errProductChanged) {
+			code = codes.Aborted
+		}
+	case codeInsufficientStock:
+		code = codes.FailedPrecondition
+	case codeUnreadableProduct:
+		code = codes.DataLoss
+	case codePayloadTooLarge, codeRateLimited:
+		code = codes.ResourceExhausted
+	case codeStateStoreFailure, codeStateStoreDown, codeNotReady:
+		code = codes.Unavailable
+	}
+	if apiErr.Status >= 500 {
+		slog.ErrorContext(ctx, "gRPC request failed", "code", apiErr.Code, "error", apiErr.Error())
+	}
+
+	st := status.New(code, apiErr.Detail)
+	if len(apiErr.Errors) > 0 {
+		badRequest := &errdetails.BadRequest{}
+		for _, fieldErr := range apiErr.Errors {
+			badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       fieldErr.Field,
+				Description: fieldErr.Message,
+			})
+		}
+		if detailed, err := st.WithDetails(badRequest); err == nil {
+			st = detailed
+		}
+	}
+	if apiErr.RetryAfter > 0 {
+		if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(apiErr.RetryAfter)}); err == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+func productToProto(product Product) *CatalogProduct {
+	return &CatalogProduct{
+		Id:          int32(product.Id),
+		Name:        product.Name,
+		Category:    product.Category,
+		Price:       product.Price,
+		Description: product.Description,
+		ImageUrl:    product.ImageUrl,
+		Quantity:    int32(product.Quantity),
+		Tags:        product.Tags,
+	}
+}
+
+func productFromProto(product *CatalogProduct) Product {
+	return Product{
+		Id:          int(product.GetId()),
+		Name:        product.GetName(),
+		Category:    product.GetCategory(),
+		Price:       product.GetPrice(),
+		Description: product.GetDescription(),
+		ImageUrl:    product.GetImageUrl(),
+		Quantity:    int(product.GetQuantity()),
+		Tags:        product.GetTags(),
+	}
+}
+
+func stockLevel(product Product) *StockLevel {
+	return &StockLevel{Id: int32(product.Id), Quantity: int32(product.Quantity), InStock: product.Quantity > 0}
+}
@@ -0,0 +1,604 @@
+// stock-management-app/handlers_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestAPI serves the API routes without authentication against an in-memory catalog of
+// the default tenant, holding products
+func newTestAPI(t *testing.T, products ...Product) (http.Handler, ProductRepository) {
+	t.Helper()
+	audit := newMemoryAuditStore()
+	repo := newAuditedProductRepository(newMemoryProductRepository(), audit)
+	return newTestAPIWithRepository(t, repo, audit, products...), repo
+}
+
+// newTestAPIWithRepository serves the API from repo, seeded with products
+func newTestAPIWithRepository(t *testing.T, repo ProductRepository, audit auditStore, products ...Product) http.Handler {
+	t.Helper()
+	cfg, auth := useTestConfig(t)
+
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	for _, product := range products {
+		if _, _, err := saveProduct(ctx, repo, product); err != nil {
+			t.Fatalf("saveProduct(%d): %v", product.Id, err)
+		}
+	}
+	return routeTestAPI(auth, repo, audit)
+}
+
+// routeTestAPI serves the API routes against repo, authenticating callers with auth
+func routeTestAPI(auth *authChain, repo ProductRepository, audit auditStore) http.Handler {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(abortTruncatedResponses(), limitRequestBody(), errorMiddleware())
+	registerAPIRoutes(r.Group("", authenticate(auth), resolveTenant(), rateLimit(newRateLimiter())), repo, audit, newMemoryImportJobStore())
+	return r
+}
+
+// useTestConfig loads the default configuration and tenants with authentication turned off
+func useTestConfig(t *testing.T) (*Config, *authChain) {
+	t.Helper()
+	t.Setenv("AUTH_DISABLED", "true")
+	return loadTestConfig(t)
+}
+
+// loadTestConfig loads the configuration and tenants the environment sets. loadConfig starts
+// from the current configuration, so both are put back once the test is done.
+func loadTestConfig(t *testing.T) (*Config, *authChain) {
+	t.Helper()
+	previous, previousTenants := config(), registeredTenants.Load()
+	t.Cleanup(func() {
+		currentConfig.Store(previous)
+		registeredTenants.Store(previousTenants)
+	})
+	cfg, _, err := loadConfig(nil)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	currentConfig.Store(cfg)
+	registered, err := loadTenants(cfg)
+	if err != nil {
+		t.Fatalf("loadTenants: %v", err)
+	}
+	setTenants(registered)
+	auth, err := newAuthChain(cfg)
+	if err != nil {
+		t.Fatalf("newAuthChain: %v", err)
+	}
+	return cfg, auth
+}
+
+// Credentials of useTwoTenants
+const (
+	testTenantAKey  = "a-key"
+	testTenantBKey  = "b-key"
+	testReaderKey   = "reader-key"
+	testAdminKey    = "admin-key"
+	testAppAPIToken = "dapr-token"
+)
+
+// useTwoTenants serves tenants a and b with authentication on. The admin keys testTenantAKey
+// and testTenantBKey are bound to a tenant each, testReaderKey and testAdminKey to none.
+func useTwoTenants(t *testing.T) *authChain {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.yaml")
+	if err := os.WriteFile(path, []byte("tenants:\n  a: {}\n  b: {}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TENANTS_FILE", path)
+	t.Setenv("DEFAULT_TENANT", "a")
+	t.Setenv("API_KEYS", "a:"+testTenantAKey+":admin:a,b:"+testTenantBKey+":admin:b,reader:"+testReaderKey+":reader,ops:"+testAdminKey+":admin")
+	t.Setenv("APP_API_TOKEN", testAppAPIToken)
+	t.Setenv("AUTH_DISABLED", "false")
+	_, auth := loadTestConfig(t)
+	return auth
+}
+
+// dialTestGRPC serves the gRPC API against repo on a local port and connects to it
+func dialTestGRPC(t *testing.T, repo ProductRepository, auth *authChain, limiter *rateLimiter) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _, err := newGRPCService(lis, repo, nil, auth, limiter)
+	if err != nil {
+		t.Fatalf("newGRPCService: %v", err)
+	}
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// setFeatureFlag switches a flag for the rest of the test, as the configuration store would
+func setFeatureFlag(t *testing.T, name string, enabled bool) {
+	t.Helper()
+	t.Cleanup(resetFeatureFlags)
+	applyFeatureFlags(map[string]*dapr.ConfigurationItem{
+		featureFlagKeyPrefix + name: {Value: strconv.FormatBool(enabled)},
+	})
+}
+
+// serve sends a request to the API and returns the recorded response
+func serve(t *testing.T, api http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveWithHeaders(t, api, method, path, body, nil)
+}
+
+// serveWithHeaders sends a request with the given headers to the API
+func serveWithHeaders(t *testing.T, api http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w
+}
+
+// decodeData decodes the data of a success envelope into v
+func decodeData(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	var envelope struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("decoding response %s: %v", w.Body, err)
+	}
+	if envelope.Status != "success" {
+		t.Fatalf("status = %q, want success: %s", envelope.Status, w.Body)
+	}
+	if v != nil {
+		if err := json.Unmarshal(envelope.Data, v); err != nil {
+			t.Fatalf("decoding data %s: %v", envelope.Data, err)
+		}
+	}
+}
+
+// expectProblem checks that a response is problem details with the given status and code
+func expectProblem(t *testing.T, w *httptest.ResponseRecorder, status int, code string) ProblemDetails {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body)
+	}
+	var problem ProblemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("decoding problem %s: %v", w.Body, err)
+	}
+	if problem.Code != code {
+		t.Fatalf("code = %q, want %q", problem.Code, code)
+	}
+	return problem
+}
+
+func TestStoreProduct(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	w := serve(t, api, http.MethodPost, "/product", `{"id":1,"name":"Mug","category":"kitchen","price":9.5,"quantity":3}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var stored Product
+	decodeData(t, w, &stored)
+	if stored.Id != 1 || stored.Name != "Mug" || stored.Quantity != 3 {
+		t.Fatalf("stored = %+v", stored)
+	}
+
+	w = serve(t, api, http.MethodGet, "/product/1", "")
+	var fetched Product
+	decodeData(t, w, &fetched)
+	if fetched.Name != "Mug" || fetched.Price != 9.5 {
+		t.Fatalf("fetched = %+v", fetched)
+	}
+
+	var products []Product
+	decodeData(t, serve(t, api, http.MethodGet, "/products", ""), &products)
+	if len(products) != 1 {
+		t.Fatalf("listed %d products after storing one, want 1", len(products))
+	}
+}
+
+func TestStoreProductRejectsInvalidProducts(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		code  string
+		field string
+	}{
+		{name: "malformed JSON", body: `{"id":1,`, code: codeBadRequest},
+		{name: "missing name", body: `{"id":1,"quantity":1}`, code: codeValidation, field: "name"},
+		{name: "negative quantity", body: `{"id":1,"name":"Mug","quantity":-1}`, code: codeValidation, field: "quantity"},
+		{name: "invalid ID", body: `{"id":0,"name":"Mug"}`, code: codeValidation, field: "id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, repo := newTestAPI(t)
+
+			problem := expectProblem(t, serve(t, api, http.MethodPost, "/product", tt.body), http.StatusBadRequest, tt.code)
+			if tt.field != "" && (len(problem.Errors) == 0 || problem.Errors[0].Field != tt.field) {
+				t.Fatalf("errors = %+v, want one for %s", problem.Errors, tt.field)
+			}
+			ids, err := repo.GetProductIDs(withTenant(context.Background(), config().DefaultTenant, tenantSourceJob))
+			if err != nil || len(ids) != 0 {
+				t.Fatalf("product IDs = %v, %v; want none stored", ids, err)
+			}
+		})
+	}
+}
+
+func TestGetAllProducts(t *testing.T) {
+	api, _ := newTestAPI(t,
+		Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 3},
+		Product{Id: 2, Name: "Kettle", Category: "kitchen", Price: 30, Quantity: 0},
+		Product{Id: 3, Name: "Lamp", Category: "lighting", Price: 45, Quantity: 7},
+	)
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{query: "", want: []int{1, 2, 3}},
+		{query: "?category=kitchen", want: []int{1, 2}},
+		{query: "?inStock=true", want: []int{1, 3}},
+		{query: "?minPrice=10&maxPrice=40", want: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run("products"+tt.query, func(t *testing.T) {
+			var products []Product
+			decodeData(t, serve(t, api, http.MethodGet, "/products"+tt.query, ""), &products)
+			if len(products) != len(tt.want) {
+				t.Fatalf("got %d products, want IDs %v: %+v", len(products), tt.want, products)
+			}
+			for i, product := range products {
+				if product.Id != tt.want[i] {
+					t.Fatalf("product %d has ID %d, want %d", i, product.Id, tt.want[i])
+				}
+			}
+		})
+	}
+
+	expectProblem(t, serve(t, api, http.MethodGet, "/products?inStock=maybe", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestGetAllProductsEmptyCatalog(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	w := serve(t, api, http.MethodGet, "/products", "")
+	var products []Product
+	decodeData(t, w, &products)
+	if products == nil || len(products) != 0 {
+		t.Fatalf("products = %v, want an empty list: %s", products, w.Body)
+	}
+}
+
+func TestGetProductByID(t *testing.T) {
+	api, _ := newTestAPI(t, Product{Id: 7, Name: "Lamp", Price: 45, Quantity: 2, Tags: []string{"desk"}})
+
+	var product Product
+	decodeData(t, serve(t, api, http.MethodGet, "/product/7", ""), &product)
+	if product.Id != 7 || product.Name != "Lamp" || len(product.Tags) != 1 {
+		t.Fatalf("product = %+v", product)
+	}
+
+	expectProblem(t, serve(t, api, http.MethodGet, "/product/8", ""), http.StatusNotFound, codeNotFound)
+	expectProblem(t, serve(t, api, http.MethodGet, "/product/lamp", ""), http.StatusBadRequest, codeBadRequest)
+}
+
+func TestUpdateStock(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+		// wantQuantity is the stock of product 1 afterwards
+		wantQuantity int
+	}{
+		{
+			name:         "direct request",
+			body:         `{"updates":[{"id":1,"purchaseQty":4}]}`,
+			wantStatus:   http.StatusOK,
+			wantQuantity: 6,
+		},
+		{
+			name:         "CloudEvent",
+			body:         `{"specversion":"1.0","type":"stockUpdate","data":{"updates":[{"id":1,"purchaseQty":10}]}}`,
+			wantStatus:   http.StatusOK,
+			wantQuantity: 0,
+		},
+		{
+			name:         "insufficient stock",
+			body:         `{"updates":[{"id":1,"purchaseQty":11}]}`,
+			wantStatus:   http.StatusConflict,
+			wantCode:     codeInsufficientStock,
+			wantQuantity: 10,
+		},
+		{
+			name:         "unknown product",
+			body:         `{"updates":[{"id":99,"purchaseQty":1}]}`,
+			wantStatus:   http.StatusNotFound,
+			wantCode:     codeNotFound,
+			wantQuantity: 10,
+		},
+		{
+			name:         "unknown product after a known one",
+			body:         `{"updates":[{"id":1,"purchaseQty":4},{"id":99,"purchaseQty":1}]}`,
+			wantStatus:   http.StatusNotFound,
+			wantCode:     codeNotFound,
+			wantQuantity: 10,
+		},
+		{
+			name:         "no updates",
+			body:         `{"updates":[]}`,
+			wantStatus:   http.StatusBadRequest,
+			wantCode:     codeValidation,
+			wantQuantity: 10,
+		},
+		{
+			name:         "zero purchase",
+			body:         `{"updates":[{"id":1,"purchaseQty":0}]}`,
+			wantStatus:   http.StatusBadRequest,
+			wantCode:     codeValidation,
+			wantQuantity: 10,
+		},
+		{
+			name:         "malformed JSON",
+			body:         `{"updates":`,
+			wantStatus:   http.StatusBadRequest,
+			wantCode:     codeBadRequest,
+			wantQuantity: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFeatureFlag(t, featureBackorders, false)
+			api, repo := newTestAPI(t, Product{Id: 1, Name: "Mug", Quantity: 10})
+
+			w := serve(t, api, http.MethodPost, "/updateStock", tt.body)
+			if tt.wantCode != "" {
+				expectProblem(t, w, tt.wantStatus, tt.wantCode)
+			} else if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			product, err := repo.GetProduct(withTenant(context.Background(), config().DefaultTenant, tenantSourceJob), 1)
+			if err != nil {
+				t.Fatalf("GetProduct: %v", err)
+			}
+			if product.Quantity != tt.wantQuantity {
+				t.Fatalf("quantity = %d, want %d", product.Quantity, tt.wantQuantity)
+			}
+		})
+	}
+}
+
+func TestUpdateStockWithBackorders(t *testing.T) {
+	setFeatureFlag(t, featureBackorders, true)
+	api, repo := newTestAPI(t, Product{Id: 1, Name: "Mug", Quantity: 2})
+
+	if w := serve(t, api, http.MethodPost, "/updateStock", `{"updates":[{"id":1,"purchaseQty":5}]}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	product, err := repo.GetProduct(withTenant(context.Background(), config().DefaultTenant, tenantSourceJob), 1)
+	if err != nil || product.Quantity != -3 {
+		t.Fatalf("product = %+v, %v; want 3 units on backorder", product, err)
+	}
+}
+
+func TestUpdateStockDropsEventsThatCannotSucceed(t *testing.T) {
+	setFeatureFlag(t, featureBackorders, false)
+	api, _ := newTestAPI(t, Product{Id: 1, Name: "Mug", Quantity: 1})
+
+	for _, body := range []string{
+		`{"data":{"updates":[{"id":1,"purchaseQty":5}]}}`,
+		`{"data":{"updates":[{"id":1,"purchaseQty":0}]}}`,
+	} {
+		w := serve(t, api, http.MethodPost, "/updateStock", body)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"DROP"`) {
+			t.Fatalf("event %s: got %d %s, want a DROP status", body, w.Code, w.Body)
+		}
+	}
+}
+
+func TestProductHistory(t *testing.T) {
+	api, _ := newTestAPI(t, Product{Id: 1, Name: "Mug", Price: 9.5, Quantity: 10})
+
+	serve(t, api, http.MethodPost, "/product", `{"id":1,"name":"Mug","price":12,"quantity":10}`)
+	serve(t, api, http.MethodPost, "/product", `{"id":1,"name":"Mug","price":12,"quantity":10}`)
+
+	var history []auditEntry
+	decodeData(t, serve(t, api, http.MethodGet, "/product/1/history", ""), &history)
+	if len(history) != 2 {
+		t.Fatalf("history has %d entries, want a create and one price change: %+v", len(history), history)
+	}
+	latest := history[0]
+	if latest.Action != auditActionUpdate || latest.Actor != "none:anonymous" || len(latest.Changes) != 1 || latest.Changes[0].Field != "price" {
+		t.Fatalf("latest entry = %+v", latest)
+	}
+	if history[1].Action != auditActionCreate || history[1].Actor != auditActorSystem {
+		t.Fatalf("first entry = %+v", history[1])
+	}
+
+	expectProblem(t, serve(t, api, http.MethodGet, "/product/2/history", ""), http.StatusNotFound, codeNotFound)
+}
+
+func TestStockUpdatesDoNotEvictProductHistory(t *testing.T) {
+	api, _ := newTestAPI(t, Product{Id: 1, Name: "Mug", Price: 9.5, Quantity: 10})
+	cfg := *config()
+	cfg.AuditHistoryLimit = 3
+	currentConfig.Store(&cfg)
+
+	serve(t, api, http.MethodPost, "/product", `{"id":1,"name":"Mug","price":12,"quantity":10}`)
+	for i := 0; i < 5; i++ {
+		serve(t, api, http.MethodPost, "/updateStock", `{"data":{"updates":[{"id":1,"purchaseQty":1}]}}`)
+	}
+
+	var history []auditEntry
+	decodeData(t, serve(t, api, http.MethodGet, "/product/1/history", ""), &history)
+	if len(history) != 2 || history[0].Changes[0].Field != "price" || history[1].Action != auditActionCreate {
+		t.Fatalf("history = %+v, want the create and the price change", history)
+	}
+
+	var entries []auditEntry
+	decodeData(t, serve(t, api, http.MethodGet, "/admin/audit?productId=1", ""), &entries)
+	if len(entries) != 5 {
+		t.Fatalf("audit has %d entries, want the 2 versions and the last 3 stock changes: %+v", len(entries), entries)
+	}
+	if latest := entries[0]; len(latest.Changes) != 1 || latest.Changes[0].Field != "quantity" || latest.Changes[0].After != float64(5) {
+		t.Errorf("latest entry = %+v, want the last stock change", latest)
+	}
+}
+
+func TestPriceRoundingAppliesToEveryWritePath(t *testing.T) {
+	api, repo := newTestAPI(t)
+	setFeatureFlag(t, featurePriceRounding, true)
+	ctx := withTenant(context.Background(), config().DefaultTenant, tenantSourceJob)
+
+	var stored Product
+	decodeData(t, serve(t, api, http.MethodPost, "/product", `{"id":1,"name":"Mug","category":"kitchen","price":9.999,"quantity":3}`), &stored)
+	if stored.Price != 10 {
+		t.Errorf("POST /product answered price %v, want 10", stored.Price)
+	}
+
+	upserted, err := (&catalogServer{repo: repo}).UpsertProduct(ctx, &UpsertProductRequest{
+		Product: &CatalogProduct{Id: 2, Name: "Lamp", Category: "lighting", Price: 45.004, Quantity: 7},
+	})
+	if err != nil {
+		t.Fatalf("UpsertProduct: %v", err)
+	}
+	if upserted.GetPrice() != 45 {
+		t.Errorf("UpsertProduct answered price %v, want 45", upserted.GetPrice())
+	}
+
+	var job importJob
+	decodeData(t, serve(t, api, http.MethodPost, "/admin/import?format=jsonl", `{"id":3,"name":"Rug","category":"home","price":19.995,"quantity":1}`), &job)
+	awaitImportJob(t, api, job.Id)
+
+	if _, err := seedProducts(ctx, repo, []Product{{Id: 4, Name: "Vase", Category: "home", Price: 4.444, Quantity: 2}}, seedModeUpsert); err != nil {
+		t.Fatalf("seedProducts: %v", err)
+	}
+
+	for id, want := range map[int]float64{1: 10, 2: 45, 3: 20, 4: 4.44} {
+		product, err := repo.GetProduct(ctx, id)
+		if err != nil {
+			t.Fatalf("GetProduct(%d): %v", id, err)
+		}
+		if product.Price != want {
+			t.Errorf("product %d stored with price %v, want %v", id, product.Price, want)
+		}
+	}
+}
+
+func TestUnboundCredentialsNeedACrossTenantRole(t *testing.T) {
+	auth := useTwoTenants(t)
+	audit := newMemoryAuditStore()
+	api := routeTestAPI(auth, newAuditedProductRepository(newMemoryProductRepository(), audit), audit)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"bound key", map[string]string{apiKeyHeader: testTenantBKey}, http.StatusOK},
+		{"unbound admin key", map[string]string{apiKeyHeader: testAdminKey, tenantHeader: "b"}, http.StatusOK},
+		{"unbound reader key", map[string]string{apiKeyHeader: testReaderKey}, http.StatusForbidden},
+		{"unbound reader key naming a tenant", map[string]string{apiKeyHeader: testReaderKey, tenantHeader: "b"}, http.StatusForbidden},
+		{"Dapr app API token", map[string]string{daprTokenHeader: testAppAPIToken, tenantHeader: "b"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveWithHeaders(t, api, http.MethodGet, "/products", "", tt.headers)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// The sidecar still delivers events to the tenant they are for
+	dapr, err := auth.authenticate(credentials{DaprToken: testAppAPIToken})
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	ctx, err := scopeEventTenant(withPrincipal(context.Background(), dapr), "b")
+	if id, _ := tenantFromContext(ctx); err != nil || id != "b" {
+		t.Errorf("scopeEventTenant = %q, %v, want tenant b", id, err)
+	}
+}
+
+func TestTenantsCannotSeeEachOthersProducts(t *testing.T) {
+	auth := useTwoTenants(t)
+	audit := newMemoryAuditStore()
+	repo := newAuditedProductRepository(newMemoryProductRepository(), audit)
+	api := routeTestAPI(auth, repo, audit)
+	ctx := withTenant(context.Background(), "a", tenantSourceJob)
+	if _, _, err := saveProduct(ctx, repo, Product{Id: 1, Name: "Tenant A mug", Category: "kitchen", Price: 12, Quantity: 3}); err != nil {
+		t.Fatalf("saveProduct: %v", err)
+	}
+
+	t.Run("naming another tenant", func(t *testing.T) {
+		w := serveWithHeaders(t, api, http.MethodGet, "/products", "", map[string]string{apiKeyHeader: testTenantBKey, tenantHeader: "a"})
+		expectProblem(t, w, http.StatusForbidden, codeForbidden)
+	})
+
+	if w := serveWithHeaders(t, api, http.MethodGet, "/products", "", map[string]string{apiKeyHeader: testTenantAKey}); !strings.Contains(w.Body.String(), "Tenant A mug") {
+		t.Fatalf("tenant a cannot see its own product: %s", w.Body)
+	}
+	asB := map[string]string{apiKeyHeader: testTenantBKey}
+	for _, path := range []string{"/products", "/export/products", "/admin/audit", "/admin/audit?productId=1"} {
+		t.Run(path, func(t *testing.T) {
+			w := serveWithHeaders(t, api, http.MethodGet, path, "", asB)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			if strings.Contains(w.Body.String(), "Tenant A mug") {
+				t.Errorf("tenant b was answered tenant a's product: %s", w.Body)
+			}
+		})
+	}
+	t.Run("/product/1", func(t *testing.T) {
+		expectProblem(t, serveWithHeaders(t, api, http.MethodGet, "/product/1", "", asB), http.StatusNotFound, codeNotFound)
+	})
+
+	t.Run("gRPC", func(t *testing.T) {
+		catalog := NewCatalogServiceClient(dialTestGRPC(t, repo, auth, newRateLimiter()))
+		ctx := metadata.AppendToOutgoingContext(context.Background(), strings.ToLower(apiKeyHeader), testTenantBKey)
+
+		if _, err := catalog.GetProduct(ctx, &GetProductRequest{Id: 1}); status.Code(err) != codes.NotFound {
+			t.Errorf("GetProduct = %v, want NotFound", err)
+		}
+		list, err := catalog.ListProducts(ctx, &ListProductsRequest{})
+		if err != nil {
+			t.Fatalf("ListProducts: %v", err)
+		}
+		if len(list.GetProducts()) != 0 {
+			t.Errorf("ListProducts = %v, want none of tenant a's products", list.GetProducts())
+		}
+	})
+}
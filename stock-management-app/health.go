@@ -0,0 +1,190 @@
+// stock-management-app/health.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	checkStatusUp      = "up"
+	checkStatusDown    = "down"
+	checkStatusSkipped = "skipped"
+)
+
+// unrecoverable is set once the process can no longer serve and needs a restart
+var unrecoverable atomic.Value
+
+// DependencyCheck is the outcome of checking one dependency
+type DependencyCheck struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ReadinessReport lists the status of every dependency readiness depends on
+type ReadinessReport struct {
+	Status    string                     `json:"status"`
+	CheckedAt time.Time                  `json:"checkedAt"`
+	Checks    map[string]DependencyCheck `json:"checks"`
+}
+
+// readinessChecker verifies the sidecar, the state store, the pubsub component and seeding.
+// Results are cached for READINESS_CACHE_SECONDS and concurrent probes share one run.
+type readinessChecker struct {
+	client dapr.Client
+
+	mu      sync.Mutex
+	last    *ReadinessReport
+	expires time.Time
+}
+
+func newReadinessChecker(client dapr.Client) *readinessChecker {
+	return &readinessChecker{client: client}
+}
+
+// report returns the cached report or runs the checks when it has expired
+func (r *readinessChecker) report(ctx context.Context) *ReadinessReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last != nil && time.Now().Before(r.expires) {
+		return r.last
+	}
+
+	report := &ReadinessReport{Status: "ready", CheckedAt: time.Now().UTC(), Checks: make(map[string]DependencyCheck)}
+
+	var components []*dapr.MetadataRegisteredComponents
+	sidecarErr := r.check(ctx, report, "sidecar", func(ctx context.Context) error {
+		metadata, err := r.client.GetMetadata(ctx)
+		if err != nil {
+			return err
+		}
+		components = metadata.RegisteredComponents
+		return nil
+	})
+	if sidecarErr != nil {
+		// Nothing else can be reached without the sidecar
+		report.Checks["stateStore"] = DependencyCheck{Status: checkStatusSkipped}
+		report.Checks["pubsub"] = DependencyCheck{Status: checkStatusSkipped}
+	} else {
+		r.check(ctx, report, "stateStore", r.checkStateStore)
+		r.check(ctx, report, "pubsub", func(ctx context.Context) error {
+			return checkComponent(components, config().PubsubName, "pubsub.")
+		})
+	}
+
+	seed := DependencyCheck{Status: checkStatusUp}
+	if !seedCompleted.Load() {
+		seed = DependencyCheck{Status: checkStatusDown, Error: "catalog seeding in progress"}
+	}
+	report.Checks["seed"] = seed
+
+	for _, check := range report.Checks {
+		if check.Status != checkStatusUp {
+			report.Status = "not-ready"
+		}
+	}
+	if report.Status != "ready" && (r.last == nil || r.last.Status == "ready") {
+		slog.Warn("Readiness check failed", "checks", report.Checks)
+	}
+
+	r.last = report
+	r.expires = time.Now().Add(config().ReadinessCacheTTL)
+	return report
+}
+
+// check runs one dependency check with its own timeout and records the outcome
+func (r *readinessChecker) check(ctx context.Context, report *ReadinessReport, name string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, config().ReadinessCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := fn(ctx)
+	check := DependencyCheck{Status: checkStatusUp, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		check.Status = checkStatusDown
+		check.Error = err.Error()
+	}
+	report.Checks[name] = check
+	return err
+}
+
+// readinessCanaryTTL expires the canary of a replica that is gone, each check writes it again
+const readinessCanaryTTL = 10 * time.Minute
+
+// checkStateStore writes a canary value for this replica and reads it back
+func (r *readinessChecker) checkStateStore(ctx context.Context) error {
+	key := "readiness-canary-" + startupJobOwner()
+	value := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	meta := map[string]string{"ttlInSeconds": strconv.Itoa(int(readinessCanaryTTL.Seconds()))}
+	if err := r.client.SaveState(ctx, config().StateStoreName, key, []byte(value), meta); err != nil {
+		return fmt.Errorf("failed to write canary key: %v", err)
+	}
+	item, err := r.client.GetState(ctx, config().StateStoreName, key, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read canary key: %v", err)
+	}
+	if string(item.Value) != value {
+		return fmt.Errorf("canary key read back %q, expected %q", item.Value, value)
+	}
+	return nil
+}
+
+// checkComponent verifies that a component of the given type prefix is loaded under name
+func checkComponent(components []*dapr.MetadataRegisteredComponents, name, typePrefix string) error {
+	for _, component := range components {
+		if component.Name == name && strings.HasPrefix(component.Type, typePrefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("component %s is not loaded by the sidecar", name)
+}
+
+// markUnrecoverable fails the liveness probe so the container is restarted
+func markUnrecoverable(reason string) {
+	slog.Error("Marking the service unhealthy", "reason", reason)
+	unrecoverable.Store(reason)
+}
+
+// healthCheck responds to health check requests, used for liveness probe. It only fails when
+// a restart is needed; dependency outages are reported by readiness instead.
+func healthCheck(c *gin.Context) {
+	if reason, ok := unrecoverable.Load().(string); ok {
+		abortWithError(c, &APIError{Code: codeUnhealthy, Status: http.StatusServiceUnavailable, Title: "Unhealthy", Detail: reason})
+		return
+	}
+	respond(c, http.StatusOK, gin.H{"status": "healthy"}, "")
+}
+
+// readinessCheck responds to readiness check requests, used for readiness probe
+func readinessCheck(checker *readinessChecker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if shuttingDown.Load() {
+			abortWithError(c, newNotReadyError("Shutting down"))
+			return
+		}
+
+		// Not tied to the probe request, the result is shared with other probes
+		report := checker.report(context.Background())
+		if report.Status != "ready" {
+			err := newNotReadyError("One or more dependencies are unavailable")
+			err.Checks = report.Checks
+			abortWithError(c, err)
+			return
+		}
+		respond(c, http.StatusOK, report, "")
+	}
+}
@@ -0,0 +1,25 @@
+// stock-management-app/health_test.go
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReadinessCanaryExpires(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+
+	if err := newReadinessChecker(client).checkStateStore(context.Background()); err != nil {
+		t.Fatalf("checkStateStore: %v", err)
+	}
+	expires, ok := sidecar.Expiry(cfg.StateStoreName, "readiness-canary-"+startupJobOwner())
+	if !ok {
+		t.Fatal("canary key was not written")
+	}
+	if expires.IsZero() || expires.After(time.Now().Add(readinessCanaryTTL)) {
+		t.Errorf("canary expires at %v, want within %v", expires, readinessCanaryTTL)
+	}
+}
@@ -0,0 +1,554 @@
+// stock-management-app/import.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"github.com/gin-gonic/gin"
+)
+
+// Import formats and modes accepted by POST /admin/import
+const (
+	importFormatCSV   = "csv"
+	importFormatJSONL = "jsonl"
+
+	importModeUpsert = "upsert"
+	importModeCreate = "create"
+)
+
+// Import job states
+const (
+	importJobPending   = "pending"
+	importJobRunning   = "running"
+	importJobCompleted = "completed"
+
+	// importJobInterrupted means the replica shut down before every row was processed
+	importJobInterrupted = "interrupted"
+	// importJobFailed means the upload could not be read to the end, Error says why
+	importJobFailed = "failed"
+)
+
+// importJobMaxErrors caps the row errors kept with a job, later failures are only counted
+const importJobMaxErrors = 1000
+
+// importJobSaveInterval is how often the progress of a running job is saved
+const importJobSaveInterval = time.Second
+
+// importRowError describes why a single row was rejected
+type importRowError struct {
+	Row     int              `json:"row"`
+	Id      int              `json:"id,omitempty"`
+	Error   string           `json:"error"`
+	Details ValidationErrors `json:"details,omitempty"`
+}
+
+// importJob tracks the progress of a catalog import. Jobs are kept in the state store for
+// IMPORT_JOB_RETENTION_SECONDS so any replica can report them, the replica that accepted the
+// upload runs the job. TotalRows counts the rows read so far, it is final once the job is done.
+type importJob struct {
+	Id          string           `json:"jobId"`
+	Status      string           `json:"status"`
+	Format      string           `json:"format"`
+	Mode        string           `json:"mode"`
+	DryRun      bool             `json:"dryRun"`
+	TotalRows   int              `json:"totalRows"`
+	Processed   int              `json:"processedRows"`
+	Created     int              `json:"created"`
+	Updated     int              `json:"updated"`
+	Failed      int              `json:"failed"`
+	Errors      []importRowError `json:"errors"`
+	Error       string           `json:"error,omitempty"`
+	StartedAt   time.Time        `json:"startedAt"`
+	CompletedAt *time.Time       `json:"completedAt,omitempty"`
+}
+
+// importRow is a parsed row waiting to be validated and written. Error is set instead of
+// Product when the row could not be parsed.
+type importRow struct {
+	Row     int
+	Product Product
+	Error   string
+}
+
+// importJobStore keeps import jobs of the tenant ctx is scoped to
+type importJobStore interface {
+	Save(ctx context.Context, job importJob) error
+	// Get returns nil for jobs that do not exist or have expired
+	Get(ctx context.Context, id string) (*importJob, error)
+}
+
+// daprImportJobStore keeps each job under its own key, expiring IMPORT_JOB_RETENTION_SECONDS
+// after it was last saved
+type daprImportJobStore struct {
+	client dapr.Client
+}
+
+func newDaprImportJobStore(client dapr.Client) *daprImportJobStore {
+	return &daprImportJobStore{client: client}
+}
+
+func (s *daprImportJobStore) Save(ctx context.Context, job importJob) error {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	meta := map[string]string{"ttlInSeconds": strconv.Itoa(int(config().ImportJobRetention.Seconds()))}
+	if err := s.client.SaveState(ctx, config().StateStoreName, importJobKey(tenant, job.Id), data, meta); err != nil {
+		return wrapStateStoreError(fmt.Errorf("failed to save import job %s: %w", job.Id, err))
+	}
+	return nil
+}
+
+func (s *daprImportJobStore) Get(ctx context.Context, id string) (*importJob, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	item, err := s.client.GetState(ctx, config().StateStoreName, importJobKey(tenant, id), nil)
+	if err != nil {
+		return nil, wrapStateStoreError(fmt.Errorf("failed to read import job %s: %w", id, err))
+	}
+	if item.Value == nil {
+		return nil, nil
+	}
+	var job importJob
+	if err := json.Unmarshal(item.Value, &job); err != nil {
+		return nil, fmt.Errorf("failed to decode import job %s: %v", id, err)
+	}
+	return &job, nil
+}
+
+// memoryImportJobStore keeps jobs in memory with the same retention, used for tests
+type memoryImportJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]memoryImportJob
+}
+
+type memoryImportJob struct {
+	job     importJob
+	expires time.Time
+}
+
+func newMemoryImportJobStore() *memoryImportJobStore {
+	return &memoryImportJobStore{jobs: make(map[string]memoryImportJob)}
+}
+
+func (s *memoryImportJobStore) Save(ctx context.Context, job importJob) error {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, stored := range s.jobs {
+		if now.After(stored.expires) {
+			delete(s.jobs, key)
+		}
+	}
+	job.Errors = append(make([]importRowError, 0, len(job.Errors)), job.Errors...)
+	s.jobs[importJobKey(tenant, job.Id)] = memoryImportJob{job: job, expires: now.Add(config().ImportJobRetention)}
+	return nil
+}
+
+func (s *memoryImportJobStore) Get(ctx context.Context, id string) (*importJob, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.jobs[importJobKey(tenant, id)]
+	if !ok || time.Now().After(stored.expires) {
+		return nil, nil
+	}
+	job := stored.job
+	job.Errors = append(make([]importRowError, 0, len(job.Errors)), job.Errors...)
+	return &job, nil
+}
+
+// startImport copies a CSV or JSON Lines upload to a temporary file and answers once it is
+// uploaded; a background job then reads the rows back one at a time and writes them.
+// Query parameters: mode=upsert|create (default upsert) and dryRun=true to only validate.
+func startImport(c *gin.Context, repo ProductRepository, jobs importJobStore) {
+	ctx := c.Request.Context()
+	format, err := importFormat(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	mode := c.DefaultQuery("mode", importModeUpsert)
+	if mode != importModeUpsert && mode != importModeCreate {
+		abortWithError(c, newBadRequestError("Invalid mode %q: expected %s or %s", mode, importModeUpsert, importModeCreate))
+		return
+	}
+
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dryRun", "false"))
+	if err != nil {
+		abortWithError(c, newBadRequestError("Invalid dryRun value"))
+		return
+	}
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	upload, size, err := spoolImport(c.Request.Body)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			abortWithError(c, err)
+			return
+		}
+		abortWithError(c, requestBodyError(err, newBadRequestError("Failed to read the upload: %v", err)))
+		return
+	}
+	reader, err := newImportReader(format, upload)
+	if err != nil {
+		removeSpooledImport(upload)
+		abortWithError(c, newBadRequestError("%v", err))
+		return
+	}
+
+	job := importJob{
+		Id:        newImportJobID(),
+		Status:    importJobPending,
+		Format:    format,
+		Mode:      mode,
+		DryRun:    dryRun,
+		Errors:    make([]importRowError, 0),
+		StartedAt: time.Now().UTC(),
+	}
+	if err := jobs.Save(ctx, job); err != nil {
+		removeSpooledImport(upload)
+		abortWithError(c, err)
+		return
+	}
+
+	// The rows are written after the request is done, credit them to its caller and request ID
+	actor := auditActor(ctx)
+	corr, _ := ctx.Value(correlationKey{}).(correlation)
+	running := job
+	started := backgroundWorkers.Go(func(ctx context.Context) {
+		defer removeSpooledImport(upload)
+		ctx, _ = withCorrelation(withAuditActor(withTenant(ctx, tenant, tenantSourceJob), actor), corr.RequestID, "")
+		runImport(ctx, repo, jobs, &running, reader)
+	})
+	if !started {
+		removeSpooledImport(upload)
+		job.Status = importJobInterrupted
+		saveImportJob(ctx, jobs, &job)
+		abortWithError(c, newNotReadyError("Shutting down, retry the import"))
+		return
+	}
+
+	slog.InfoContext(ctx, "Accepted import job", "jobId", job.Id, "tenant", tenant, "bytes", size, "format", format, "mode", mode, "dryRun", dryRun)
+	c.Header("Location", c.FullPath()+"/"+job.Id)
+	respond(c, http.StatusAccepted, job, "Import job accepted")
+}
+
+// getImportJob reports the progress of an import job. Jobs of other tenants are not found.
+func getImportJob(c *gin.Context, jobs importJobStore) {
+	job, err := jobs.Get(c.Request.Context(), c.Param("jobId"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if job == nil {
+		abortWithError(c, newNotFoundError("Import job %s not found", c.Param("jobId")))
+		return
+	}
+	respond(c, http.StatusOK, job, "")
+}
+
+// spoolImport copies an upload to a temporary file, so the rows are never all held in memory
+// and the job can read them after the request is done
+func spoolImport(body io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpooledImport(file)
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+func removeSpooledImport(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		slog.Warn("Failed to remove spooled import", "file", file.Name(), "error", err)
+	}
+}
+
+// runImport validates and writes rows through saveProduct so the product ID index stays correct,
+// saving the job's progress every importJobSaveInterval. It stops between rows when ctx is
+// cancelled and marks the job interrupted.
+func runImport(ctx context.Context, repo ProductRepository, jobs importJobStore, job *importJob, reader importReader) {
+	job.Status = importJobRunning
+	saveImportJob(ctx, jobs, job)
+	saved := time.Now()
+
+	// Dry runs write nothing, they report rows as created or updated from the index as it was
+	var existing map[int]bool
+	if job.DryRun {
+		existingIDs, err := repo.GetProductIDs(ctx)
+		if err != nil {
+			job.Error = fmt.Sprintf("failed to read the product IDs: %v", err)
+			finishImport(ctx, jobs, job, importJobFailed)
+			slog.WarnContext(ctx, "Import job could not read product IDs", "jobId", job.Id, "error", err)
+			return
+		}
+		existing = make(map[int]bool, len(existingIDs))
+		for _, id := range existingIDs {
+			existing[id] = true
+		}
+	}
+
+	seen := make(map[int]int)
+	for {
+		if ctx.Err() != nil {
+			finishImport(ctx, jobs, job, importJobInterrupted)
+			slog.WarnContext(ctx, "Import job interrupted by shutdown", "jobId", job.Id, "processed", job.Processed)
+			return
+		}
+		row, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			job.Error = err.Error()
+			finishImport(ctx, jobs, job, importJobFailed)
+			slog.WarnContext(ctx, "Import job could not read the upload", "jobId", job.Id, "processed", job.Processed, "error", err)
+			return
+		}
+		job.TotalRows++
+		job.Processed++
+
+		problem := row.Error
+		var errs ValidationErrors
+		if problem == "" {
+			errs = validateProduct(row.Product)
+			if len(errs) > 0 {
+				problem = "validation failed"
+			} else if first, dup := seen[row.Product.Id]; dup {
+				problem = fmt.Sprintf("duplicate id %d, first seen on row %d", row.Product.Id, first)
+			} else if job.Mode == importModeCreate {
+				problem = checkProductAbsent(ctx, repo, row.Product.Id)
+			}
+			if _, dup := seen[row.Product.Id]; !dup {
+				seen[row.Product.Id] = row.Row
+			}
+		}
+
+		created := false
+		if problem == "" {
+			if job.DryRun {
+				created = !existing[row.Product.Id]
+			} else if _, added, err := saveProduct(ctx, repo, row.Product); err != nil {
+				problem = fmt.Sprintf("failed to save product: %v", err)
+			} else {
+				created = added
+			}
+		}
+
+		switch {
+		case problem != "":
+			job.Failed++
+			if len(job.Errors) < importJobMaxErrors {
+				job.Errors = append(job.Errors, importRowError{Row: row.Row, Id: row.Product.Id, Error: problem, Details: errs})
+			}
+		case created:
+			job.Created++
+		default:
+			job.Updated++
+		}
+
+		if time.Since(saved) >= importJobSaveInterval {
+			saveImportJob(ctx, jobs, job)
+			saved = time.Now()
+		}
+	}
+
+	finishImport(ctx, jobs, job, importJobCompleted)
+	slog.InfoContext(ctx, "Import job completed", "jobId", job.Id, "created", job.Created, "updated", job.Updated, "failed", job.Failed)
+}
+
+// checkProductAbsent reads a product create-only imports are about to write, returning why the
+// row is rejected if it exists or could not be read
+func checkProductAbsent(ctx context.Context, repo ProductRepository, id int) string {
+	_, err := repo.GetProduct(ctx, id)
+	switch {
+	case errors.Is(err, errProductNotFound):
+		return ""
+	case err != nil:
+		return fmt.Sprintf("failed to check whether product %d exists: %v", id, err)
+	}
+	return fmt.Sprintf("product with ID %d already exists", id)
+}
+
+// finishImport saves the final status of a job
+func finishImport(ctx context.Context, jobs importJobStore, job *importJob, status string) {
+	now := time.Now().UTC()
+	job.Status = status
+	job.CompletedAt = &now
+	saveImportJob(ctx, jobs, job)
+}
+
+// saveImportJob saves the progress of a job, also once shutdown has cancelled ctx. A failure
+// only delays what pollers see, the next save catches up.
+func saveImportJob(ctx context.Context, jobs importJobStore, job *importJob) {
+	if err := jobs.Save(context.WithoutCancel(ctx), *job); err != nil {
+		slog.WarnContext(ctx, "Failed to save import job", "jobId", job.Id, "status", job.Status, "error", err)
+	}
+}
+
+// importFormat picks the upload format from the format query parameter or the Content-Type
+func importFormat(c *gin.Context) (string, error) {
+	if format := c.Query("format"); format != "" {
+		if format != importFormatCSV && format != importFormatJSONL {
+			return "", newBadRequestError("Unsupported import format %q: expected %s or %s", format, importFormatCSV, importFormatJSONL)
+		}
+		return format, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return importFormatCSV, nil
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return importFormatJSONL, nil
+	default:
+		return "", newUnsupportedMediaTypeError("Unsupported Content-Type %q: expected text/csv or application/x-ndjson", mediaType)
+	}
+}
+
+// importReader reads the rows of an upload one at a time
+type importReader interface {
+	// next returns the next row, or io.EOF after the last one
+	next() (importRow, error)
+}
+
+// newImportReader starts reading an upload, rejecting a CSV header it does not understand
+func newImportReader(format string, r io.Reader) (importReader, error) {
+	if format == importFormatCSV {
+		return newCSVImportReader(r)
+	}
+	return newJSONLinesImportReader(r), nil
+}
+
+// csvImportReader reads CSV rows, reporting per-row parse errors instead of stopping at the first
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+func newCSVImportReader(r io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns, err := csvColumns(header)
+	if err != nil {
+		return nil, err
+	}
+	return &csvImportReader{reader: reader, columns: columns, line: 1}, nil
+}
+
+func (r *csvImportReader) next() (importRow, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return importRow{}, io.EOF
+	}
+	r.line++
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			return importRow{Row: r.line, Error: err.Error()}, nil
+		}
+		return importRow{}, fmt.Errorf("failed to read CSV line %d: %w", r.line, err)
+	}
+
+	product, err := productFromCSVRecord(r.columns, record)
+	if err != nil {
+		return importRow{Row: r.line, Error: err.Error()}, nil
+	}
+	return importRow{Row: r.line, Product: product}, nil
+}
+
+// jsonLinesImportReader reads one Product object per line, skipping blank lines
+type jsonLinesImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newJSONLinesImportReader(r io.Reader) *jsonLinesImportReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &jsonLinesImportReader{scanner: scanner}
+}
+
+func (r *jsonLinesImportReader) next() (importRow, error) {
+	for r.scanner.Scan() {
+		r.line++
+		data := bytes.TrimSpace(r.scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var product Product
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&product); err != nil {
+			return importRow{Row: r.line, Error: fmt.Sprintf("invalid JSON: %v", err)}, nil
+		}
+		return importRow{Row: r.line, Product: product}, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return importRow{}, fmt.Errorf("failed to read JSON Lines: %w", err)
+	}
+	return importRow{}, io.EOF
+}
+
+func newImportJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+// stock-management-app/import_test.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// awaitImportJob polls an import job until it is done
+func awaitImportJob(t *testing.T, api http.Handler, id string) importJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var job importJob
+		decodeData(t, serve(t, api, http.MethodGet, "/admin/import/"+id, ""), &job)
+		if job.CompletedAt != nil {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("import job %s still %s", id, job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImportWritesRowsInBackground(t *testing.T) {
+	api, repo := newTestAPI(t, Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 3})
+
+	upload := "id,name,category,price,quantity\n" +
+		"1,Mug,kitchen,11,3\n" +
+		"2,Lamp,lighting,45,7\n" +
+		"x,Broken,kitchen,1,1\n" +
+		"2,Lamp again,lighting,45,7\n"
+	w := serve(t, api, http.MethodPost, "/admin/import?format=csv", upload)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var accepted importJob
+	decodeData(t, w, &accepted)
+	if accepted.Status != importJobPending {
+		t.Errorf("accepted job is %s, want %s", accepted.Status, importJobPending)
+	}
+
+	job := awaitImportJob(t, api, accepted.Id)
+	if job.Status != importJobCompleted || job.TotalRows != 4 || job.Processed != 4 || job.Created != 1 || job.Updated != 1 || job.Failed != 2 {
+		t.Fatalf("job = %+v, want 4 rows: 1 created, 1 updated and 2 failed", job)
+	}
+	if len(job.Errors) != 2 || job.Errors[0].Row != 4 || job.Errors[1].Row != 5 {
+		t.Errorf("errors = %+v, want rows 4 and 5", job.Errors)
+	}
+	expectQuantity(t, repo, 2, 7)
+}
+
+func TestImportRejectsUnknownCSVColumns(t *testing.T) {
+	api, _ := newTestAPI(t)
+	expectProblem(t, serve(t, api, http.MethodPost, "/admin/import?format=csv", "id,name,colour\n1,Mug,red\n"), http.StatusBadRequest, codeBadRequest)
+	expectProblem(t, serve(t, api, http.MethodGet, "/admin/import/unknown", ""), http.StatusNotFound, codeNotFound)
+}
+
+func TestImportJobsExpireFromStateStore(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	_, client := connectSidecar(t)
+	cfg.ImportJobRetention = time.Second
+	currentConfig.Store(cfg)
+
+	// Another replica reads the job from the state store, other tenants do not find it
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	if err := newDaprImportJobStore(client).Save(ctx, importJob{Id: "job-1", Status: importJobRunning}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	job, err := newDaprImportJobStore(client).Get(ctx, "job-1")
+	if err != nil || job == nil || job.Status != importJobRunning {
+		t.Fatalf("Get = %+v, %v, want the running job", job, err)
+	}
+	job, err = newDaprImportJobStore(client).Get(withTenant(context.Background(), "other", tenantSourceJob), "job-1")
+	if err != nil || job != nil {
+		t.Fatalf("Get for another tenant = %+v, %v, want no job", job, err)
+	}
+
+	time.Sleep(cfg.ImportJobRetention + 100*time.Millisecond)
+	job, err = newDaprImportJobStore(client).Get(ctx, "job-1")
+	if err != nil || job != nil {
+		t.Fatalf("Get after the retention = %+v, %v, want no job", job, err)
+	}
+}
+
+// unindexedRepository fails to read the product ID index
+type unindexedRepository struct {
+	ProductRepository
+}
+
+func (r *unindexedRepository) GetProductIDs(ctx context.Context) ([]int, error) {
+	return nil, &unavailableError{Err: context.DeadlineExceeded}
+}
+
+func TestDryRunImportFailsWithoutTheProductIndex(t *testing.T) {
+	audit := newMemoryAuditStore()
+	repo := &unindexedRepository{newAuditedProductRepository(newMemoryProductRepository(), audit)}
+	api := newTestAPIWithRepository(t, repo, audit)
+
+	var accepted importJob
+	decodeData(t, serve(t, api, http.MethodPost, "/admin/import?format=jsonl&dryRun=true", `{"id":1,"name":"Mug","category":"kitchen","price":9.5,"quantity":3}`), &accepted)
+	job := awaitImportJob(t, api, accepted.Id)
+	if job.Status != importJobFailed || job.Error == "" || job.Processed != 0 {
+		t.Fatalf("job = %+v, want it failed before processing any row", job)
+	}
+}
+
+func TestCreateOnlyImportKeepsUnindexedProducts(t *testing.T) {
+	api, repo := newTestAPI(t)
+	ctx := withTenant(context.Background(), config().DefaultTenant, tenantSourceJob)
+	// Stored but missing from the index, as an index write lost to another replica leaves it
+	if err := repo.SaveProduct(ctx, Product{Id: 1, Name: "Mug", Category: "kitchen", Price: 9.5, Quantity: 3}); err != nil {
+		t.Fatalf("SaveProduct: %v", err)
+	}
+
+	var accepted importJob
+	decodeData(t, serve(t, api, http.MethodPost, "/admin/import?format=jsonl&mode=create", `{"id":1,"name":"Mug","category":"kitchen","price":12,"quantity":3}`), &accepted)
+	job := awaitImportJob(t, api, accepted.Id)
+	if job.Failed != 1 || job.Created != 0 {
+		t.Fatalf("job = %+v, want the existing product rejected", job)
+	}
+	product, _ := repo.GetProduct(ctx, 1)
+	if product.Price != 9.5 {
+		t.Errorf("price = %v, want the existing 9.5", product.Price)
+	}
+}
+
+func TestImportCountsWhatWasWritten(t *testing.T) {
+	api, repo := newTestAPI(t)
+	ctx := withTenant(context.Background(), config().DefaultTenant, tenantSourceJob)
+	upload := `{"id":1,"name":"Mug","category":"kitchen","price":9.5,"quantity":3}` + "\n" +
+		`{"id":2,"name":"Lamp","category":"lighting","price":45,"quantity":7}`
+
+	var dryRun importJob
+	decodeData(t, serve(t, api, http.MethodPost, "/admin/import?format=jsonl&dryRun=true", upload), &dryRun)
+	if job := awaitImportJob(t, api, dryRun.Id); job.Created != 2 || job.Updated != 0 {
+		t.Fatalf("dry run = %+v, want 2 created", job)
+	}
+
+	// Another writer adds product 2 before the import gets to it
+	if _, _, err := saveProduct(ctx, repo, Product{Id: 2, Name: "Lamp", Category: "lighting", Price: 40, Quantity: 1}); err != nil {
+		t.Fatalf("saveProduct: %v", err)
+	}
+	var accepted importJob
+	decodeData(t, serve(t, api, http.MethodPost, "/admin/import?format=jsonl", upload), &accepted)
+	if job := awaitImportJob(t, api, accepted.Id); job.Created != 1 || job.Updated != 1 {
+		t.Fatalf("job = %+v, want 1 created and 1 updated", job)
+	}
+}
@@ -0,0 +1,267 @@
+// stock-management-app/limits.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	commonv1pb "github.com/dapr/dapr/pkg/proto/common/v1"
+	runtimev1pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// Rate limit budgets, each client has a bucket per budget
+const (
+	budgetRead   = "read"
+	budgetWrite  = "write"
+	budgetExport = "export"
+	budgetAdmin  = "admin"
+)
+
+// routeBudgets is the budget each API route draws from, by method and path below the API
+// base path. Admin routes share budgetAdmin.
+var routeBudgets = map[string]string{
+	"GET /products":                   budgetRead,
+	"GET /product/:productid":         budgetRead,
+	"GET /product/:productid/history": budgetRead,
+	"GET /export/products":            budgetExport,
+	"POST /product":                   budgetWrite,
+	"POST /updateStock":               budgetWrite,
+}
+
+// rpcBudgets is the budget each unary RPC draws from, the same as its HTTP counterpart
+var rpcBudgets = map[string]string{
+	CatalogService_GetProduct_FullMethodName:          budgetRead,
+	CatalogService_ListProducts_FullMethodName:        budgetRead,
+	CatalogService_UpsertProduct_FullMethodName:       budgetWrite,
+	InventoryService_ApplyStockUpdates_FullMethodName: budgetWrite,
+}
+
+// rateLimitSweepInterval is how often buckets that have refilled completely are dropped
+const rateLimitSweepInterval = time.Minute
+
+// budgetPerMinute returns the requests per minute a client may make against a budget, 0 for no limit
+func budgetPerMinute(cfg *Config, budget string) int {
+	switch budget {
+	case budgetRead:
+		return cfg.RateLimitReadPerMinute
+	case budgetWrite:
+		return cfg.RateLimitWritePerMinute
+	case budgetExport:
+		return cfg.RateLimitExportPerMinute
+	case budgetAdmin:
+		return cfg.RateLimitAdminPerMinute
+	}
+	return 0
+}
+
+// routeBudget returns the budget of the route a request matched, if it has one
+func routeBudget(c *gin.Context) (string, bool) {
+	path := strings.TrimPrefix(c.FullPath(), apiBasePath)
+	if strings.HasPrefix(path, "/admin/") {
+		return budgetAdmin, true
+	}
+	budget, ok := routeBudgets[c.Request.Method+" "+path]
+	return budget, ok
+}
+
+// tokenBucket holds the requests a client may still make, refilled continuously
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64 // tokens per second
+	updated  time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+// rateLimiter keeps a token bucket per client and budget
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// take spends a token from the bucket of key, which holds burstSeconds worth of perMinute.
+// When the bucket is empty it reports how long until the next token.
+func (l *rateLimiter) take(key string, perMinute, burstSeconds int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	rate := float64(perMinute) / 60
+	capacity := math.Max(1, math.Ceil(rate*float64(burstSeconds)))
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	// Budgets may be reloaded, a bucket follows the current one from now on
+	b.capacity, b.rate = capacity, rate
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled, a new bucket starts full anyway
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.rate >= b.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// admit spends a token from the budget of a client, identified by its principal or, for
+// anonymous callers, by IP. Deliveries from the sidecar are not throttled: Dapr retries a
+// 429 and the events would only pile up.
+func (l *rateLimiter) admit(budget string, p *principal, ip string) error {
+	cfg := config()
+	perMinute := budgetPerMinute(cfg, budget)
+	if perMinute <= 0 || (p != nil && p.Method == "dapr-api-token") {
+		return nil
+	}
+
+	client := "ip:" + ip
+	if p != nil && p != anonymousPrincipal {
+		client = p.Method + ":" + p.Name
+	}
+	if ok, wait := l.take(budget+"|"+client, perMinute, cfg.RateLimitBurstSeconds, time.Now()); !ok {
+		return newRateLimitedError(budget, wait)
+	}
+	return nil
+}
+
+// rateLimit throttles each client per route budget once authenticate has identified it
+func rateLimit(limiter *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		budget, ok := routeBudget(c)
+		if !ok {
+			c.Next()
+			return
+		}
+		p, _ := principalFromContext(c.Request.Context())
+		if err := limiter.admit(budget, p, c.ClientIP()); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimitUnaryInterceptor throttles RPCs, called directly or through OnInvoke, once
+// authUnaryInterceptor has identified the caller. Sharing the limiter of rateLimit, a client
+// spends the same budgets over HTTP and gRPC.
+func rateLimitUnaryInterceptor(limiter *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := info.FullMethod
+		if in, ok := req.(*commonv1pb.InvokeRequest); ok && method == runtimev1pb.AppCallback_OnInvoke_FullMethodName {
+			method = "/" + in.GetMethod()
+		}
+		budget, ok := rpcBudgets[method]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		var ip string
+		if caller, ok := peer.FromContext(ctx); ok && caller.Addr != nil {
+			ip = caller.Addr.String()
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
+		}
+		p, _ := principalFromContext(ctx)
+		if err := limiter.admit(budget, p, ip); err != nil {
+			return nil, grpcError(ctx, err)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// limitRequestBody caps how much of a request body handlers can read. Reading past the
+// limit fails with an *http.MaxBytesError, reported as 413 by requestBodyError.
+func limitRequestBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := config().MaxRequestBodyBytes
+		if strings.HasSuffix(c.FullPath(), "/admin/import") {
+			limit = config().MaxImportBodyBytes
+		}
+		if limit > 0 && c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(limit))
+		}
+		c.Next()
+	}
+}
+
+// limitEventBody caps the body of event deliveries, which the callback middlewares and the
+// SDK read in full before the request reaches Gin. Other paths keep Gin's per-route limits.
+func limitEventBody(subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	routes := subscriptionRoutes(subscriptions)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := int64(config().MaxRequestBodyBytes)
+			if limit > 0 && r.Body != nil && routes[r.URL.Path] {
+				if r.ContentLength > limit {
+					slog.WarnContext(r.Context(), "Rejecting event delivery over the body size limit", "path", r.URL.Path, "bytes", r.ContentLength, "limit", limit)
+					http.Error(w, (&http.MaxBytesError{Limit: limit}).Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseTrustedProxies reads comma-separated addresses or CIDRs
+func parseTrustedProxies(raw string) ([]string, error) {
+	var proxies []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+		}
+		proxies = append(proxies, entry)
+	}
+	return proxies, nil
+}
+
+// requestBodyError reports a request body that could not be read or parsed: as too large when
+// it went over the limit, as invalid otherwise
+func requestBodyError(err error, invalid *APIError) *APIError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newPayloadTooLargeError(tooLarge.Limit)
+	}
+	return invalid
+}
@@ -0,0 +1,82 @@
+// stock-management-app/limits_test.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// changeConfig applies change to a copy of the current configuration, which loadTestConfig
+// puts back once the test is done
+func changeConfig(change func(cfg *Config)) {
+	cfg := config().clone()
+	change(cfg)
+	currentConfig.Store(cfg)
+}
+
+func TestRateLimitAnswers429WithRetryAfter(t *testing.T) {
+	api, _ := newTestAPI(t, Product{Id: 1, Name: "Mug", Quantity: 3})
+	changeConfig(func(cfg *Config) { cfg.RateLimitReadPerMinute = 1 })
+
+	if w := serve(t, api, http.MethodGet, "/products", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	w := serve(t, api, http.MethodGet, "/product/1", "")
+	expectProblem(t, w, http.StatusTooManyRequests, codeRateLimited)
+	if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || seconds < 1 || seconds > 60 {
+		t.Errorf("Retry-After = %q, want the seconds until the next token", w.Header().Get("Retry-After"))
+	}
+
+	// Other budgets are not spent
+	if w := serve(t, api, http.MethodGet, "/export/products", ""); w.Code != http.StatusOK {
+		t.Errorf("export: status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestRateLimitAppliesToRPCs(t *testing.T) {
+	cfg, auth := useTestConfig(t)
+	changeConfig(func(cfg *Config) { cfg.RateLimitReadPerMinute = 1 })
+	repo := newMemoryProductRepository()
+	if _, _, err := saveProduct(withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob), repo, Product{Id: 1, Name: "Mug", Quantity: 3}); err != nil {
+		t.Fatalf("saveProduct: %v", err)
+	}
+	conn := dialTestGRPC(t, repo, auth, newRateLimiter())
+	catalog := NewCatalogServiceClient(conn)
+
+	if _, err := catalog.GetProduct(context.Background(), &GetProductRequest{Id: 1}); err != nil {
+		t.Fatalf("first GetProduct: %v", err)
+	}
+	if _, err := catalog.ListProducts(context.Background(), &ListProductsRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("ListProducts = %v, want ResourceExhausted", err)
+	}
+	// Stock updates draw from the write budget
+	if _, err := NewInventoryServiceClient(conn).ApplyStockUpdates(context.Background(), &ApplyStockUpdatesRequest{
+		Updates: []*StockUpdate{{Id: 1, PurchaseQty: 1}},
+	}); err != nil {
+		t.Errorf("ApplyStockUpdates: %v", err)
+	}
+}
+
+func TestStockUpdatesAreCapped(t *testing.T) {
+	api, repo := newTestAPI(t, Product{Id: 1, Name: "Mug", Quantity: 10})
+	changeConfig(func(cfg *Config) { cfg.MaxStockUpdates = 2 })
+	updates := `{"updates":[{"id":1,"purchaseQty":1},{"id":1,"purchaseQty":1},{"id":1,"purchaseQty":1}]}`
+
+	expectProblem(t, serve(t, api, http.MethodPost, "/updateStock", updates), http.StatusBadRequest, codeValidation)
+	expectQuantity(t, repo, 1, 10)
+
+	ctx := withTenant(context.Background(), config().DefaultTenant, tenantSourceJob)
+	_, err := (&inventoryServer{repo: repo}).ApplyStockUpdates(ctx, &ApplyStockUpdatesRequest{
+		Updates: []*StockUpdate{{Id: 1, PurchaseQty: 1}, {Id: 1, PurchaseQty: 1}, {Id: 1, PurchaseQty: 1}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ApplyStockUpdates = %v, want InvalidArgument", err)
+	}
+	expectQuantity(t, repo, 1, 10)
+}
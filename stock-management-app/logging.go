@@ -0,0 +1,222 @@
+// stock-management-app/logging.go
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	requestIDHeader   = "X-Request-ID"
+	traceParentHeader = "traceparent"
+)
+
+var (
+	// redactedFields are JSON keys whose values never appear in logs, matched case-insensitively
+	redactedFields = []string{"password", "secret", "token", "authorization", "apikey", "api_key", "cookie"}
+
+	// logLevel follows LOG_LEVEL, including changes reloaded at runtime
+	logLevel slog.LevelVar
+)
+
+type correlationKey struct{}
+
+// correlation identifies the request or event a log line belongs to
+type correlation struct {
+	RequestID string
+	TraceID   string
+}
+
+// setupLogging replaces the default logger with a JSON logger at LOG_LEVEL. Lines logged
+// with a request context carry its request, trace and span IDs; the standard log package,
+// used by the Dapr SDK, goes through the same handler.
+func setupLogging() {
+	applyLogLevel(config())
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})
+	slog.SetDefault(slog.New(correlationHandler{handler}))
+}
+
+// applyLogLevel switches the logger to the level of cfg, which has been validated
+func applyLogLevel(cfg *Config) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err == nil {
+		logLevel.Set(level)
+	}
+}
+
+// correlationHandler adds the request ID and the current span found in the context to every
+// record, or the trace ID of the request when it is not traced
+type correlationHandler struct {
+	slog.Handler
+}
+
+func (h correlationHandler) Handle(ctx context.Context, record slog.Record) error {
+	c, _ := ctx.Value(correlationKey{}).(correlation)
+	if c.RequestID != "" {
+		record.AddAttrs(slog.String("requestId", c.RequestID))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("traceId", span.TraceID().String()), slog.String("spanId", span.SpanID().String()))
+	} else if c.TraceID != "" {
+		record.AddAttrs(slog.String("traceId", c.TraceID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h correlationHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlationHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlationHandler) WithGroup(name string) slog.Handler {
+	return correlationHandler{h.Handler.WithGroup(name)}
+}
+
+// withCorrelation returns a context carrying the request ID, generating one when it is empty,
+// and the trace ID of a W3C traceparent. A context that already has one is returned as is.
+func withCorrelation(ctx context.Context, requestID, traceParent string) (context.Context, correlation) {
+	if c, ok := ctx.Value(correlationKey{}).(correlation); ok {
+		return ctx, c
+	}
+
+	if requestID == "" || len(requestID) > 128 {
+		requestID = newRequestID()
+	}
+	c := correlation{RequestID: requestID}
+	// traceparent is version-traceid-parentid-flags
+	if parts := strings.Split(traceParent, "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		c.TraceID = parts[1]
+	}
+	return context.WithValue(ctx, correlationKey{}, c), c
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// correlationMiddleware tags requests to the Dapr HTTP service, including event deliveries
+func correlationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, c := withCorrelation(r.Context(), r.Header.Get(requestIDHeader), r.Header.Get(traceParentHeader))
+		w.Header().Set(requestIDHeader, c.RequestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestLogger tags Gin requests that were not tagged by the Dapr HTTP service yet and
+// logs one line per request. Probes and metrics scrapes are only logged at debug level.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		ctx, corr := withCorrelation(c.Request.Context(), c.GetHeader(requestIDHeader), c.GetHeader(traceParentHeader))
+		c.Request = c.Request.WithContext(ctx)
+		c.Header(requestIDHeader, corr.RequestID)
+
+		c.Next()
+
+		level := slog.LevelInfo
+		if isOperationalPath(c.Request.URL.Path) {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "Request served",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"bytes", c.Writer.Size(),
+			"durationMs", time.Since(start).Milliseconds(),
+			"clientIp", c.ClientIP())
+	}
+}
+
+// correlationUnaryInterceptor tags gRPC calls with the request and trace IDs from their metadata
+func correlationUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(grpcCorrelation(ctx), req)
+}
+
+// correlationStreamInterceptor tags gRPC streams like correlationUnaryInterceptor
+func correlationStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &correlatedStream{ServerStream: stream, ctx: grpcCorrelation(stream.Context())})
+}
+
+func grpcCorrelation(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	ctx, _ = withCorrelation(ctx, first(strings.ToLower(requestIDHeader)), first(traceParentHeader))
+	return ctx
+}
+
+type correlatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *correlatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// logPayload prepares a request or event payload for logging: sensitive JSON fields are
+// redacted and the result is cut to LOG_PAYLOAD_LIMIT bytes
+func logPayload(data []byte) string {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err == nil {
+		if redacted, err := json.Marshal(redactFields(doc)); err == nil {
+			data = redacted
+		}
+	}
+
+	if limit := config().LogPayloadLimit; limit >= 0 && len(data) > limit {
+		return fmt.Sprintf("%s...(%d bytes truncated)", data[:limit], len(data)-limit)
+	}
+	return string(data)
+}
+
+func redactFields(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isRedactedField(key) {
+				v[key] = "[REDACTED]"
+				continue
+			}
+			v[key] = redactFields(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactFields(item)
+		}
+	}
+	return value
+}
+
+func isRedactedField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range redactedFields {
+		if strings.Contains(key, field) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,37 +4,39 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	dapr "github.com/dapr/go-sdk/client"
 	"github.com/gin-gonic/gin"
-)
-
-var (
-	stateStoreName = getEnv("STATE_STORE_NAME", "statestore")
-	pubsubName     = getEnv("PUBSUB_NAME", "orderpubsub")
-	maxRetries     = getEnvAsInt("MAX_RETRIES", 3)
-	port           = getEnv("PORT", "8080")
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Product struct {
-	Id          int      `json:"id"`
-	Name        string   `json:"name"`
-	Category    string   `json:"category"`
-	Price       float64  `json:"price"`
-	Description string   `json:"description"`
-	ImageUrl    string   `json:"imageUrl"`
-	Quantity    int      `json:"quantity"`
-	Tags        []string `json:"tags"`
+	Id          int      `json:"id" yaml:"id"`
+	Name        string   `json:"name" yaml:"name"`
+	Category    string   `json:"category" yaml:"category"`
+	Price       float64  `json:"price" yaml:"price"`
+	Description string   `json:"description" yaml:"description"`
+	ImageUrl    string   `json:"imageUrl" yaml:"imageUrl"`
+	Quantity    int      `json:"quantity" yaml:"quantity"`
+	Tags        []string `json:"tags" yaml:"tags"`
 }
 
 type StockUpdateRequest struct {
@@ -47,458 +49,722 @@ type ProductUpdate struct {
 }
 
 type DaprStockUpdateRequest struct {
-	Data StockUpdateRequest `json:"data"`
+	Data     StockUpdateRequest `json:"data"`
+	TenantID string             `json:"tenantid"`
 }
 
-// APIResponse struct for consistent API response
+// APIResponse is the versioned envelope for every successful API response.
+// Errors are returned as RFC 7807 problem details instead, see response.go.
 type APIResponse struct {
-	Status  string      `json:"status"`
-	Message string      `json:"message,omitempty"`
-	Error   string      `json:"error,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
+	APIVersion string      `json:"apiVersion"`
+	Status     string      `json:"status"`
+	Message    string      `json:"message,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
 }
 
 func main() {
-	// Initialize Gin router
-	r := gin.Default()
+	setupLogging()
+	cfg, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	var problems ConfigErrors
+	if errors.As(err, &problems) {
+		slog.Error("Invalid configuration", "problems", []string(problems))
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("Failed to load the configuration", "error", err)
+		os.Exit(1)
+	}
+	currentConfig.Store(cfg)
+	applyLogLevel(cfg)
+
+	// Every tenant has its own catalog, TENANTS_FILE lists them with their own settings
+	registered, err := loadTenants(cfg)
+	if err != nil {
+		slog.Error("Failed to load the tenants", "error", err)
+		os.Exit(1)
+	}
+	setTenants(registered)
+
+	flushTraces, err := setupTracing(context.Background())
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize Gin router, requests are logged by requestLogger instead of Gin's own logger.
+	// Every request but the probes gets a span, continuing the trace of its caller or event.
+	// Bodies are capped before anything reads them, and streams a handler could not finish are
+	// aborted once every other middleware is done with them.
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	r := gin.New()
+	trustedProxies, _ := parseTrustedProxies(config().TrustedProxies)
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		slog.Error("Failed to set the trusted proxies", "error", err)
+		os.Exit(1)
+	}
+	r.Use(abortTruncatedResponses(), limitRequestBody(), cloudEventTrace(), otelgin.Middleware(config().ServiceName, otelgin.WithFilter(isTracedRequest)),
+		requestLogger(), metricsMiddleware(), gin.Recovery(), errorMiddleware())
 
 	var client dapr.Client
-	var err error
 
 	// Attempt to create a Dapr client with retries
-	for attempt := 0; attempt < maxRetries; attempt++ {
+	for attempt := 0; attempt < config().MaxRetries; attempt++ {
 		client, err = dapr.NewClient()
 		if err == nil {
 			break
 		}
-		log.Printf("Failed to create Dapr client (attempt %d/%d): %v", attempt+1, maxRetries, err)
+		slog.Warn("Failed to create Dapr client", "attempt", attempt+1, "maxRetries", config().MaxRetries, "error", err)
 		time.Sleep(2 * time.Second) // Wait for 2 seconds before retrying
 	}
 
 	if err != nil {
-		log.Printf("All retries failed: %v", err)
+		slog.Error("All retries to create the Dapr client failed", "error", err)
 		os.Exit(1)
 	}
 
-	defer client.Close()
-
-	// Health Check Endpoints
-	r.GET("/healthz", healthCheck)
-	r.GET("/ready", readinessCheck)
+	// Run the storage migration instead of the server when asked to
+	if len(args) > 0 && args[0] == "migrate" {
+		err := runMigrateCommand(client, args[1:])
+		client.Close()
+		if err != nil {
+			slog.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	// Dapr Endpoints
-	r.GET("/dapr/config", daprConfig)
-	r.GET("/dapr/subscribe", daprSubscribe)
+	// State and pubsub calls get deadlines and a circuit breaker, readiness probes the sidecar directly
+	daprClient := newResilientClient(client)
+	// Every product write is recorded in the audit trail
+	audit := newDaprAuditStore(daprClient)
+	repo := newAuditedProductRepository(newDaprProductRepository(daprClient), audit)
+	imports := newDaprImportJobStore(daprClient)
 
-	// Endpoints
-	r.POST("/product", func(c *gin.Context) { storeProduct(c, client) })
-	r.GET("/products", func(c *gin.Context) { getAllProducts(c, client) })
-	r.POST("/updateStock", func(c *gin.Context) { updateStock(c, client) })
-	r.GET("/product/:productid", func(c *gin.Context) { getProductByID(c, client) })
-
-	// Call initializeSampleProducts to preload products into the state store
-	if err := initializeSampleProducts(client); err != nil {
-		log.Printf("Error initializing sample products: %v", err)
-		// Handle the error as needed
-		return
+	// API keys and bearer tokens identify callers once configured, the sidecar's own calls
+	// carry the Dapr app API token
+	auth, err := newAuthChain(config())
+	if err != nil {
+		slog.Error("Failed to set up authentication", "error", err)
+		os.Exit(1)
+	}
+	if !auth.enforced {
+		slog.Warn("Authentication is off (AUTH_DISABLED), every caller is an admin")
 	}
 
-	// Start the server on the specified port
-	if err := r.Run(":" + port); err != nil {
-		log.Printf("Failed to start the server: %v", err)
-		// Handle the server startup error as needed
-		return
+	// Health Check Endpoints, open to probes and scrapers
+	r.GET("/healthz", healthCheck)
+	r.GET("/ready", readinessCheck(newReadinessChecker(client)))
+	r.GET("/metrics", serveMetrics())
+
+	// Versioned API, requests are validated against the OpenAPI document it serves
+	doc, err := newOpenAPIDocument()
+	if err != nil {
+		slog.Error("Failed to build the OpenAPI document", "error", err)
+		os.Exit(1)
+	}
+	validator, err := openAPIValidationMiddleware(doc)
+	if err != nil {
+		slog.Error("Failed to create the request validator", "error", err)
+		os.Exit(1)
 	}
-}
 
-// Utility function to get environment variable as string
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+	v1 := r.Group(apiBasePath)
+	v1.GET("/openapi.json", serveOpenAPIDocument(doc))
+	limiter := newRateLimiter()
+	registerAPIRoutes(v1.Group("", authenticate(auth), resolveTenant(), rateLimit(limiter), validator), repo, audit, imports)
+
+	// Serve the gRPC API on its own port from the same process
+	lis, err := net.Listen("tcp", ":"+config().GRPCPort)
+	if err != nil {
+		slog.Error("Failed to listen on the gRPC port", "port", config().GRPCPort, "error", err)
+		os.Exit(1)
+	}
+	// Topic subscriptions are served on whichever channel the sidecar calls the app on
+	subscriptions := stockSubscriptions(repo)
+	var grpcSubscriptions []topicSubscription
+	if config().DaprAppProtocol == appProtocolGRPC {
+		grpcSubscriptions = subscriptions
 	}
-	return fallback
-}
 
-// Utility function to get environment variable as integer
-func getEnvAsInt(name string, defaultVal int) int {
-	if value, ok := os.LookupEnv(name); ok {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+	grpcServer, grpcService, err := newGRPCService(lis, repo, grpcSubscriptions, auth, limiter)
+	if err != nil {
+		slog.Error("Failed to create the gRPC service", "error", err)
+		os.Exit(1)
+	}
+	go func() {
+		if err := grpcService.Start(); !isServerClosed(err) {
+			slog.Error("gRPC server stopped", "error", err)
+			markUnrecoverable(fmt.Sprintf("gRPC server stopped: %v", err))
+		}
+	}()
+
+	// Seed the catalog of each tenant according to its seed mode and file in the background,
+	// after moving products stored before catalogs were kept per tenant into the default tenant
+	// and converting each tenant's records into the current format.
+	// Only one replica runs each job; readiness stays false until seeding has completed.
+	// A failure shuts the server down the way a signal would, then exits with an error.
+	startupErr := make(chan error, 1)
+	backgroundWorkers.Go(func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, config().StartupJobWait)
+		defer cancel()
+
+		runOnce := func(name string, job func() error) error {
+			return runStartupJob(ctx, daprClient, name, job)
+		}
+		var err error
+		if tenant := config().DefaultTenant; tenant != "" {
+			err = runOnce(legacyCatalogJobName, func() error {
+				report, err := moveLegacyCatalog(withTenant(ctx, tenant, tenantSourceJob), daprClient, config().LegacyProductScanLimit, false)
+				if err == nil && len(report.Failed) > 0 {
+					err = fmt.Errorf("%d legacy products could not be moved to tenant %s", len(report.Failed), tenant)
+				}
+				return err
+			})
+		}
+		for _, tenant := range tenantIDs() {
+			if err != nil {
+				break
+			}
+			tenantCtx := withTenant(ctx, tenant, tenantSourceJob)
+			err = runOnce(productRecordsJobName(tenant), func() error {
+				return migrateTenantRecords(tenantCtx, daprClient)
+			})
+			if err != nil {
+				break
+			}
+			_, err = seedProductCatalog(withAuditActor(tenantCtx, "job:seed"), repo, runOnce)
+		}
+		if err != nil {
+			if shuttingDown.Load() {
+				slog.Warn("Seeding product catalog interrupted by shutdown", "error", err)
+				return
+			}
+			startupErr <- err
+			return
+		}
+		seedCompleted.Store(true)
+	})
+
+	// Rebuild the inventory gauges now and then, they only see this replica's writes otherwise,
+	// and follow the reloadable settings held in the configuration store
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go resyncInventory(watchCtx, repo)
+	if storeName := config().ConfigStoreName; storeName != "" {
+		watchConfiguration(watchCtx, client, storeName)
+	}
+	if storeName := config().FeatureFlagStoreName; storeName != "" {
+		watchFeatureFlags(watchCtx, client, storeName)
+	}
+
+	// Start the server on the specified port, through the Dapr HTTP service unless
+	// the sidecar talks to the app over gRPC
+	var startHTTP func() error
+	var stopHTTP httpServerStopper
+	if config().DaprAppProtocol == appProtocolGRPC {
+		server := &http.Server{Addr: ":" + config().Port, Handler: r}
+		startHTTP = server.ListenAndServe
+		stopHTTP = server.Shutdown
+	} else {
+		httpService, err := newHTTPCallbackService(":"+config().Port, r, subscriptions, auth)
+		if err != nil {
+			slog.Error("Failed to create the Dapr HTTP service", "error", err)
+			os.Exit(1)
+		}
+		startHTTP = httpService.Start
+		stopHTTP = func(ctx context.Context) error {
+			// Stop closes the listener but gives up after five seconds, keep waiting until ctx is done
+			if err := httpService.Stop(); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+			return waitWithContext(ctx, inFlightRequests.Wait)
 		}
 	}
-	return defaultVal
-}
-
-// healthCheck responds to health check requests, used for liveness probe
-func healthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "healthy"})
-}
 
-// readinessCheck responds to readiness check requests, used for readiness probe
-func readinessCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- startHTTP()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		slog.Info("Received shutdown signal", "signal", sig.String())
+	case err := <-serverErr:
+		slog.Error("Failed to start the server", "error", err)
+		exitCode = 1
+	case err := <-startupErr:
+		slog.Error("Error seeding product catalog", "error", err)
+		exitCode = 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config().ShutdownTimeout)
+	defer cancel()
+	stopWatching()
+	gracefulShutdown(ctx, stopHTTP, grpcServer)
+	if err := flushTraces(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+	slog.Info("Closing the Dapr client")
+	client.Close()
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 }
 
-// Dapr Config
-func daprConfig(c *gin.Context) {
-	config := map[string]interface{}{
-		"subscriptions": []map[string]interface{}{
-			{
-				"pubsubname": pubsubName,
-				"topic":      "stockUpdate",
-				"route":      "/updateStock",
-			},
-		},
-	}
-	c.JSON(http.StatusOK, config)
+// registerAPIRoutes registers the product, stock, export and admin endpoints on a route group
+// whose callers have been authenticated, each with the role it requires
+func registerAPIRoutes(g *gin.RouterGroup, repo ProductRepository, audit auditStore, imports importJobStore) {
+	// Endpoints
+	g.POST("/product", requireRole(roleMerchandiser), func(c *gin.Context) { storeProduct(c, repo) })
+	g.GET("/products", requireRole(roleReader), func(c *gin.Context) { getAllProducts(c, repo) })
+	g.POST("/updateStock", requireRole(roleInventory), func(c *gin.Context) { updateStock(c, repo) })
+	g.GET("/product/:productid", requireRole(roleReader), func(c *gin.Context) { getProductByID(c, repo) })
+	g.GET("/product/:productid/history", requireRole(roleMerchandiser), func(c *gin.Context) { getProductHistory(c, repo, audit) })
+
+	g.GET("/export/products", requireRole(roleReader), func(c *gin.Context) { exportProducts(c, repo) })
+
+	// Admin Endpoints
+	admin := g.Group("/admin", requireRole(roleAdmin), auditAdminActions(audit))
+	admin.POST("/import", func(c *gin.Context) { startImport(c, repo, imports) })
+	admin.GET("/import/:jobId", func(c *gin.Context) { getImportJob(c, imports) })
+	admin.GET("/config", getConfig)
+	admin.GET("/features", getFeatureFlags)
+	admin.GET("/audit", func(c *gin.Context) { listAuditEntries(c, repo, audit) })
 }
 
-// Dapr Subscription
-func daprSubscribe(c *gin.Context) {
-	subscriptions := []map[string]string{
-		{
-			"pubsubname": pubsubName,
-			"topic":      "stockUpdate",
-			"route":      "/updateStock",
-		},
+func storeProduct(c *gin.Context, repo ProductRepository) {
+	var product Product
+	if err := c.ShouldBindJSON(&product); err != nil {
+		abortWithError(c, requestBodyError(err, newBadRequestError("Invalid request body: %v", err)))
+		return
 	}
-	c.JSON(http.StatusOK, subscriptions)
-}
 
-func storeProduct(c *gin.Context, client dapr.Client) {
-	var product Product
-	if err := c.BindJSON(&product); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+	if errs := validateProduct(product); len(errs) > 0 {
+		abortWithError(c, newValidationError(errs))
 		return
 	}
 
 	// Save product to state store
-	if err := saveToStateStore(client, product.Id, product); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	product, _, err := saveProduct(c.Request.Context(), repo, product)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Product stored successfully!"})
+	respond(c, http.StatusOK, product, "Product stored successfully!")
+}
+
+// productIDsMu serialises additions to the product ID index within this process, the index's
+// ETag guards against other replicas
+var productIDsMu sync.Mutex
+
+// saveProduct writes a product and adds its ID to the product ID index if it is new, rounding
+// its price first when featurePriceRounding is on. It returns the product as stored and reports
+// whether it was newly added to the index.
+func saveProduct(ctx context.Context, repo ProductRepository, product Product) (Product, bool, error) {
+	if featureEnabled(featurePriceRounding) {
+		product.Price = math.Round(product.Price*100) / 100
+	}
+
+	if err := repo.SaveProduct(ctx, product); err != nil {
+		return product, false, err
+	}
+	stockWatchers.publish(ctx, product)
+
+	productIDsMu.Lock()
+	defer productIDsMu.Unlock()
+	added, err := repo.AddProductID(ctx, product.Id)
+	return product, added, err
 }
 
 // getAllProducts retrieves all products from the state store
-func getAllProducts(c *gin.Context, client dapr.Client) {
-	productIDs, err := getProductIDs(client)
+func getAllProducts(c *gin.Context, repo ProductRepository) {
+	filter, err := parseProductFilter(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, newBadRequestError("%v", err))
 		return
 	}
 
-	if len(productIDs) == 0 {
-		log.Println("No products found in state store")
-		c.JSON(http.StatusOK, gin.H{"products": []Product{}})
+	products, err := listProducts(c.Request.Context(), repo, filter)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
+	respond(c, http.StatusOK, products, "")
+}
+
+// listProducts returns the products that pass the filter, skipping products that cannot be read
+func listProducts(ctx context.Context, repo ProductRepository, filter productFilter) ([]Product, error) {
+	productIDs, err := repo.GetProductIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(productIDs) == 0 {
+		slog.DebugContext(ctx, "No products found in state store")
+	}
+
 	products := make([]Product, 0)
 	for _, id := range productIDs {
-		var product Product
-		err := getFromStateStore(client, id, &product)
+		product, err := repo.GetProduct(ctx, id)
+		if errors.Is(err, errStateStoreUnavailable) || ctx.Err() != nil {
+			// Skipping would return a silently truncated list
+			return nil, err
+		}
 		if err != nil {
-			log.Printf("Failed to retrieve product with ID %d: %v", id, err)
+			slog.WarnContext(ctx, "Failed to retrieve product", "productId", id, "error", err)
+			continue
+		}
+		if !filter.matches(product) {
 			continue
 		}
 		products = append(products, product)
 	}
-
-	c.JSON(http.StatusOK, products)
+	return products, nil
 }
 
 // The updateStock function will read the request body, iterate over the product updates, and adjust the stock quantities.
-func updateStock(c *gin.Context, client dapr.Client) {
-	log.Println("Starting stock update process")
+func updateStock(c *gin.Context, repo ProductRepository) {
+	ctx := c.Request.Context()
+	slog.DebugContext(ctx, "Starting stock update process")
 
 	var daprReq DaprStockUpdateRequest
 	var req StockUpdateRequest
+	var fromDapr bool
 	var err error
 
 	requestBody, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading request body"})
+		slog.WarnContext(ctx, "Error reading request body", "error", err)
+		abortWithError(c, requestBodyError(err, newBadRequestError("Error reading request body")))
 		return
 	}
-	log.Printf("Request Body: %s", string(requestBody))
+	slog.DebugContext(ctx, "Stock update request", "body", logPayload(requestBody))
 
 	// Try to unmarshal as a Dapr request
 	err = json.Unmarshal(requestBody, &daprReq)
 	if err != nil {
-		log.Printf("Error unmarshalling as Dapr request: %v", err)
+		slog.DebugContext(ctx, "Request is not a Dapr event", "error", err)
 	}
 	if err == nil && daprReq.Data.Updates != nil {
 		// It's a Dapr request
 		req = daprReq.Data
-		log.Println("Processed as Dapr request")
+		fromDapr = true
+		slog.DebugContext(ctx, "Processed as Dapr request")
 	} else {
 		// Try to unmarshal as a direct request
 		err = json.Unmarshal(requestBody, &req)
 		if err != nil {
-			log.Printf("Error unmarshalling as direct request: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			slog.WarnContext(ctx, "Error unmarshalling stock update request", "error", err)
+			abortWithError(c, newBadRequestError("Invalid request format"))
 			return
 		}
-		log.Println("Processed as direct request")
+		slog.DebugContext(ctx, "Processed as direct request")
 	}
 
-	for _, update := range req.Updates {
-		log.Printf("Processing stock update for Product ID %d, Purchase Quantity: %d", update.Id, update.PurchaseQty)
+	source := stockUpdateSourceHTTP
+	if fromDapr {
+		source = stockUpdateSourceEvent
+		if ctx, err = scopeEventTenant(ctx, daprReq.TenantID); err != nil {
+			slog.WarnContext(ctx, "Dropping stock update event for a tenant that is not served", "error", err)
+			countStockUpdate(source, stockUpdateFailed)
+			c.JSON(http.StatusOK, gin.H{"status": "DROP"})
+			return
+		}
+	}
 
-		var product Product
-		err := getFromStateStore(client, update.Id, &product)
-		if err != nil {
-			log.Printf("Error getting product with ID %d from state store: %v", update.Id, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get product with ID %d: %v", update.Id, err)})
-			continue
+	if errs := validateStockUpdateRequest(req); len(errs) > 0 {
+		slog.WarnContext(ctx, "Rejecting invalid stock update", "errors", errs.Error())
+		countStockUpdate(source, stockUpdateFailed)
+		if fromDapr {
+			// Tell Dapr to drop the event, redelivering it would never succeed
+			c.JSON(http.StatusOK, gin.H{"status": "DROP"})
+			return
 		}
-		log.Printf("Retrieved product from state store: %+v", product)
+		abortWithError(c, newValidationError(errs))
+		return
+	}
 
-		product.Quantity -= update.PurchaseQty
-		log.Printf("Updated quantity for Product ID %d, New Quantity: %d", update.Id, product.Quantity)
+	// Dapr redelivers events that fail with anything but a 404
+	_, err = applyStockUpdates(ctx, repo, req.Updates)
+	countStockUpdate(source, stockUpdateResult(err, fromDapr))
+	if fromDapr && errors.Is(err, errInsufficientStock) {
+		slog.WarnContext(ctx, "Dropping stock update event", "error", err)
+		c.JSON(http.StatusOK, gin.H{"status": "DROP"})
+		return
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 
-		if err := saveToStateStore(client, update.Id, product); err != nil {
-			log.Printf("Error saving product with ID %d to state store: %v", update.Id, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+	slog.InfoContext(ctx, "Stock update completed", "updates", len(req.Updates))
+	respond(c, http.StatusOK, nil, "Stock updated successfully!")
+}
+
+// errInsufficientStock is wrapped when a purchase exceeds the stock on hand and backorders are off
+var errInsufficientStock = errors.New("insufficient stock")
+
+// isPermanentStockUpdateError reports whether applying a stock update again would fail the same way
+func isPermanentStockUpdateError(err error) bool {
+	return errors.Is(err, errProductNotFound) || errors.Is(err, errInsufficientStock)
+}
+
+// applyStockUpdates subtracts each purchase from the stock level and returns the updated products.
+// Every product is read before any is written, then all are saved in one transaction, so an
+// update that fails leaves stock untouched and can be retried as a whole.
+func applyStockUpdates(ctx context.Context, repo ProductRepository, updates []ProductUpdate) ([]Product, error) {
+	var order []int
+	products := make(map[int]versionedProduct, len(updates))
+	for _, update := range updates {
+		product, ok := products[update.Id]
+		if !ok {
+			var err error
+			if product, err = repo.GetVersionedProduct(ctx, update.Id); err != nil {
+				slog.WarnContext(ctx, "Error getting product from state store", "productId", update.Id, "error", err)
+				return nil, err
+			}
+			order = append(order, update.Id)
+		}
+
+		if update.PurchaseQty > product.Quantity && !featureEnabled(featureBackorders) {
+			return nil, fmt.Errorf("product with ID %d has %d units, %d requested: %w", update.Id, product.Quantity, update.PurchaseQty, errInsufficientStock)
 		}
-		log.Printf("Saved product with ID %d to state store successfully", update.Id)
+		product.Quantity -= update.PurchaseQty
+		products[update.Id] = product
 	}
 
-	log.Println("Stock update process completed successfully")
-	c.JSON(http.StatusOK, gin.H{"message": "Stock updated successfully!"})
+	changed := make([]versionedProduct, len(order))
+	for i, id := range order {
+		changed[i] = products[id]
+	}
+	if err := repo.SaveProducts(ctx, changed); err != nil {
+		slog.ErrorContext(ctx, "Error saving products to state store", "products", len(changed), "error", err)
+		return nil, err
+	}
+
+	updated := make([]Product, len(changed))
+	for i, product := range changed {
+		slog.DebugContext(ctx, "Applied stock update", "productId", product.Id, "quantity", product.Quantity)
+		stockWatchers.publish(ctx, product.Product)
+		updated[i] = product.Product
+	}
+	return updated, nil
 }
 
 // This function will extract the product ID from the URL, validate it, and retrieve the corresponding product details from the state store.
-func getProductByID(c *gin.Context, client dapr.Client) {
+func getProductByID(c *gin.Context, repo ProductRepository) {
 	// Extracting product ID from the path parameter
 	productIDStr := c.Param("productid")
 	productID, err := strconv.Atoi(productIDStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+		abortWithError(c, newBadRequestError("Invalid product ID %q", productIDStr))
 		return
 	}
 
 	// Fetching product details from the state store
-	var product Product
-	err = getFromStateStore(client, productID, &product)
+	product, err := repo.GetProduct(c.Request.Context(), productID)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		}
+		abortWithError(c, err)
 		return
 	}
 
 	// Responding with the product details
-	c.JSON(http.StatusOK, product)
+	respond(c, http.StatusOK, product, "")
 }
 
 // getProductIDs retrieves the list of product IDs from the state store
-func getProductIDs(client dapr.Client) ([]int, error) {
-	log.Println("Retrieving product IDs from state store")
+func getProductIDs(ctx context.Context, client dapr.Client) ([]int, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slog.DebugContext(ctx, "Retrieving product IDs from state store", "tenant", tenant)
 
-	item, err := client.GetState(context.Background(), stateStoreName, "productIDs", nil)
+	item, err := client.GetState(ctx, config().StateStoreName, productIDsKey(tenant), nil)
 	if err != nil {
-		log.Printf("Failed to get product IDs: %v", err)
+		slog.WarnContext(ctx, "Failed to get product IDs", "error", err)
 		return nil, err
 	}
 
 	if item.Value == nil {
-		log.Println("No product IDs found in state store")
+		slog.DebugContext(ctx, "No product IDs found in state store")
 		return make([]int, 0), nil // Returns an empty slice instead of nil
 	}
 
 	var productIDs []int
 	err = json.Unmarshal(item.Value, &productIDs)
 	if err != nil {
-		log.Printf("Failed to decode product IDs: %v", err)
+		slog.ErrorContext(ctx, "Failed to decode product IDs", "error", err)
 		return nil, err
 	}
 
 	return productIDs, nil
 }
 
-// getFromStateStore retrieves a single product from the state store
-func getFromStateStore(client dapr.Client, id int, product *Product) error {
-	log.Printf("Retrieving product ID %d from state store", id)
+// getFromStateStore retrieves a single product from the state store and returns its ETag
+func getFromStateStore(ctx context.Context, client dapr.Client, id int, product *Product) (string, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return "", err
+	}
+	slog.DebugContext(ctx, "Retrieving product from state store", "tenant", tenant, "productId", id)
 
-	item, err := client.GetState(context.Background(), stateStoreName, "product-"+strconv.Itoa(id), nil)
+	item, err := client.GetState(ctx, config().StateStoreName, productKey(tenant, id), nil)
 	if err != nil {
-		log.Printf("Failed to get product with ID %d: %v", id, err)
-		return err
+		slog.WarnContext(ctx, "Failed to get product", "productId", id, "error", err)
+		return "", err
 	}
 
 	if item.Value == nil {
-		log.Printf("State store returned nil for product ID %d", id)
-		return fmt.Errorf("product with ID %d not found", id)
+		slog.DebugContext(ctx, "Product not found in state store", "productId", id)
+		return "", fmt.Errorf("product with ID %d %w", id, errProductNotFound)
 	}
 
-	// First, try to unmarshal directly without Base64 decoding
-	err = json.Unmarshal(item.Value, product)
-	if err == nil {
-		log.Printf("Successfully retrieved and unmarshalled product ID %d directly: %+v", id, product)
-		return nil // Successfully unmarshalled without Base64 decoding
+	if err := decodeProductRecord(item.Value, product); err != nil {
+		slog.ErrorContext(ctx, "Failed to decode product", "productId", id, "error", err)
+		return "", fmt.Errorf("product with ID %d %w: %w", id, errUnreadableProduct, err)
 	}
 
-	// If direct unmarshal fails, try Base64 decoding
-	trimmedRespBody := strings.Trim(string(item.Value), "\"")
-	decodedBytes, err := base64.StdEncoding.DecodeString(trimmedRespBody)
+	return item.Etag, nil
+}
+
+// saveToStateStore saves a product to the state store using Dapr's state store API
+func saveToStateStore(ctx context.Context, client dapr.Client, id int, product Product) error {
+	tenant, err := requireTenant(ctx)
 	if err != nil {
-		log.Printf("Failed to decode base64 string for product ID %d: %v", id, err)
-		return err // Failed to decode Base64
+		return err
+	}
+	slog.DebugContext(ctx, "Saving product to state store", "tenant", tenant, "productId", id)
+	productRecord, err := encodeProductRecord(product)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal product", "productId", id, "error", err)
+		return err
 	}
 
-	// Try to unmarshal decoded JSON into Product struct
-	err = json.Unmarshal(decodedBytes, product)
+	// Provide an empty map for metadata and omit state options
+	err = client.SaveState(ctx, config().StateStoreName, productKey(tenant, id), productRecord, map[string]string{})
 	if err != nil {
-		log.Printf("Failed to unmarshal JSON for product ID %d after Base64 decoding: %v", id, err)
-		return fmt.Errorf("failed to unmarshal JSON into product with ID %d after Base64 decoding: %v", id, err)
+		slog.WarnContext(ctx, "Failed to save product", "productId", id, "error", err)
+		return err
 	}
 
-	log.Printf("Successfully retrieved and unmarshalled product ID %d after Base64 decoding: %+v", id, product)
+	slog.DebugContext(ctx, "Product saved", "productId", id)
 	return nil
 }
 
-// saveToStateStore saves a product to the state store using Dapr's state store API
-func saveToStateStore(client dapr.Client, id int, product Product) error {
-	log.Printf("Saving product ID %d to state store", id)
-	productJSON, err := json.Marshal(product)
+// saveProductsToStateStore saves products in one state transaction. Each write is guarded by
+// the ETag the product was read with, products without one must not exist yet.
+func saveProductsToStateStore(ctx context.Context, client dapr.Client, products []versionedProduct) error {
+	tenant, err := requireTenant(ctx)
 	if err != nil {
-		log.Printf("Failed to marshal product: %v", err)
 		return err
 	}
+	slog.DebugContext(ctx, "Saving products to state store", "tenant", tenant, "count", len(products))
 
-	// Using a consistent key format for products
-	key := "product-" + strconv.Itoa(id)
+	ops := make([]*dapr.StateOperation, 0, len(products))
+	for _, product := range products {
+		productRecord, err := encodeProductRecord(product.Product)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to marshal product", "productId", product.Id, "error", err)
+			return err
+		}
+		item := &dapr.SetStateItem{Key: productKey(tenant, product.Id), Value: productRecord}
+		if product.ETag != "" {
+			item.Etag = &dapr.ETag{Value: product.ETag}
+		} else {
+			item.Options = &dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite}
+		}
+		ops = append(ops, &dapr.StateOperation{Type: dapr.StateOperationTypeUpsert, Item: item})
+	}
 
-	// Provide an empty map for metadata and omit state options
-	err = client.SaveState(context.Background(), stateStoreName, key, productJSON, map[string]string{})
+	err = client.ExecuteStateTransaction(ctx, config().StateStoreName, map[string]string{}, ops)
+	if status.Code(err) == codes.Aborted {
+		slog.InfoContext(ctx, "Products changed since they were read", "count", len(products), "error", err)
+		return fmt.Errorf("one of %d products %w: %w", len(products), errProductChanged, err)
+	}
 	if err != nil {
-		log.Printf("Failed to save product ID %d: %v", id, err)
+		slog.WarnContext(ctx, "Failed to save products", "count", len(products), "error", err)
 		return err
 	}
 
-	log.Printf("Product ID %d saved successfully", id)
+	slog.DebugContext(ctx, "Products saved", "count", len(products))
 	return nil
 }
 
-func initializeSampleProducts(client dapr.Client) error {
-	log.Println("Starting to initialize sample products")
-
-	initialProducts := []Product{
-		{Id: 1, Name: "Ultra HD Smart TV", Category: "Electronics", Price: 799.99, Description: "65\" 4K Ultra HD screen, Smart TV with streaming capabilities.", ImageUrl: "https://loremflickr.com/320/240/Ultra+HD+Smart+TV", Quantity: 10, Tags: []string{"tv", "smart", "4k"}},
-		{Id: 2, Name: "Professional DSLR Camera", Category: "Photography", Price: 1200.99, Description: "24.1 MP DSLR camera with 4K video recording and dual pixel CMOS AF.", ImageUrl: "https://loremflickr.com/320/240/DSLR+Camera", Quantity: 8, Tags: []string{"camera", "dslr", "photography"}},
-		{Id: 3, Name: "Wireless Bluetooth Headphones", Category: "Audio", Price: 199.99, Description: "Noise-cancelling over-ear headphones with 20 hours of battery life.", ImageUrl: "https://loremflickr.com/320/240/Bluetooth+Headphones", Quantity: 15, Tags: []string{"headphones", "audio", "bluetooth"}},
-		{Id: 4, Name: "Smartphone 12 Pro", Category: "Electronics", Price: 999.99, Description: "6.1-inch Super Retina XDR display, A14 Bionic chip, 5G capable.", ImageUrl: "https://loremflickr.com/320/240/Smartphone+12+Pro", Quantity: 20, Tags: []string{"smartphone", "electronics", "mobile"}},
-		{Id: 5, Name: "Portable External Hard Drive", Category: "Computing", Price: 89.99, Description: "1TB external hard drive with USB 3.0 connectivity and durable design.", ImageUrl: "https://loremflickr.com/320/240/External+Hard+Drive", Quantity: 25, Tags: []string{"hard drive", "storage", "computing"}},
-		{Id: 6, Name: "Gaming Laptop", Category: "Computing", Price: 1499.99, Description: "High-performance laptop with 16GB RAM, 1TB SSD, and dedicated graphics card.", ImageUrl: "https://loremflickr.com/320/240/Gaming+Laptop", Quantity: 10, Tags: []string{"laptop", "gaming", "computing"}},
-		{Id: 7, Name: "Wireless Gaming Mouse", Category: "Accessories", Price: 59.99, Description: "Ergonomic design with customizable buttons and adjustable DPI settings.", ImageUrl: "https://loremflickr.com/320/240/Gaming+Mouse", Quantity: 30, Tags: []string{"mouse", "gaming", "accessories"}},
-		{Id: 8, Name: "Smart Watch", Category: "Wearables", Price: 299.99, Description: "Feature-packed smartwatch with fitness tracking, heart rate monitor, and waterproof design.", ImageUrl: "https://loremflickr.com/320/240/Smart+Watch", Quantity: 15, Tags: []string{"smartwatch", "wearables", "fitness"}},
-		{Id: 9, Name: "Action Camera", Category: "Photography", Price: 349.99, Description: "4K action camera with image stabilization, waterproof casing, and wide-angle lens.", ImageUrl: "https://loremflickr.com/320/240/Action+Camera", Quantity: 12, Tags: []string{"camera", "action", "photography"}},
-		{Id: 10, Name: "Tablet Device", Category: "Electronics", Price: 499.99, Description: "10.5-inch display tablet with stylus support and powerful processing capabilities.", ImageUrl: "https://loremflickr.com/320/240/Tablet+Device", Quantity: 18, Tags: []string{"tablet", "electronics", "mobile"}},
-		{Id: 11, Name: "Wireless Earbuds", Category: "Audio", Price: 129.99, Description: "Compact and lightweight earbuds with crystal-clear sound quality and a charging case.", ImageUrl: "https://loremflickr.com/320/240/Wireless+Earbuds", Quantity: 20, Tags: []string{"earbuds", "audio", "wireless"}},
-		{Id: 12, Name: "Fitness Tracker", Category: "Wearables", Price: 99.99, Description: "Advanced fitness tracker with sleep monitoring, step counting, and calorie tracking.", ImageUrl: "https://loremflickr.com/320/240/Fitness+Tracker", Quantity: 25, Tags: []string{"fitness", "tracker", "wearables"}},
-		{Id: 13, Name: "Electric Toothbrush", Category: "Personal Care", Price: 79.99, Description: "Rechargeable electric toothbrush with multiple brushing modes and pressure sensor.", ImageUrl: "https://loremflickr.com/320/240/Electric+Toothbrush", Quantity: 30, Tags: []string{"toothbrush", "personal care", "dental"}},
-		{Id: 14, Name: "Espresso Machine", Category: "Home Appliances", Price: 249.99, Description: "Automatic espresso machine with customizable settings and milk frother.", ImageUrl: "https://loremflickr.com/320/240/Espresso+Machine", Quantity: 10, Tags: []string{"espresso", "coffee", "kitchen"}},
-		{Id: 15, Name: "Robot Vacuum", Category: "Home Appliances", Price: 399.99, Description: "Smart robot vacuum cleaner with app control and powerful suction.", ImageUrl: "https://loremflickr.com/320/240/Robot+Vacuum", Quantity: 12, Tags: []string{"vacuum", "robot", "cleaning"}},
-		{Id: 16, Name: "Bluetooth Speaker", Category: "Audio", Price: 119.99, Description: "Portable Bluetooth speaker with long battery life and waterproof design.", ImageUrl: "https://loremflickr.com/320/240/Bluetooth+Speaker", Quantity: 20, Tags: []string{"speaker", "audio", "bluetooth"}},
-		{Id: 17, Name: "4K Streaming Device", Category: "Electronics", Price: 49.99, Description: "Stream your favorite content in 4K resolution with voice control and HDR support.", ImageUrl: "https://loremflickr.com/320/240/4K+Streaming+Device", Quantity: 25, Tags: []string{"streaming", "4k", "electronics"}},
-		{Id: 18, Name: "Mechanical Keyboard", Category: "Accessories", Price: 109.99, Description: "Mechanical gaming keyboard with customizable RGB lighting and tactile switches.", ImageUrl: "https://loremflickr.com/320/240/Mechanical+Keyboard", Quantity: 15, Tags: []string{"keyboard", "gaming", "mechanical"}},
-		{Id: 19, Name: "Smart Home Hub", Category: "Smart Home", Price: 129.99, Description: "Centralized control for your smart home devices with voice command support.", ImageUrl: "https://loremflickr.com/320/240/Smart+Home+Hub", Quantity: 12, Tags: []string{"home", "smart", "hub"}},
-		{Id: 20, Name: "High-Performance Blender", Category: "Kitchen Appliances", Price: 199.99, Description: "Multi-speed blender with large capacity, perfect for smoothies and soups.", ImageUrl: "https://loremflickr.com/320/240/Blender", Quantity: 15, Tags: []string{"blender", "kitchen", "appliances"}},
-		{Id: 21, Name: "Wireless Charger Pad", Category: "Accessories", Price: 39.99, Description: "Fast charging wireless pad for smartphones and earbuds.", ImageUrl: "https://loremflickr.com/320/240/Wireless+Charger", Quantity: 30, Tags: []string{"charger", "wireless", "accessories"}},
-		{Id: 22, Name: "Smart Home Security Camera", Category: "Smart Home", Price: 149.99, Description: "1080p HD security camera with night vision and motion detection.", ImageUrl: "https://loremflickr.com/320/240/Security+Camera", Quantity: 20, Tags: []string{"security", "camera", "smart home"}},
-		{Id: 23, Name: "Virtual Reality Headset", Category: "Gaming", Price: 399.99, Description: "Immersive VR headset with high-resolution display and built-in audio.", ImageUrl: "https://loremflickr.com/320/240/VR+Headset", Quantity: 15, Tags: []string{"vr", "gaming", "headset"}},
-		{Id: 24, Name: "Fitness Yoga Mat", Category: "Fitness", Price: 29.99, Description: "Non-slip yoga mat with cushioning for yoga and workout routines.", ImageUrl: "https://loremflickr.com/320/240/Yoga+Mat", Quantity: 40, Tags: []string{"fitness", "yoga", "mat"}},
-		{Id: 25, Name: "Electric Kettle", Category: "Kitchen Appliances", Price: 59.99, Description: "Stainless steel electric kettle with auto shut-off and boil-dry protection.", ImageUrl: "https://loremflickr.com/320/240/Electric+Kettle", Quantity: 25, Tags: []string{"kettle", "kitchen", "appliances"}},
-		{Id: 26, Name: "Gaming Console", Category: "Gaming", Price: 499.99, Description: "Next-gen gaming console with 4K resolution and high-speed SSD.", ImageUrl: "https://loremflickr.com/320/240/Gaming+Console", Quantity: 20, Tags: []string{"console", "gaming", "entertainment"}},
-		{Id: 27, Name: "LED Desk Lamp", Category: "Home Office", Price: 44.99, Description: "Adjustable LED desk lamp with touch control and USB charging port.", ImageUrl: "https://loremflickr.com/320/240/Desk+Lamp", Quantity: 35, Tags: []string{"lamp", "office", "lighting"}},
-		{Id: 28, Name: "Portable Projector", Category: "Electronics", Price: 299.99, Description: "Compact projector with HD resolution, built-in speakers, and HDMI connectivity.", ImageUrl: "https://loremflickr.com/320/240/Portable+Projector", Quantity: 18, Tags: []string{"projector", "portable", "electronics"}},
-		{Id: 29, Name: "Smart Thermostat", Category: "Smart Home", Price: 199.99, Description: "Wi-Fi enabled smart thermostat with voice control and energy-saving features.", ImageUrl: "https://loremflickr.com/320/240/Smart+Thermostat", Quantity: 20, Tags: []string{"thermostat", "smart home", "energy"}},
-		{Id: 30, Name: "Noise Cancelling Earphones", Category: "Audio", Price: 159.99, Description: "High-quality earphones with active noise cancellation and ambient mode.", ImageUrl: "https://loremflickr.com/320/240/Noise+Cancelling+Earphones", Quantity: 25, Tags: []string{"earphones", "audio", "noise cancelling"}},
-		{Id: 31, Name: "Wireless Mouse", Category: "Computing", Price: 49.99, Description: "Ergonomic wireless mouse with customizable buttons and long battery life.", ImageUrl: "https://loremflickr.com/320/240/Wireless+Mouse", Quantity: 30, Tags: []string{"mouse", "wireless", "computing"}},
-		{Id: 32, Name: "Smart Doorbell", Category: "Smart Home", Price: 179.99, Description: "Wi-Fi smart doorbell with HD video, two-way audio, and motion detection.", ImageUrl: "https://loremflickr.com/320/240/Smart+Doorbell", Quantity: 22, Tags: []string{"doorbell", "smart home", "security"}},
-		{Id: 33, Name: "Compact Refrigerator", Category: "Home Appliances", Price: 189.99, Description: "Energy-efficient compact refrigerator with freezer compartment.", ImageUrl: "https://loremflickr.com/320/240/Compact+Refrigerator", Quantity: 15, Tags: []string{"refrigerator", "appliances", "compact"}},
-		{Id: 34, Name: "Digital Camera", Category: "Photography", Price: 549.99, Description: "Versatile digital camera with high-resolution sensor and versatile zoom lens.", ImageUrl: "https://loremflickr.com/320/240/Digital+Camera", Quantity: 12, Tags: []string{"camera", "digital", "photography"}},
-		{Id: 35, Name: "Wireless Keyboard", Category: "Computing", Price: 69.99, Description: "Slim wireless keyboard with comfortable keys and long battery life.", ImageUrl: "https://loremflickr.com/320/240/Wireless+Keyboard", Quantity: 25, Tags: []string{"keyboard", "wireless", "computing"}},
-		{Id: 36, Name: "Air Purifier", Category: "Home Appliances", Price: 129.99, Description: "HEPA air purifier with real-time air quality monitoring and quiet operation.", ImageUrl: "https://loremflickr.com/320/240/Air+Purifier", Quantity: 20, Tags: []string{"air purifier", "home", "health"}},
-		{Id: 37, Name: "Digital Photo Frame", Category: "Home Decor", Price: 89.99, Description: "High-resolution digital photo frame with Wi-Fi connectivity and cloud storage.", ImageUrl: "https://loremflickr.com/320/240/Digital+Photo+Frame", Quantity: 30, Tags: []string{"photo frame", "digital", "decor"}},
-		{Id: 38, Name: "Smart Scale", Category: "Fitness", Price: 59.99, Description: "Bluetooth enabled smart scale with body composition analysis.", ImageUrl: "https://loremflickr.com/320/240/Smart+Scale", Quantity: 25, Tags: []string{"scale", "fitness", "smart"}},
-		{Id: 39, Name: "Gaming Chair", Category: "Gaming", Price: 249.99, Description: "Ergonomic gaming chair with adjustable armrests and lumbar support.", ImageUrl: "https://loremflickr.com/320/240/Gaming+Chair", Quantity: 15, Tags: []string{"chair", "gaming", "comfort"}},
-		{Id: 40, Name: "Streaming Webcam", Category: "Computing", Price: 99.99, Description: "High-definition webcam with autofocus and built-in microphone for streaming.", ImageUrl: "https://loremflickr.com/320/240/Webcam", Quantity: 20, Tags: []string{"webcam", "streaming", "computing"}},
-	}
-
-	// Debug: Fetch product IDs and log them
-	existingIDs, err := getProductIDs(client)
-	if err != nil {
-		log.Printf("Error retrieving product IDs: %v", err)
-		return err
-	}
-	log.Printf("Retrieved product IDs: %v", existingIDs)
+// productIDsUpdateAttempts bounds how often adding to the product ID index is retried when
+// another replica changed it in between
+const productIDsUpdateAttempts = 5
 
-	// Check if products are already initialized
-	if len(existingIDs) != 0 {
-		log.Println("Products already initialized in state store.")
-		return nil
+// addProductID adds id to the product ID index of the tenant ctx is scoped to, writing the index
+// back with the ETag it was read at so writers on other replicas do not drop each other's IDs.
+// It reports whether the ID was added.
+func addProductID(ctx context.Context, client dapr.Client, id int) (bool, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return false, err
 	}
+	key := productIDsKey(tenant)
 
-	log.Println("Adding initial products to state store...")
-	var productIDs []int
-	for _, product := range initialProducts {
-		err := saveToStateStore(client, product.Id, product)
+	for attempt := 1; ; attempt++ {
+		item, err := client.GetState(ctx, config().StateStoreName, key, nil)
 		if err != nil {
-			log.Printf("Error saving product ID %d: %v", product.Id, err)
-			continue
+			return false, fmt.Errorf("failed to read product IDs: %w", err)
 		}
-		productIDs = append(productIDs, product.Id)
-		log.Printf("Initialized product ID %d", product.Id)
-	}
-
-	// Save the index of product IDs
-	if len(productIDs) > 0 {
-		err := saveProductIDs(client, productIDs)
-		if err != nil {
-			log.Printf("Error saving product IDs: %v", err)
-			return err
+		var productIDs []int
+		if item.Value != nil {
+			if err := json.Unmarshal(item.Value, &productIDs); err != nil {
+				return false, fmt.Errorf("failed to decode product IDs: %v", err)
+			}
+		}
+		if slices.Contains(productIDs, id) {
+			return false, nil
 		}
-	}
 
-	// Debug: Test Dapr functionality by retrieving a known product ID
-	// Example: Retrieve the first product if it exists
-	if len(productIDs) > 0 {
-		var product Product
-		err := getFromStateStore(client, productIDs[0], &product)
+		data, err := json.Marshal(append(productIDs, id))
 		if err != nil {
-			log.Printf("Error retrieving product with ID %d: %v", productIDs[0], err)
-		} else {
-			log.Printf("Successfully retrieved product with ID %d: %+v", productIDs[0], product)
+			return false, err
+		}
+		// First-write concurrency also rejects creating the index another replica just created
+		err = client.SaveStateWithETag(ctx, config().StateStoreName, key, data, item.Etag, map[string]string{},
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if err == nil {
+			return true, nil
+		}
+		if status.Code(err) != codes.Aborted || attempt == productIDsUpdateAttempts {
+			return false, fmt.Errorf("failed to add product %d to the product IDs: %w", id, err)
 		}
+		slog.DebugContext(ctx, "Product IDs changed while adding, retrying", "productId", id, "attempt", attempt)
 	}
-
-	log.Println("Completed initializing sample products.")
-	return nil
 }
 
-func saveProductIDs(client dapr.Client, productIDs []int) error {
-	log.Println("Saving product IDs to state store")
+func saveProductIDs(ctx context.Context, client dapr.Client, productIDs []int) error {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Saving product IDs to state store", "tenant", tenant, "count", len(productIDs))
 
 	productIDsJSON, err := json.Marshal(productIDs)
 	if err != nil {
-		log.Printf("Failed to marshal product IDs: %v", err)
+		slog.ErrorContext(ctx, "Failed to marshal product IDs", "error", err)
 		return err
 	}
 
-	err = client.SaveState(context.Background(), stateStoreName, "productIDs", productIDsJSON, map[string]string{})
+	err = client.SaveState(ctx, config().StateStoreName, productIDsKey(tenant), productIDsJSON, map[string]string{})
 	if err != nil {
-		log.Printf("Failed to save product IDs: %v", err)
+		slog.WarnContext(ctx, "Failed to save product IDs", "error", err)
 		return err
 	}
 
-	log.Println("Product IDs saved successfully")
+	slog.DebugContext(ctx, "Product IDs saved")
 	return nil
 }
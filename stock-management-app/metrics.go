@@ -0,0 +1,266 @@
+// stock-management-app/metrics.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Sources and outcomes of stock updates
+const (
+	stockUpdateSourceHTTP  = "http"
+	stockUpdateSourceEvent = "event"
+	stockUpdateSourceBulk  = "bulk"
+	stockUpdateSourceGRPC  = "grpc"
+
+	stockUpdateProcessed = "processed"
+	stockUpdateFailed    = "failed"
+	stockUpdateRetried   = "retried"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method, route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	daprCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dapr_call_duration_seconds",
+		Help:    "Latency of state and pubsub calls to the Dapr sidecar by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	daprCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dapr_call_errors_total",
+		Help: "Failed state and pubsub calls to the Dapr sidecar by operation and reason.",
+	}, []string{"operation", "reason"})
+
+	concurrencyConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "state_concurrency_conflicts_total",
+		Help: "State writes rejected because of an ETag mismatch or an existing first-write key.",
+	}, []string{"operation"})
+
+	stockUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stock_updates_total",
+		Help: "Stock update requests and events by source and result (processed, failed or retried).",
+	}, []string{"source", "result"})
+
+	auditWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "audit_write_failures_total",
+		Help: "Changes that were made but could not be recorded in the audit trail.",
+	})
+
+	productsTracked = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stock_products",
+		Help: "Products in the catalog by tenant.",
+	}, []string{"tenant"})
+
+	productsOutOfStock = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stock_products_out_of_stock",
+		Help: "Products with no units on hand by tenant.",
+	}, []string{"tenant"})
+
+	unitsOnHand = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "stock_units_on_hand",
+		Help: "Total units on hand across all products by tenant.",
+	}, []string{"tenant"})
+
+	// inventory keeps the business gauges in step with product writes
+	inventory = newInventoryMetrics()
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal, httpRequestDuration,
+		daprCallDuration, daprCallErrors, concurrencyConflicts,
+		stockUpdatesTotal, auditWriteFailures, productsTracked, productsOutOfStock, unitsOnHand,
+	)
+}
+
+// serveMetrics exposes the registry in the Prometheus text format
+func serveMetrics() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// metricsMiddleware records the latency and status of every request but the operational
+// endpoints. Unmatched paths share one route label to keep the label set bounded.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isOperationalPath(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		code := strconv.Itoa(c.Writer.Status())
+		httpRequestsTotal.WithLabelValues(c.Request.Method, route, code).Inc()
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, code).Observe(time.Since(start).Seconds())
+	}
+}
+
+// isOperationalPath reports whether a path is one of the probe or metrics endpoints
+func isOperationalPath(path string) bool {
+	return path == "/healthz" || path == "/ready" || path == "/metrics"
+}
+
+// observeDaprCall records the latency of a sidecar call and why it failed, if it did
+func observeDaprCall(operation string, elapsed time.Duration, err error) {
+	daprCallDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+	if err == nil {
+		return
+	}
+
+	reason := "error"
+	switch {
+	case errors.Is(err, context.Canceled):
+		reason = "cancelled"
+	case errors.Is(err, errStateStoreUnavailable):
+		reason = "unavailable"
+	case status.Code(err) == codes.Aborted:
+		reason = "conflict"
+		concurrencyConflicts.WithLabelValues(operation).Inc()
+	}
+	daprCallErrors.WithLabelValues(operation, reason).Inc()
+}
+
+// countStockUpdate records the outcome of one stock update request or event
+func countStockUpdate(source, result string) {
+	stockUpdatesTotal.WithLabelValues(source, result).Inc()
+}
+
+// stockUpdateResult is the outcome of applying a stock update that failed with err. Only
+// event deliveries are redelivered, and never when retrying cannot succeed.
+func stockUpdateResult(err error, redelivered bool) string {
+	switch {
+	case err == nil:
+		return stockUpdateProcessed
+	case redelivered && !isPermanentStockUpdateError(err):
+		return stockUpdateRetried
+	default:
+		return stockUpdateFailed
+	}
+}
+
+// inventoryMetrics tracks the stock level of every product of every tenant, so the business
+// gauges follow writes without reading the catalogs on each scrape
+type inventoryMetrics struct {
+	mu      sync.Mutex
+	tenants map[string]*tenantInventory
+}
+
+// tenantInventory is the stock of one tenant's catalog
+type tenantInventory struct {
+	quantities map[int]int
+	outOfStock int
+	units      int
+}
+
+func newInventoryMetrics() *inventoryMetrics {
+	return &inventoryMetrics{tenants: make(map[string]*tenantInventory)}
+}
+
+// observe records the stock level of a product that was just written
+func (m *inventoryMetrics) observe(tenant string, product Product) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.tenants[tenant]
+	if !ok {
+		inv = &tenantInventory{quantities: make(map[int]int)}
+		m.tenants[tenant] = inv
+	}
+	if quantity, ok := inv.quantities[product.Id]; ok {
+		inv.remove(quantity)
+	}
+	inv.quantities[product.Id] = product.Quantity
+	inv.add(product.Quantity)
+	inv.publish(tenant)
+}
+
+// reset replaces every stock level of a tenant with the products read from the state store
+func (m *inventoryMetrics) reset(tenant string, products []Product) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv := &tenantInventory{quantities: make(map[int]int, len(products))}
+	for _, product := range products {
+		inv.quantities[product.Id] = product.Quantity
+		inv.add(product.Quantity)
+	}
+	m.tenants[tenant] = inv
+	inv.publish(tenant)
+}
+
+func (inv *tenantInventory) add(quantity int) {
+	if quantity <= 0 {
+		inv.outOfStock++
+		return
+	}
+	inv.units += quantity
+}
+
+func (inv *tenantInventory) remove(quantity int) {
+	if quantity <= 0 {
+		inv.outOfStock--
+		return
+	}
+	inv.units -= quantity
+}
+
+func (inv *tenantInventory) publish(tenant string) {
+	productsTracked.WithLabelValues(tenant).Set(float64(len(inv.quantities)))
+	productsOutOfStock.WithLabelValues(tenant).Set(float64(inv.outOfStock))
+	unitsOnHand.WithLabelValues(tenant).Set(float64(inv.units))
+}
+
+// resyncInventory rebuilds the inventory gauges of every tenant from the state store now and
+// then every INVENTORY_METRICS_RESYNC_SECONDS until ctx is done
+func resyncInventory(ctx context.Context, repo ProductRepository) {
+	for {
+		for _, tenant := range tenantIDs() {
+			products, err := listProducts(withTenant(ctx, tenant, tenantSourceJob), repo, productFilter{})
+			if err == nil {
+				inventory.reset(tenant, products)
+			} else if ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to resync inventory metrics", "tenant", tenant, "error", err)
+			}
+		}
+
+		if config().InventoryResyncInterval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(config().InventoryResyncInterval):
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// stock-management-app/migrate.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// legacyCatalogJobName is the startup job moving the catalog stored before catalogs were kept
+// per tenant into the default tenant. Renamed when it started scanning for unindexed keys, so
+// deployments that ran the index-only version run it again.
+const legacyCatalogJobName = "move-legacy-catalog-v2"
+
+// migrationReport summarises a storage migration run
+type migrationReport struct {
+	Migrated []int
+	Current  []int
+	Missing  []int
+	Failed   map[int]error
+}
+
+// legacyCatalogReport summarises moving the catalog stored before catalogs were kept per tenant
+type legacyCatalogReport struct {
+	Moved []int
+	// Kept are products the tenant already had, its own version is kept
+	Kept    []int
+	Missing []int
+	Failed  map[int]error
+}
+
+// runMigrateCommand moves the products stored before catalogs were kept per tenant into a
+// tenant, then rewrites every tenant's product keys into the current record format.
+// The server runs the same steps as startup jobs, the command is for dry runs and for legacy
+// product IDs above LEGACY_PRODUCT_SCAN_LIMIT.
+// Usage: main migrate [-dry-run] [-legacy-tenant id] [-scan-limit n]
+func runMigrateCommand(client dapr.Client, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be migrated without writing")
+	legacyTenant := flags.String("legacy-tenant", config().DefaultTenant, "tenant that receives the products stored before catalogs were kept per tenant")
+	scanLimit := flags.Int("scan-limit", config().LegacyProductScanLimit, "highest product ID probed for legacy keys missing from the legacy index")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if *legacyTenant != "" {
+		if _, ok := tenants()[*legacyTenant]; !ok {
+			return fmt.Errorf("tenant %s is not served", *legacyTenant)
+		}
+		moved, err := moveLegacyCatalog(withTenant(ctx, *legacyTenant, tenantSourceJob), client, *scanLimit, *dryRun)
+		if err != nil {
+			return err
+		}
+		slog.Info("Moved legacy catalog", "tenant", *legacyTenant, "dryRun", *dryRun, "moved", len(moved.Moved),
+			"kept", len(moved.Kept), "missing", len(moved.Missing), "failed", len(moved.Failed))
+		for id, err := range moved.Failed {
+			slog.Error("Failed to move product", "productId", id, "error", err)
+		}
+		if len(moved.Failed) > 0 {
+			return fmt.Errorf("%d legacy products could not be moved", len(moved.Failed))
+		}
+	}
+
+	failed := 0
+	for _, tenant := range tenantIDs() {
+		report, err := migrateProductRecords(withTenant(ctx, tenant, tenantSourceJob), client, *dryRun)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Migration finished", "tenant", tenant, "dryRun", *dryRun, "migrated", len(report.Migrated),
+			"current", len(report.Current), "missing", len(report.Missing), "failed", len(report.Failed))
+		for id, err := range report.Failed {
+			slog.Error("Failed to migrate product", "tenant", tenant, "productId", id, "error", err)
+		}
+		failed += len(report.Failed)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d product records could not be migrated", failed)
+	}
+	return nil
+}
+
+// moveLegacyCatalog moves the products stored under product-<id> into the tenant ctx is scoped
+// to, keeping the tenant's own version of products it already indexes. The products listed by
+// the legacy index are moved along with any product-<id> key up to scanLimit, as the legacy
+// POST /product never indexed what it stored. Values are copied as they are,
+// migrateProductRecords converts legacy formats afterwards. The legacy keys are deleted once
+// every product has been moved, so running it again is a no-op.
+func moveLegacyCatalog(ctx context.Context, client dapr.Client, scanLimit int, dryRun bool) (*legacyCatalogReport, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &legacyCatalogReport{Failed: make(map[int]error)}
+
+	index, err := client.GetState(ctx, config().StateStoreName, legacyProductIDsKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the legacy product IDs: %v", err)
+	}
+	var legacyIDs []int
+	if index.Value != nil {
+		if err := json.Unmarshal(index.Value, &legacyIDs); err != nil {
+			return nil, fmt.Errorf("failed to decode the legacy product IDs: %v", err)
+		}
+	}
+	listed := make(map[int]bool, len(legacyIDs))
+	for _, id := range legacyIDs {
+		listed[id] = true
+	}
+	for id := 1; id <= scanLimit; id++ {
+		if !listed[id] {
+			legacyIDs = append(legacyIDs, id)
+		}
+	}
+
+	items, err := getLegacyProducts(ctx, client, legacyIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	productIDs, err := getProductIDs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	indexed := make(map[int]bool, len(productIDs))
+	for _, id := range productIDs {
+		indexed[id] = true
+	}
+
+	var done []int
+	for _, id := range legacyIDs {
+		item := items[id]
+		switch {
+		case item == nil:
+			report.Failed[id] = errors.New("legacy product missing from the bulk read")
+			continue
+		case item.Error != "":
+			report.Failed[id] = fmt.Errorf("failed to read legacy product: %s", item.Error)
+			continue
+		case item.Value == nil:
+			if listed[id] {
+				report.Missing = append(report.Missing, id)
+			}
+			continue
+		case indexed[id]:
+			report.Kept = append(report.Kept, id)
+			done = append(done, id)
+			continue
+		}
+
+		if !dryRun {
+			if err := client.SaveState(ctx, config().StateStoreName, productKey(tenant, id), item.Value, map[string]string{}); err != nil {
+				report.Failed[id] = err
+				continue
+			}
+		}
+		slog.InfoContext(ctx, "Moved legacy product", "tenant", tenant, "productId", id, "indexed", listed[id], "dryRun", dryRun)
+		report.Moved = append(report.Moved, id)
+		done = append(done, id)
+		indexed[id] = true
+		productIDs = append(productIDs, id)
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	if len(report.Moved) > 0 {
+		if err := saveProductIDs(ctx, client, productIDs); err != nil {
+			return nil, err
+		}
+	}
+	if len(report.Failed) > 0 {
+		// Keep the legacy keys so the products that failed are moved on the next run
+		return report, nil
+	}
+	for _, id := range done {
+		if err := client.DeleteState(ctx, config().StateStoreName, legacyProductKey(id), nil); err != nil {
+			slog.WarnContext(ctx, "Failed to delete legacy product", "productId", id, "error", err)
+		}
+	}
+	if index.Value != nil {
+		if err := client.DeleteState(ctx, config().StateStoreName, legacyProductIDsKey, nil); err != nil {
+			return nil, fmt.Errorf("failed to delete the legacy product IDs: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// legacyProductBatchSize is how many legacy keys are read per bulk request
+const legacyProductBatchSize = 100
+
+// getLegacyProducts reads the legacy keys of ids in batches
+func getLegacyProducts(ctx context.Context, client dapr.Client, ids []int) (map[int]*dapr.BulkStateItem, error) {
+	items := make(map[int]*dapr.BulkStateItem, len(ids))
+	for start := 0; start < len(ids); start += legacyProductBatchSize {
+		batch := ids[start:min(start+legacyProductBatchSize, len(ids))]
+		keys := make([]string, len(batch))
+		idsByKey := make(map[string]int, len(batch))
+		for i, id := range batch {
+			keys[i] = legacyProductKey(id)
+			idsByKey[keys[i]] = id
+		}
+
+		found, err := client.GetBulkState(ctx, config().StateStoreName, keys, nil, 10)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read legacy products: %v", err)
+		}
+		for _, item := range found {
+			if id, ok := idsByKey[item.Key]; ok {
+				items[id] = item
+			}
+		}
+	}
+	return items, nil
+}
+
+// productRecordsJobName is the startup job converting the records of a tenant into the
+// current schema version, so it runs once per tenant and version
+func productRecordsJobName(tenant string) string {
+	return "migrate-product-records-v" + strconv.Itoa(productSchemaVersion) + "-" + tenant
+}
+
+// migrateTenantRecords runs migrateProductRecords for the tenant ctx is scoped to, failing when
+// any record could not be converted so the startup job is retried
+func migrateTenantRecords(ctx context.Context, client dapr.Client) error {
+	report, err := migrateProductRecords(ctx, client, false)
+	if err != nil {
+		return err
+	}
+	tenant, _ := tenantFromContext(ctx)
+	slog.InfoContext(ctx, "Migrated product records", "tenant", tenant, "migrated", len(report.Migrated),
+		"current", len(report.Current), "missing", len(report.Missing), "failed", len(report.Failed))
+	for id, err := range report.Failed {
+		slog.ErrorContext(ctx, "Failed to migrate product", "tenant", tenant, "productId", id, "error", err)
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d product records of tenant %s could not be migrated", len(report.Failed), tenant)
+	}
+	return nil
+}
+
+// migrateProductRecords converts the legacy product values of the tenant ctx is scoped to into
+// the versioned record format. Writes are guarded by the ETag read alongside the value so
+// concurrent updates are not lost.
+func migrateProductRecords(ctx context.Context, client dapr.Client, dryRun bool) (*migrationReport, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	productIDs, err := getProductIDs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &migrationReport{Failed: make(map[int]error)}
+	for _, id := range productIDs {
+		item, err := client.GetState(ctx, config().StateStoreName, productKey(tenant, id), nil)
+		if err != nil {
+			report.Failed[id] = err
+			continue
+		}
+
+		if item.Value == nil {
+			report.Missing = append(report.Missing, id)
+			continue
+		}
+
+		var product Product
+		err = decodeProductRecord(item.Value, &product)
+		if err == nil {
+			report.Current = append(report.Current, id)
+			continue
+		}
+		if !errors.Is(err, errLegacyProductRecord) {
+			// Never overwrite records written by a newer or unknown format
+			report.Failed[id] = err
+			continue
+		}
+
+		if err := decodeLegacyProduct(item.Value, &product); err != nil {
+			report.Failed[id] = err
+			continue
+		}
+
+		if !dryRun {
+			record, err := encodeProductRecord(product)
+			if err != nil {
+				report.Failed[id] = err
+				continue
+			}
+			if err := client.SaveStateWithETag(ctx, config().StateStoreName, productKey(tenant, id), record, item.Etag, map[string]string{}); err != nil {
+				report.Failed[id] = err
+				continue
+			}
+		}
+
+		slog.InfoContext(ctx, "Migrated product", "tenant", tenant, "productId", id, "schemaVersion", productSchemaVersion, "dryRun", dryRun)
+		report.Migrated = append(report.Migrated, id)
+	}
+
+	return report, nil
+}
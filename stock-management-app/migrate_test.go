@@ -0,0 +1,99 @@
+// stock-management-app/migrate_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestMoveLegacyCatalogFindsUnindexedProducts(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	store := cfg.StateStoreName
+
+	// Seeded products were indexed, products added through POST /product were not
+	sidecar.SetState(store, legacyProductIDsKey, []byte(`[1,2]`))
+	sidecar.SetState(store, legacyProductKey(1), []byte(`{"id":1,"name":"Mug","category":"kitchen","price":9.5,"quantity":3}`))
+	lamp := base64.StdEncoding.EncodeToString([]byte(`{"id":7,"name":"Lamp","category":"lighting","price":45,"quantity":2}`))
+	sidecar.SetState(store, legacyProductKey(7), []byte(`"`+lamp+`"`))
+
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	report, err := moveLegacyCatalog(ctx, client, 10, false)
+	if err != nil {
+		t.Fatalf("moveLegacyCatalog: %v", err)
+	}
+	if !slices.Equal(report.Moved, []int{1, 7}) || !slices.Equal(report.Missing, []int{2}) || len(report.Failed) > 0 {
+		t.Fatalf("moved %v, missing %v, failed %v, want [1 7], [2] and none", report.Moved, report.Missing, report.Failed)
+	}
+	for _, key := range []string{legacyProductIDsKey, legacyProductKey(1), legacyProductKey(7)} {
+		if _, ok := sidecar.State(store, key); ok {
+			t.Errorf("legacy key %s was kept", key)
+		}
+	}
+
+	if err := migrateTenantRecords(ctx, client); err != nil {
+		t.Fatalf("migrateTenantRecords: %v", err)
+	}
+	repo := newDaprProductRepository(client)
+	productIDs, err := repo.GetProductIDs(ctx)
+	if err != nil || !slices.Equal(productIDs, []int{1, 7}) {
+		t.Fatalf("GetProductIDs = %v, %v, want [1 7]", productIDs, err)
+	}
+	product, err := repo.GetProduct(ctx, 7)
+	if err != nil || product.Name != "Lamp" || product.Quantity != 2 {
+		t.Fatalf("GetProduct(7) = %+v, %v, want the migrated lamp", product, err)
+	}
+}
+
+func TestStartupMigrationRunsOncePerTenant(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	key := productKey(cfg.DefaultTenant, 1)
+	sidecar.SetState(cfg.StateStoreName, productIDsKey(cfg.DefaultTenant), []byte(`[1]`))
+	sidecar.SetState(cfg.StateStoreName, key, []byte(`{"id":1,"name":"Mug","quantity":3}`))
+
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	runs := 0
+	for i := 0; i < 2; i++ {
+		err := runStartupJob(ctx, client, productRecordsJobName(cfg.DefaultTenant), func() error {
+			runs++
+			return migrateTenantRecords(ctx, client)
+		})
+		if err != nil {
+			t.Fatalf("runStartupJob: %v", err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("migration ran %d times, want once", runs)
+	}
+
+	value, _ := sidecar.State(cfg.StateStoreName, key)
+	var record productRecord
+	if err := json.Unmarshal(value, &record); err != nil || record.SchemaVersion != productSchemaVersion {
+		t.Errorf("stored %s, want a version %d record", value, productSchemaVersion)
+	}
+}
+
+func TestUnreadableProductIsNotAStateStoreFailure(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	sidecar.SetState(cfg.StateStoreName, productKey(cfg.DefaultTenant, 1), []byte(`{"id":1,"name":"Mug"}`))
+
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	_, err := newDaprProductRepository(client).GetProduct(ctx, 1)
+	if !errors.Is(err, errUnreadableProduct) || !errors.Is(err, errLegacyProductRecord) {
+		t.Fatalf("GetProduct = %v, want an unreadable legacy record", err)
+	}
+	if errors.Is(err, errStateStore) {
+		t.Errorf("GetProduct = %v, marked as a state store failure", err)
+	}
+	if apiErr := toAPIError(err); apiErr.Status != http.StatusInternalServerError || apiErr.Code != codeUnreadableProduct {
+		t.Errorf("mapped to %d %s, want %d %s", apiErr.Status, apiErr.Code, http.StatusInternalServerError, codeUnreadableProduct)
+	}
+}
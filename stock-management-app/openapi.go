@@ -0,0 +1,341 @@
+// stock-management-app/openapi.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/openapi3gen"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gin-gonic/gin"
+)
+
+// apiBasePath is the prefix of the current API version
+const apiBasePath = "/v1"
+
+func init() {
+	// Dapr delivers pub/sub events as CloudEvents, which are plain JSON documents
+	openapi3filter.RegisterBodyDecoder("application/cloudevents+json", openapi3filter.RegisteredBodyDecoder("application/json"))
+}
+
+// newOpenAPIDocument builds the OpenAPI 3 description of the /v1 API.
+// Component schemas are generated from the Go types and tightened with the rules in validation.go.
+func newOpenAPIDocument() (*openapi3.T, error) {
+	schemas := openapi3.Schemas{}
+	for name, value := range map[string]interface{}{
+		"Product":            Product{},
+		"ProductUpdate":      ProductUpdate{},
+		"StockUpdateRequest": StockUpdateRequest{},
+		"FieldError":         FieldError{},
+		"ProblemDetails":     ProblemDetails{},
+		"ImportJob":          importJob{},
+		"ConfigSetting":      configSetting{},
+		"FeatureFlagState":   FeatureFlagState{},
+		"AuditEntry":         auditEntry{},
+	} {
+		ref, err := openapi3gen.NewSchemaRefForValue(value, schemas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate schema for %s: %v", name, err)
+		}
+		schemas[name] = ref
+	}
+
+	// The generator shares property schemas between fields of the same type, so constrained
+	// properties get schemas of their own
+	tag := openapi3.NewStringSchema().WithMinLength(1).WithMaxLength(int64(config().MaxProductTagLength))
+	tags := openapi3.NewArraySchema().WithItems(tag).WithMaxItems(int64(config().MaxProductTags)).WithNullable()
+
+	product := schemas["Product"].Value
+	product.Required = []string{"id", "name"}
+	product.WithProperty("id", openapi3.NewIntegerSchema().WithMin(1)).
+		WithProperty("name", openapi3.NewStringSchema().WithMinLength(1).WithMaxLength(int64(config().MaxProductNameLength))).
+		WithProperty("price", openapi3.NewFloat64Schema().WithMin(0)).
+		WithProperty("quantity", openapi3.NewIntegerSchema().WithMin(0)).
+		WithProperty("imageUrl", openapi3.NewStringSchema().WithFormat("uri")).
+		WithProperty("tags", tags)
+
+	update := schemas["ProductUpdate"].Value
+	update.Required = []string{"id", "purchaseQty"}
+	update.WithProperty("id", openapi3.NewIntegerSchema().WithMin(1)).
+		WithProperty("purchaseQty", openapi3.NewIntegerSchema().WithMin(1))
+
+	updates := openapi3.NewArraySchema().WithMinItems(1).WithMaxItems(int64(config().MaxStockUpdates))
+	updates.Items = schemaRef("ProductUpdate")
+	stockUpdate := schemas["StockUpdateRequest"].Value
+	stockUpdate.Required = []string{"updates"}
+	stockUpdate.WithProperty("updates", updates)
+
+	doc := &openapi3.T{
+		OpenAPI: "3.0.3",
+		Info: &openapi3.Info{
+			Title:       "Stock management API",
+			Description: "Product catalog and stock levels of the e-commerce app. Errors are returned as RFC 7807 problem details.",
+			Version:     apiVersion,
+		},
+		Servers: openapi3.Servers{{URL: apiBasePath}},
+		Paths:   openapi3.NewPaths(),
+		Components: &openapi3.Components{
+			Schemas: schemas,
+			SecuritySchemes: openapi3.SecuritySchemes{
+				"apiKey":     &openapi3.SecuritySchemeRef{Value: openapi3.NewSecurityScheme().WithType("apiKey").WithIn("header").WithName(apiKeyHeader)},
+				"bearerAuth": &openapi3.SecuritySchemeRef{Value: openapi3.NewJWTSecurityScheme()},
+			},
+		},
+		Security: openapi3.SecurityRequirements{
+			openapi3.NewSecurityRequirement().Authenticate("apiKey"),
+			openapi3.NewSecurityRequirement().Authenticate("bearerAuth"),
+		},
+	}
+
+	filterParams := []*openapi3.Parameter{
+		openapi3.NewQueryParameter("category").WithSchema(openapi3.NewStringSchema()).WithDescription("Only products in this category"),
+		openapi3.NewQueryParameter("tag").WithSchema(openapi3.NewStringSchema()).WithDescription("Only products with this tag"),
+		openapi3.NewQueryParameter("inStock").WithSchema(openapi3.NewBoolSchema()).WithDescription("Only products that are, or are not, in stock"),
+		openapi3.NewQueryParameter("minPrice").WithSchema(openapi3.NewFloat64Schema().WithMin(0)),
+		openapi3.NewQueryParameter("maxPrice").WithSchema(openapi3.NewFloat64Schema().WithMin(0)),
+	}
+
+	op := newOperation("storeProduct", "Create or replace a product", http.StatusOK, schemaRef("Product"))
+	op.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithRequired(true).WithJSONSchemaRef(schemaRef("Product"))}
+	doc.AddOperation("/product", http.MethodPost, op)
+
+	productList := openapi3.NewArraySchema()
+	productList.Items = schemaRef("Product")
+	op = newOperation("listProducts", "List products", http.StatusOK, openapi3.NewSchemaRef("", productList))
+	for _, param := range filterParams {
+		op.AddParameter(param)
+	}
+	doc.AddOperation("/products", http.MethodGet, op)
+
+	op = newOperation("getProduct", "Get a product by ID", http.StatusOK, schemaRef("Product"))
+	op.AddParameter(openapi3.NewPathParameter("productid").WithSchema(openapi3.NewIntegerSchema().WithMin(1)))
+	doc.AddOperation("/product/{productid}", http.MethodGet, op)
+
+	auditList := openapi3.NewArraySchema()
+	auditList.Items = schemaRef("AuditEntry")
+	op = newOperation("getProductHistory", "List the recorded versions of a product, newest first", http.StatusOK, openapi3.NewSchemaRef("", auditList))
+	op.AddParameter(openapi3.NewPathParameter("productid").WithSchema(openapi3.NewIntegerSchema().WithMin(1)))
+	doc.AddOperation("/product/{productid}/history", http.MethodGet, op)
+
+	// CloudEvents are not validated here: updateStock tells Dapr to drop invalid events
+	// instead of rejecting them, which would make Dapr redeliver them forever.
+	op = newOperation("updateStock", "Apply stock updates, called directly or by the stockUpdate subscription", http.StatusOK, nil)
+	op.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithRequired(true).WithContent(openapi3.Content{
+		"application/json":             openapi3.NewMediaType().WithSchemaRef(schemaRef("StockUpdateRequest")),
+		"application/cloudevents+json": openapi3.NewMediaType(),
+	})}
+	doc.AddOperation("/updateStock", http.MethodPost, op)
+
+	op = newOperation("exportProducts", "Stream the catalog as CSV, JSON Lines or a Google Merchant feed", http.StatusOK, nil)
+	op.AddParameter(openapi3.NewQueryParameter("format").WithSchema(openapi3.NewStringSchema().WithEnum(exportFormatCSV, exportFormatJSONL, exportFormatMerchantXML).WithDefault(exportFormatCSV)))
+	op.AddParameter(openapi3.NewQueryParameter("fields").WithSchema(openapi3.NewStringSchema()).WithDescription("Comma separated list of fields, not supported for merchant-xml"))
+	for _, param := range filterParams {
+		op.AddParameter(param)
+	}
+	op.Responses.Set("200", &openapi3.ResponseRef{Value: openapi3.NewResponse().WithDescription("Exported products").WithContent(openapi3.Content{
+		"text/csv":             openapi3.NewMediaType().WithSchema(openapi3.NewStringSchema()),
+		"application/x-ndjson": openapi3.NewMediaType().WithSchema(openapi3.NewStringSchema()),
+		"application/xml":      openapi3.NewMediaType().WithSchema(openapi3.NewStringSchema()),
+	})})
+	doc.AddOperation("/export/products", http.MethodGet, op)
+
+	// Upload schemas are left out on purpose so the middleware does not parse the upload;
+	// startImport reports malformed rows individually.
+	op = newOperation("startImport", "Import products from CSV or JSON Lines in a background job", http.StatusAccepted, schemaRef("ImportJob"))
+	op.AddParameter(openapi3.NewQueryParameter("format").WithSchema(openapi3.NewStringSchema().WithEnum(importFormatCSV, importFormatJSONL)))
+	op.AddParameter(openapi3.NewQueryParameter("mode").WithSchema(openapi3.NewStringSchema().WithEnum(importModeUpsert, importModeCreate).WithDefault(importModeUpsert)))
+	op.AddParameter(openapi3.NewQueryParameter("dryRun").WithSchema(openapi3.NewBoolSchema().WithDefault(false)))
+	op.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithRequired(true).WithContent(openapi3.Content{
+		"text/csv":                openapi3.NewMediaType(),
+		"application/x-ndjson":    openapi3.NewMediaType(),
+		"application/jsonl":       openapi3.NewMediaType(),
+		"application/x-jsonlines": openapi3.NewMediaType(),
+	})}
+	doc.AddOperation("/admin/import", http.MethodPost, op)
+
+	op = newOperation("getImportJob", "Get the progress of an import job", http.StatusOK, schemaRef("ImportJob"))
+	op.AddParameter(openapi3.NewPathParameter("jobId").WithSchema(openapi3.NewStringSchema()))
+	doc.AddOperation("/admin/import/{jobId}", http.MethodGet, op)
+
+	settingList := openapi3.NewArraySchema()
+	settingList.Items = schemaRef("ConfigSetting")
+	op = newOperation("getConfig", "List the settings in effect, with secrets redacted, and where each came from", http.StatusOK, openapi3.NewSchemaRef("", settingList))
+	doc.AddOperation("/admin/config", http.MethodGet, op)
+
+	flagList := openapi3.NewArraySchema()
+	flagList.Items = schemaRef("FeatureFlagState")
+	op = newOperation("getFeatureFlags", "List the feature flags, their current values and where each came from", http.StatusOK, openapi3.NewSchemaRef("", flagList))
+	doc.AddOperation("/admin/features", http.MethodGet, op)
+
+	op = newOperation("listAuditEntries", "List the audit trail of catalog changes and admin actions, newest first", http.StatusOK, openapi3.NewSchemaRef("", auditList))
+	op.AddParameter(openapi3.NewQueryParameter("productId").WithSchema(openapi3.NewIntegerSchema().WithMin(1)))
+	op.AddParameter(openapi3.NewQueryParameter("actor").WithSchema(openapi3.NewStringSchema()).WithDescription("Only changes by this actor, as method:name"))
+	op.AddParameter(openapi3.NewQueryParameter("from").WithSchema(openapi3.NewDateTimeSchema()))
+	op.AddParameter(openapi3.NewQueryParameter("to").WithSchema(openapi3.NewDateTimeSchema()))
+	op.AddParameter(openapi3.NewQueryParameter("limit").WithSchema(openapi3.NewIntegerSchema().WithMin(1).WithMax(maxAuditLimit).WithDefault(defaultAuditLimit)))
+	doc.AddOperation("/admin/audit", http.MethodGet, op)
+
+	tenantParam := openapi3.NewHeaderParameter(tenantHeader).
+		WithSchema(openapi3.NewStringSchema().WithPattern(tenantIDPattern.String())).
+		WithDescription("Tenant whose catalog is used, callers bound to a tenant may only name their own")
+	// Roles are not expressible as security scopes of API keys, so they are described instead
+	for _, item := range doc.Paths.Map() {
+		for _, op := range item.Operations() {
+			op.Description = fmt.Sprintf("Requires the %s role.", operationRoles[op.OperationID])
+			op.AddParameter(tenantParam)
+		}
+	}
+
+	if err := openapi3.NewLoader().ResolveRefsIn(doc, nil); err != nil {
+		return nil, fmt.Errorf("failed to resolve OpenAPI references: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+	return doc, nil
+}
+
+// operationRoles is the role each operation requires, as enforced by registerAPIRoutes
+var operationRoles = map[string]string{
+	"storeProduct":      roleMerchandiser,
+	"listProducts":      roleReader,
+	"getProduct":        roleReader,
+	"getProductHistory": roleMerchandiser,
+	"updateStock":       roleInventory,
+	"exportProducts":    roleReader,
+	"startImport":       roleAdmin,
+	"getImportJob":      roleAdmin,
+	"getConfig":         roleAdmin,
+	"getFeatureFlags":   roleAdmin,
+	"listAuditEntries":  roleAdmin,
+}
+
+// newOperation returns an operation whose success response wraps data in the success envelope
+// and whose other responses are problem details
+func newOperation(id, summary string, status int, data *openapi3.SchemaRef) *openapi3.Operation {
+	envelope := openapi3.NewObjectSchema().
+		WithProperty("apiVersion", openapi3.NewStringSchema()).
+		WithProperty("status", openapi3.NewStringSchema()).
+		WithProperty("message", openapi3.NewStringSchema())
+	if data != nil {
+		envelope.WithPropertyRef("data", data)
+	}
+	envelope.Required = []string{"apiVersion", "status"}
+
+	op := openapi3.NewOperation()
+	op.OperationID = id
+	op.Summary = summary
+	op.Responses = openapi3.NewResponses(
+		openapi3.WithStatus(status, &openapi3.ResponseRef{Value: openapi3.NewResponse().WithDescription(http.StatusText(status)).WithJSONSchema(envelope)}),
+		openapi3.WithName("default", openapi3.NewResponse().WithDescription("Problem details").WithContent(openapi3.Content{
+			"application/problem+json": openapi3.NewMediaType().WithSchemaRef(schemaRef("ProblemDetails")),
+		})),
+	)
+	return op
+}
+
+// schemaRef references a component schema, refs are resolved once the document is complete
+func schemaRef(name string) *openapi3.SchemaRef {
+	return openapi3.NewSchemaRef("#/components/schemas/"+name, nil)
+}
+
+// serveOpenAPIDocument serves the document as-is, outside of the success envelope
+func serveOpenAPIDocument(doc *openapi3.T) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+// openAPIValidationMiddleware rejects requests to documented operations that do not match
+// the document. Requests to paths it does not describe are passed through untouched.
+func openAPIValidationMiddleware(doc *openapi3.T) (gin.HandlerFunc, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) {
+		route, pathParams, err := router.FindRoute(c.Request)
+		if errors.Is(err, routers.ErrPathNotFound) || errors.Is(err, routers.ErrMethodNotAllowed) {
+			c.Next()
+			return
+		}
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    &openapi3filter.Options{MultiError: true, AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			abortWithError(c, requestBodyError(err, openAPIRequestError(err)))
+			return
+		}
+		c.Next()
+	}, nil
+}
+
+// openAPIRequestError maps a request validation failure onto the API's problem details
+func openAPIRequestError(err error) *APIError {
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) && reqErr.RequestBody != nil && strings.HasPrefix(reqErr.Reason, "header Content-Type has unexpected value") {
+		return newUnsupportedMediaTypeError("Unsupported Content-Type %q", reqErr.Input.Request.Header.Get("Content-Type"))
+	}
+
+	errs := ValidationErrors{}
+	collectOpenAPIErrors(err, "body", &errs)
+	return newValidationError(errs)
+}
+
+// collectOpenAPIErrors flattens nested request and schema errors into field errors
+func collectOpenAPIErrors(err error, field string, errs *ValidationErrors) {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		for _, inner := range e {
+			collectOpenAPIErrors(inner, field, errs)
+		}
+	case *openapi3filter.RequestError:
+		if e.Parameter != nil {
+			field = e.Parameter.Name
+		}
+		if e.Err == nil {
+			errs.add(field, "%s", e.Reason)
+			return
+		}
+		collectOpenAPIErrors(e.Err, field, errs)
+	case *openapi3.SchemaError:
+		if pointer := e.JSONPointer(); len(pointer) > 0 && field == "body" {
+			field = jsonPointerField(pointer)
+		}
+		errs.add(field, "%s", e.Reason)
+	default:
+		errs.add(field, "%v", err)
+	}
+}
+
+// jsonPointerField renders a JSON pointer in the field notation of validation.go, e.g. updates[0].id
+func jsonPointerField(pointer []string) string {
+	var field strings.Builder
+	for _, token := range pointer {
+		if token != "" && strings.Trim(token, "0123456789") == "" {
+			field.WriteString("[" + token + "]")
+			continue
+		}
+		if field.Len() > 0 {
+			field.WriteString(".")
+		}
+		field.WriteString(token)
+	}
+	return field.String()
+}
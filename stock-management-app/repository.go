@@ -0,0 +1,269 @@
+// stock-management-app/repository.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+var (
+	// errProductNotFound is wrapped by repositories when a product does not exist
+	errProductNotFound = errors.New("not found")
+
+	// errStateStore is wrapped around failures of the underlying store
+	errStateStore = errors.New("state store failure")
+
+	// errUnreadableProduct is wrapped when a stored product is read but cannot be decoded,
+	// a problem with the data rather than with the store
+	errUnreadableProduct = errors.New("cannot be decoded")
+
+	// errProductChanged is wrapped when SaveProducts finds a product changed since it was read
+	errProductChanged = errors.New("changed since it was read")
+)
+
+// versionedProduct is a product with the version it was read at, SaveProducts only overwrites
+// products still at that version. An empty ETag is a product that did not exist.
+type versionedProduct struct {
+	Product
+	ETag string
+}
+
+// ProductRepository abstracts the storage operations used by the handlers. Every operation
+// works on the catalog of the tenant ctx is scoped to and fails with errNoTenant without one.
+type ProductRepository interface {
+	GetProduct(ctx context.Context, id int) (Product, error)
+	SaveProduct(ctx context.Context, product Product) error
+	// GetVersionedProduct reads a product along with its version, to write it back with SaveProducts
+	GetVersionedProduct(ctx context.Context, id int) (versionedProduct, error)
+	// SaveProducts writes products in one transaction: all of them, or none with errProductChanged
+	// if any changed since it was read
+	SaveProducts(ctx context.Context, products []versionedProduct) error
+	GetProductIDs(ctx context.Context) ([]int, error)
+	SaveProductIDs(ctx context.Context, productIDs []int) error
+	// AddProductID adds an ID to the product ID index unless it is there already, reporting
+	// whether it was added. Concurrent additions from other replicas are kept.
+	AddProductID(ctx context.Context, id int) (bool, error)
+}
+
+// daprProductRepository stores products in a Dapr state store
+type daprProductRepository struct {
+	client dapr.Client
+}
+
+func newDaprProductRepository(client dapr.Client) *daprProductRepository {
+	return &daprProductRepository{client: client}
+}
+
+func (r *daprProductRepository) GetProduct(ctx context.Context, id int) (Product, error) {
+	var product Product
+	_, err := getFromStateStore(ctx, r.client, id, &product)
+	return product, wrapStateStoreError(err)
+}
+
+func (r *daprProductRepository) GetVersionedProduct(ctx context.Context, id int) (versionedProduct, error) {
+	var product versionedProduct
+	etag, err := getFromStateStore(ctx, r.client, id, &product.Product)
+	product.ETag = etag
+	return product, wrapStateStoreError(err)
+}
+
+func (r *daprProductRepository) SaveProduct(ctx context.Context, product Product) error {
+	if err := saveToStateStore(ctx, r.client, product.Id, product); err != nil {
+		return wrapStateStoreError(err)
+	}
+	tenant, _ := tenantFromContext(ctx)
+	inventory.observe(tenant, product)
+	return nil
+}
+
+func (r *daprProductRepository) SaveProducts(ctx context.Context, products []versionedProduct) error {
+	if err := saveProductsToStateStore(ctx, r.client, products); err != nil {
+		return wrapStateStoreError(err)
+	}
+	tenant, _ := tenantFromContext(ctx)
+	for _, product := range products {
+		inventory.observe(tenant, product.Product)
+	}
+	return nil
+}
+
+func (r *daprProductRepository) GetProductIDs(ctx context.Context) ([]int, error) {
+	productIDs, err := getProductIDs(ctx, r.client)
+	return productIDs, wrapStateStoreError(err)
+}
+
+func (r *daprProductRepository) SaveProductIDs(ctx context.Context, productIDs []int) error {
+	return wrapStateStoreError(saveProductIDs(ctx, r.client, productIDs))
+}
+
+func (r *daprProductRepository) AddProductID(ctx context.Context, id int) (bool, error) {
+	added, err := addProductID(ctx, r.client, id)
+	return added, wrapStateStoreError(err)
+}
+
+// wrapStateStoreError marks errors other than a missing, unreadable or changed product or a
+// missing tenant as state store failures
+func wrapStateStoreError(err error) error {
+	if err == nil || errors.Is(err, errProductNotFound) || errors.Is(err, errUnreadableProduct) || errors.Is(err, errProductChanged) || errors.Is(err, errNoTenant) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errStateStore, err)
+}
+
+// memoryProductRepository keeps products in memory, used for tests and local runs without a sidecar
+type memoryProductRepository struct {
+	mu       sync.RWMutex
+	catalogs map[string]*memoryCatalog
+}
+
+// memoryCatalog holds the products of one tenant, with a version per product that each write bumps
+type memoryCatalog struct {
+	products   map[int]Product
+	versions   map[int]int
+	productIDs []int
+}
+
+func newMemoryProductRepository() *memoryProductRepository {
+	return &memoryProductRepository{catalogs: make(map[string]*memoryCatalog)}
+}
+
+// catalog returns the catalog of the tenant ctx is scoped to, creating it when asked to
+func (r *memoryProductRepository) catalog(ctx context.Context, create bool) (*memoryCatalog, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	catalog, ok := r.catalogs[tenant]
+	if !ok {
+		catalog = &memoryCatalog{products: make(map[int]Product), versions: make(map[int]int)}
+		if create {
+			r.catalogs[tenant] = catalog
+		}
+	}
+	return catalog, nil
+}
+
+func (r *memoryProductRepository) GetProduct(ctx context.Context, id int) (Product, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	catalog, err := r.catalog(ctx, false)
+	if err != nil {
+		return Product{}, err
+	}
+	product, ok := catalog.products[id]
+	if !ok {
+		return Product{}, fmt.Errorf("product with ID %d %w", id, errProductNotFound)
+	}
+	return copyProduct(product), nil
+}
+
+func (r *memoryProductRepository) SaveProduct(ctx context.Context, product Product) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	catalog, err := r.catalog(ctx, true)
+	if err != nil {
+		return err
+	}
+	catalog.products[product.Id] = copyProduct(product)
+	catalog.versions[product.Id]++
+	return nil
+}
+
+func (r *memoryProductRepository) GetVersionedProduct(ctx context.Context, id int) (versionedProduct, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	catalog, err := r.catalog(ctx, false)
+	if err != nil {
+		return versionedProduct{}, err
+	}
+	product, ok := catalog.products[id]
+	if !ok {
+		return versionedProduct{}, fmt.Errorf("product with ID %d %w", id, errProductNotFound)
+	}
+	return versionedProduct{Product: copyProduct(product), ETag: strconv.Itoa(catalog.versions[id])}, nil
+}
+
+func (r *memoryProductRepository) SaveProducts(ctx context.Context, products []versionedProduct) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	catalog, err := r.catalog(ctx, true)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		etag := ""
+		if _, ok := catalog.products[product.Id]; ok {
+			etag = strconv.Itoa(catalog.versions[product.Id])
+		}
+		if product.ETag != etag {
+			return fmt.Errorf("product with ID %d %w", product.Id, errProductChanged)
+		}
+	}
+	for _, product := range products {
+		catalog.products[product.Id] = copyProduct(product.Product)
+		catalog.versions[product.Id]++
+	}
+	return nil
+}
+
+func (r *memoryProductRepository) GetProductIDs(ctx context.Context) ([]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	catalog, err := r.catalog(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	productIDs := make([]int, len(catalog.productIDs))
+	copy(productIDs, catalog.productIDs)
+	return productIDs, nil
+}
+
+func (r *memoryProductRepository) SaveProductIDs(ctx context.Context, productIDs []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	catalog, err := r.catalog(ctx, true)
+	if err != nil {
+		return err
+	}
+	catalog.productIDs = make([]int, len(productIDs))
+	copy(catalog.productIDs, productIDs)
+	return nil
+}
+
+func (r *memoryProductRepository) AddProductID(ctx context.Context, id int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	catalog, err := r.catalog(ctx, true)
+	if err != nil {
+		return false, err
+	}
+	if slices.Contains(catalog.productIDs, id) {
+		return false, nil
+	}
+	catalog.productIDs = append(catalog.productIDs, id)
+	return true, nil
+}
+
+// copyProduct returns a copy of the product that does not share its tags slice
+func copyProduct(product Product) Product {
+	if product.Tags != nil {
+		tags := make([]string, len(product.Tags))
+		copy(tags, product.Tags)
+		product.Tags = tags
+	}
+	return product
+}
@@ -0,0 +1,114 @@
+// stock-management-app/repository_test.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+func TestSaveProductsIsAllOrNothing(t *testing.T) {
+	repositories := map[string]func(t *testing.T) ProductRepository{
+		"memory": func(t *testing.T) ProductRepository {
+			return newMemoryProductRepository()
+		},
+		"dapr": func(t *testing.T) ProductRepository {
+			_, client := connectSidecar(t)
+			return newDaprProductRepository(client)
+		},
+	}
+	for name, newRepo := range repositories {
+		t.Run(name, func(t *testing.T) {
+			cfg, _ := useTestConfig(t)
+			repo := newRepo(t)
+			ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+			for _, product := range []Product{{Id: 1, Name: "Mug", Quantity: 10}, {Id: 2, Name: "Lamp", Quantity: 10}} {
+				if err := repo.SaveProduct(ctx, product); err != nil {
+					t.Fatalf("SaveProduct: %v", err)
+				}
+			}
+
+			mug, err := repo.GetVersionedProduct(ctx, 1)
+			if err != nil {
+				t.Fatalf("GetVersionedProduct(1): %v", err)
+			}
+			lamp, err := repo.GetVersionedProduct(ctx, 2)
+			if err != nil {
+				t.Fatalf("GetVersionedProduct(2): %v", err)
+			}
+
+			// The lamp changes after it was read, so neither product may be written
+			if err := repo.SaveProduct(ctx, Product{Id: 2, Name: "Lamp", Quantity: 8}); err != nil {
+				t.Fatalf("SaveProduct: %v", err)
+			}
+			mug.Quantity, lamp.Quantity = 9, 9
+			if err := repo.SaveProducts(ctx, []versionedProduct{mug, lamp}); !errors.Is(err, errProductChanged) {
+				t.Fatalf("SaveProducts = %v, want errProductChanged", err)
+			}
+			for id, want := range map[int]int{1: 10, 2: 8} {
+				if product, _ := repo.GetProduct(ctx, id); product.Quantity != want {
+					t.Errorf("quantity of product %d = %d, want %d", id, product.Quantity, want)
+				}
+			}
+
+			if lamp, err = repo.GetVersionedProduct(ctx, 2); err != nil {
+				t.Fatalf("GetVersionedProduct(2): %v", err)
+			}
+			lamp.Quantity = 7
+			if err := repo.SaveProducts(ctx, []versionedProduct{mug, lamp}); err != nil {
+				t.Fatalf("SaveProducts with current versions: %v", err)
+			}
+			for id, want := range map[int]int{1: 9, 2: 7} {
+				if product, _ := repo.GetProduct(ctx, id); product.Quantity != want {
+					t.Errorf("quantity of product %d = %d, want %d", id, product.Quantity, want)
+				}
+			}
+		})
+	}
+}
+
+// racingClient lets another writer change a key right after it is first read
+type racingClient struct {
+	dapr.Client
+	key   string
+	race  func()
+	raced bool
+}
+
+func (c *racingClient) GetState(ctx context.Context, storeName, key string, meta map[string]string) (*dapr.StateItem, error) {
+	item, err := c.Client.GetState(ctx, storeName, key, meta)
+	if key == c.key && !c.raced {
+		c.raced = true
+		c.race()
+	}
+	return item, err
+}
+
+func TestAddProductIDKeepsConcurrentAdditions(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	key := productIDsKey(cfg.DefaultTenant)
+	sidecar.SetState(cfg.StateStoreName, key, []byte(`[1]`))
+
+	// Another replica adds product 2 between this replica reading and writing the index
+	racing := &racingClient{Client: client, key: key, race: func() {
+		sidecar.SetState(cfg.StateStoreName, key, []byte(`[1,2]`))
+	}}
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	added, err := newDaprProductRepository(racing).AddProductID(ctx, 3)
+	if err != nil || !added {
+		t.Fatalf("AddProductID = %v, %v, want added", added, err)
+	}
+
+	productIDs, err := newDaprProductRepository(client).GetProductIDs(ctx)
+	if err != nil || !slices.Equal(productIDs, []int{1, 2, 3}) {
+		t.Fatalf("product IDs = %v, %v, want [1 2 3]", productIDs, err)
+	}
+	if added, err := newDaprProductRepository(client).AddProductID(ctx, 2); err != nil || added {
+		t.Errorf("adding an indexed ID = %v, %v, want not added", added, err)
+	}
+}
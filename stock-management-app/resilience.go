@@ -0,0 +1,227 @@
+// stock-management-app/resilience.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errStateStoreUnavailable is wrapped when the sidecar cannot be reached in time or the breaker is open
+var errStateStoreUnavailable = errors.New("state store unavailable")
+
+// unavailableError reports a call that did not reach the state store and when to try again
+type unavailableError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%v: %v", errStateStoreUnavailable, e.Err)
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == errStateStoreUnavailable
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.Err
+}
+
+// circuitBreaker fails calls fast while the sidecar keeps failing. After the cool-down one
+// trial call is let through; its outcome closes the breaker or opens it again. The threshold
+// and cool-down are read from the configuration on each call, so reloads apply at once.
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name}
+}
+
+// allow returns an unavailableError while the breaker is open
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cfg := config()
+	if b.failures < cfg.CircuitBreakerFailures {
+		return nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 || b.trial {
+		if wait <= 0 {
+			wait = cfg.CircuitBreakerCoolDown
+		}
+		return &unavailableError{RetryAfter: wait, Err: fmt.Errorf("circuit breaker %s is open", b.name)}
+	}
+	b.trial = true
+	return nil
+}
+
+// record counts the outcome of a call that was allowed through
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cfg := config()
+	b.trial = false
+	if !failed {
+		if b.failures >= cfg.CircuitBreakerFailures {
+			slog.Info("Circuit breaker closed", "breaker", b.name)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= cfg.CircuitBreakerFailures {
+		if b.failures == cfg.CircuitBreakerFailures {
+			slog.Warn("Circuit breaker opened", "breaker", b.name, "failures", b.failures, "coolDown", cfg.CircuitBreakerCoolDown.String())
+		}
+		b.openUntil = time.Now().Add(cfg.CircuitBreakerCoolDown)
+	}
+}
+
+// resilientClient adds per-operation deadlines and a circuit breaker to the state and
+// pubsub calls of a Dapr client. Other calls go straight to the wrapped client.
+type resilientClient struct {
+	dapr.Client
+	breaker *circuitBreaker
+}
+
+func newResilientClient(client dapr.Client) *resilientClient {
+	return &resilientClient{
+		Client:  client,
+		breaker: newCircuitBreaker("dapr"),
+	}
+}
+
+// call runs fn in a span and with metrics named after the operation, under the breaker with
+// the operation's deadline
+func (c *resilientClient) call(ctx context.Context, name string, attrs []attribute.KeyValue, timeout time.Duration, fn func(ctx context.Context) error) (err error) {
+	start := time.Now()
+	ctx, span := startClientSpan(ctx, name, attrs...)
+	defer func() {
+		observeDaprCall(name, time.Since(start), err)
+		endSpan(span, err)
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.breaker.allow(); err != nil {
+		return err
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = fn(opCtx)
+
+	// A caller that went away says nothing about the health of the sidecar
+	if ctx.Err() != nil {
+		c.breaker.record(false)
+		return err
+	}
+	if isUnavailable(opCtx, err) {
+		c.breaker.record(true)
+		return &unavailableError{RetryAfter: config().CircuitBreakerCoolDown, Err: err}
+	}
+	c.breaker.record(false)
+	return err
+}
+
+// isUnavailable reports whether a call failed because the sidecar or the store behind it did
+// not answer, as opposed to rejecting the request (e.g. an ETag mismatch)
+func isUnavailable(ctx context.Context, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+func (c *resilientClient) GetState(ctx context.Context, storeName, key string, meta map[string]string) (item *dapr.StateItem, err error) {
+	err = c.call(ctx, "GetState", stateAttributes(storeName, key), config().StateStoreReadTimeout, func(ctx context.Context) error {
+		item, err = c.Client.GetState(ctx, storeName, key, meta)
+		return err
+	})
+	return item, err
+}
+
+func (c *resilientClient) SaveState(ctx context.Context, storeName, key string, data []byte, meta map[string]string, so ...dapr.StateOption) error {
+	return c.call(ctx, "SaveState", stateAttributes(storeName, key), config().StateStoreWriteTimeout, func(ctx context.Context) error {
+		return c.Client.SaveState(ctx, storeName, key, data, meta, so...)
+	})
+}
+
+func (c *resilientClient) SaveStateWithETag(ctx context.Context, storeName, key string, data []byte, etag string, meta map[string]string, so ...dapr.StateOption) error {
+	return c.call(ctx, "SaveStateWithETag", stateAttributes(storeName, key), config().StateStoreWriteTimeout, func(ctx context.Context) error {
+		return c.Client.SaveStateWithETag(ctx, storeName, key, data, etag, meta, so...)
+	})
+}
+
+func (c *resilientClient) DeleteState(ctx context.Context, storeName, key string, meta map[string]string) error {
+	return c.call(ctx, "DeleteState", stateAttributes(storeName, key), config().StateStoreWriteTimeout, func(ctx context.Context) error {
+		return c.Client.DeleteState(ctx, storeName, key, meta)
+	})
+}
+
+func (c *resilientClient) DeleteStateWithETag(ctx context.Context, storeName, key string, etag *dapr.ETag, meta map[string]string, opts *dapr.StateOptions) error {
+	return c.call(ctx, "DeleteStateWithETag", stateAttributes(storeName, key), config().StateStoreWriteTimeout, func(ctx context.Context) error {
+		return c.Client.DeleteStateWithETag(ctx, storeName, key, etag, meta, opts)
+	})
+}
+
+func (c *resilientClient) ExecuteStateTransaction(ctx context.Context, storeName string, meta map[string]string, ops []*dapr.StateOperation) error {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "dapr"),
+		attribute.String("dapr.store", storeName),
+		attribute.Int("dapr.state.operations", len(ops)),
+	}
+	return c.call(ctx, "ExecuteStateTransaction", attrs, config().StateStoreWriteTimeout, func(ctx context.Context) error {
+		return c.Client.ExecuteStateTransaction(ctx, storeName, meta, ops)
+	})
+}
+
+func (c *resilientClient) PublishEvent(ctx context.Context, pubsubName, topicName string, data interface{}, opts ...dapr.PublishEventOption) error {
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "dapr"),
+		attribute.String("dapr.pubsub", pubsubName),
+		attribute.String("messaging.destination.name", topicName),
+	}
+	return c.call(ctx, "PublishEvent", attrs, config().PubsubPublishTimeout, func(ctx context.Context) error {
+		return c.Client.PublishEvent(ctx, pubsubName, topicName, data, opts...)
+	})
+}
+
+func stateAttributes(storeName, key string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("db.system", "dapr"),
+		attribute.String("dapr.store", storeName),
+		attribute.String("dapr.state.key", key),
+	}
+}
@@ -0,0 +1,236 @@
+// stock-management-app/response.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiVersion is reported in every success envelope
+const apiVersion = "1.0"
+
+// problemTypeBase prefixes the RFC 7807 type URI of each error code
+const problemTypeBase = "urn:e-commerce-app:problem:"
+
+// Error codes returned in problem details
+const (
+	codeBadRequest           = "bad-request"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeValidation           = "validation-failed"
+	codeNotFound             = "not-found"
+	codeConflict             = "conflict"
+	codeInsufficientStock    = "insufficient-stock"
+	codeUnreadableProduct    = "unreadable-product"
+	codeUnsupportedMediaType = "unsupported-media-type"
+	codePayloadTooLarge      = "payload-too-large"
+	codeRateLimited          = "rate-limited"
+	codeStateStoreFailure    = "state-store-failure"
+	codeStateStoreDown       = "state-store-unavailable"
+	codeNotReady             = "not-ready"
+	codeUnhealthy            = "unhealthy"
+	codeInternal             = "internal-error"
+)
+
+// APIError is an error with a code, HTTP status and client-facing detail
+type APIError struct {
+	Code   string
+	Status int
+	Title  string
+	Detail string
+	Errors ValidationErrors
+	Checks map[string]DependencyCheck
+	// RetryAfter is sent as the Retry-After header when set
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Detail, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+func newBadRequestError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeBadRequest, Status: http.StatusBadRequest, Title: "Bad request", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newValidationError(errs ValidationErrors) *APIError {
+	return &APIError{Code: codeValidation, Status: http.StatusBadRequest, Title: "Validation failed", Detail: "One or more fields are invalid", Errors: errs}
+}
+
+func newUnauthorizedError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeUnauthorized, Status: http.StatusUnauthorized, Title: "Unauthorized", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newForbiddenError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeForbidden, Status: http.StatusForbidden, Title: "Forbidden", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newNotFoundError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeNotFound, Status: http.StatusNotFound, Title: "Not found", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newConflictError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeConflict, Status: http.StatusConflict, Title: "Conflict", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newUnsupportedMediaTypeError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeUnsupportedMediaType, Status: http.StatusUnsupportedMediaType, Title: "Unsupported media type", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newPayloadTooLargeError(limit int64) *APIError {
+	return &APIError{Code: codePayloadTooLarge, Status: http.StatusRequestEntityTooLarge, Title: "Payload too large", Detail: fmt.Sprintf("The request body is larger than %d bytes", limit)}
+}
+
+func newRateLimitedError(budget string, retryAfter time.Duration) *APIError {
+	return &APIError{Code: codeRateLimited, Status: http.StatusTooManyRequests, Title: "Too many requests", Detail: fmt.Sprintf("The %s request budget is used up, retry later", budget), RetryAfter: retryAfter}
+}
+
+func newNotReadyError(format string, args ...interface{}) *APIError {
+	return &APIError{Code: codeNotReady, Status: http.StatusServiceUnavailable, Title: "Not ready", Detail: fmt.Sprintf(format, args...)}
+}
+
+func newStateStoreUnavailableError(err error, retryAfter time.Duration) *APIError {
+	return &APIError{Code: codeStateStoreDown, Status: http.StatusServiceUnavailable, Title: "State store unavailable", Detail: "The state store is temporarily unavailable, retry later", RetryAfter: retryAfter, Err: err}
+}
+
+func newStateStoreError(err error) *APIError {
+	return &APIError{Code: codeStateStoreFailure, Status: http.StatusBadGateway, Title: "State store failure", Detail: "The state store could not complete the request", Err: err}
+}
+
+// ProblemDetails is an RFC 7807 application/problem+json body
+type ProblemDetails struct {
+	Type     string           `json:"type"`
+	Title    string           `json:"title"`
+	Status   int              `json:"status"`
+	Detail   string           `json:"detail,omitempty"`
+	Instance string           `json:"instance,omitempty"`
+	Code     string           `json:"code"`
+	Errors   ValidationErrors `json:"errors,omitempty"`
+
+	// Checks lists dependency statuses when readiness fails
+	Checks map[string]DependencyCheck `json:"checks,omitempty"`
+}
+
+// toAPIError maps any error returned by a handler onto an APIError
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var validationErrs ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return newValidationError(validationErrs)
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newPayloadTooLargeError(tooLarge.Limit)
+	}
+
+	if errors.Is(err, errProductNotFound) {
+		return &APIError{Code: codeNotFound, Status: http.StatusNotFound, Title: "Not found", Detail: err.Error(), Err: err}
+	}
+
+	if errors.Is(err, errInsufficientStock) {
+		return &APIError{Code: codeInsufficientStock, Status: http.StatusConflict, Title: "Insufficient stock", Detail: err.Error(), Err: err}
+	}
+
+	if errors.Is(err, errProductChanged) {
+		return &APIError{Code: codeConflict, Status: http.StatusConflict, Title: "Conflict", Detail: err.Error(), Err: err}
+	}
+
+	if errors.Is(err, errUnreadableProduct) {
+		return &APIError{Code: codeUnreadableProduct, Status: http.StatusInternalServerError, Title: "Unreadable product", Detail: err.Error(), Err: err}
+	}
+
+	var unavailable *unavailableError
+	if errors.As(err, &unavailable) {
+		return newStateStoreUnavailableError(err, unavailable.RetryAfter)
+	}
+
+	if errors.Is(err, errStateStore) {
+		return newStateStoreError(err)
+	}
+
+	return &APIError{Code: codeInternal, Status: http.StatusInternalServerError, Title: "Internal server error", Detail: "An unexpected error occurred", Err: err}
+}
+
+// errResponseTruncated is attached by handlers that stopped streaming a response part way
+var errResponseTruncated = errors.New("response truncated")
+
+// abortTruncatedResponses aborts the connection of a response a handler attached
+// errResponseTruncated to, so clients see a broken stream rather than one that looks complete.
+// It runs before the other middlewares so they still log and count the request.
+func abortTruncatedResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		for _, err := range c.Errors {
+			if errors.Is(err.Err, errResponseTruncated) {
+				panic(http.ErrAbortHandler)
+			}
+		}
+	}
+}
+
+// errorMiddleware renders the last error a handler attached with c.Error as problem details
+func errorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+
+		apiErr := toAPIError(c.Errors.Last().Err)
+		if apiErr.Status >= http.StatusInternalServerError {
+			slog.ErrorContext(c.Request.Context(), "Request failed", "method", c.Request.Method, "path", c.Request.URL.Path, "code", apiErr.Code, "error", apiErr.Error())
+		}
+
+		if apiErr.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(apiErr.RetryAfter.Seconds()))))
+		}
+		c.Header("Content-Type", "application/problem+json")
+		c.JSON(apiErr.Status, ProblemDetails{
+			Type:     problemTypeBase + apiErr.Code,
+			Title:    apiErr.Title,
+			Status:   apiErr.Status,
+			Detail:   apiErr.Detail,
+			Instance: c.Request.URL.Path,
+			Code:     apiErr.Code,
+			Errors:   apiErr.Errors,
+			Checks:   apiErr.Checks,
+		})
+	}
+}
+
+// abortWithError stops the handler chain and leaves err for errorMiddleware to render
+func abortWithError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// respond writes data wrapped in the versioned success envelope
+func respond(c *gin.Context, status int, data interface{}, message string) {
+	c.JSON(status, APIResponse{
+		APIVersion: apiVersion,
+		Status:     "success",
+		Message:    message,
+		Data:       data,
+	})
+}
@@ -0,0 +1,303 @@
+// stock-management-app/seed.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Seed modes accepted by SEED_MODE
+const (
+	seedModeNone    = "none"
+	seedModeIfEmpty = "if-empty"
+	seedModeUpsert  = "upsert"
+)
+
+// defaultSeedCatalog is used when SEED_FILE is not set
+//
+//go:embed seed/products.json
+var defaultSeedCatalog []byte
+
+// seedReport describes what a seeding run created, updated, skipped or failed to write
+type seedReport struct {
+	Mode    string
+	Source  string
+	Created []int
+	Updated []int
+	Skipped []int
+	Failed  []int
+}
+
+// seedProductCatalog loads the seed catalog of the tenant ctx is scoped to, configured through
+// its seed file and mode or SEED_FILE and SEED_MODE, and writes it to the repository. runOnce
+// guards the write so that only one replica seeds; when another replica already seeded the
+// catalog every product is reported as skipped.
+func seedProductCatalog(ctx context.Context, repo ProductRepository, runOnce func(name string, job func() error) error) (*seedReport, error) {
+	tenant, err := requireTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := tenantConfig(ctx)
+	switch settings.SeedMode {
+	case seedModeNone:
+		slog.InfoContext(ctx, "Seeding disabled", "tenant", tenant, "mode", settings.SeedMode)
+		return &seedReport{Mode: settings.SeedMode}, nil
+	case seedModeIfEmpty, seedModeUpsert:
+	default:
+		return nil, fmt.Errorf("invalid seed mode %q for tenant %s: expected %s, %s or %s", settings.SeedMode, tenant, seedModeNone, seedModeIfEmpty, seedModeUpsert)
+	}
+
+	source := settings.SeedFile
+	products, err := loadSeedFile(settings.SeedFile)
+	if err != nil {
+		return nil, err
+	}
+	if source == "" {
+		source = "embedded:seed/products.json"
+	}
+
+	if err := validateSeedCatalog(products); err != nil {
+		return nil, fmt.Errorf("invalid seed catalog %s: %v", source, err)
+	}
+
+	var report *seedReport
+	err = runOnce(seedJobName(tenant, settings.SeedMode, products), func() error {
+		var seedErr error
+		report, seedErr = seedProducts(ctx, repo, products, settings.SeedMode)
+		return seedErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	if report == nil {
+		report = &seedReport{Mode: settings.SeedMode}
+		for _, product := range products {
+			report.Skipped = append(report.Skipped, product.Id)
+		}
+	}
+	report.Source = source
+
+	slog.InfoContext(ctx, "Seeded catalog", "tenant", tenant, "source", report.Source, "mode", report.Mode,
+		"created", len(report.Created), "updated", len(report.Updated), "skipped", len(report.Skipped))
+	return report, nil
+}
+
+// seedProducts writes products according to mode through saveProduct, like every other write.
+// It fails when any product could not be written, so that the job is run again.
+func seedProducts(ctx context.Context, repo ProductRepository, products []Product, mode string) (*seedReport, error) {
+	report := &seedReport{Mode: mode}
+
+	if mode == seedModeIfEmpty {
+		existingIDs, err := repo.GetProductIDs(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error retrieving product IDs", "error", err)
+			return nil, err
+		}
+		if len(existingIDs) != 0 {
+			slog.InfoContext(ctx, "Products already initialized in state store")
+			for _, product := range products {
+				report.Skipped = append(report.Skipped, product.Id)
+			}
+			return report, nil
+		}
+	}
+
+	for _, product := range products {
+		_, added, err := saveProduct(ctx, repo, product)
+		switch {
+		case err != nil:
+			slog.ErrorContext(ctx, "Error saving product", "productId", product.Id, "error", err)
+			report.Failed = append(report.Failed, product.Id)
+		case added:
+			report.Created = append(report.Created, product.Id)
+		default:
+			report.Updated = append(report.Updated, product.Id)
+		}
+	}
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("failed to save %d of %d products: %v", len(report.Failed), len(products), report.Failed)
+	}
+	return report, nil
+}
+
+// loadSeedFile reads a seed catalog, falling back to the embedded default when path is empty.
+// The format is chosen by extension: .json, .yaml/.yml or .csv.
+func loadSeedFile(path string) ([]Product, error) {
+	if path == "" {
+		return decodeJSONCatalog(bytes.NewReader(defaultSeedCatalog))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open seed file: %v", err)
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return decodeJSONCatalog(f)
+	case ".yaml", ".yml":
+		return decodeYAMLCatalog(f)
+	case ".csv":
+		return decodeCSVCatalog(f)
+	default:
+		return nil, fmt.Errorf("unsupported seed file format %q: expected .json, .yaml, .yml or .csv", filepath.Ext(path))
+	}
+}
+
+func decodeJSONCatalog(r io.Reader) ([]Product, error) {
+	var products []Product
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&products); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON catalog: %v", err)
+	}
+	return products, nil
+}
+
+func decodeYAMLCatalog(r io.Reader) ([]Product, error) {
+	var products []Product
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&products); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML catalog: %v", err)
+	}
+	return products, nil
+}
+
+func decodeCSVCatalog(r io.Reader) ([]Product, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	columns, err := csvColumns(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var products []Product
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV line %d: %v", line, err)
+		}
+
+		product, err := productFromCSVRecord(columns, record)
+		if err != nil {
+			return nil, fmt.Errorf("CSV line %d: %v", line, err)
+		}
+		products = append(products, product)
+	}
+	return products, nil
+}
+
+// csvProductColumns are the CSV columns mapped onto Product fields. Tags are separated by '|'.
+var csvProductColumns = []string{"id", "name", "category", "price", "description", "imageUrl", "quantity", "tags"}
+
+// csvColumns maps column names to their index in the header row
+func csvColumns(header []string) (map[string]int, error) {
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"id", "name"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header is missing required column %q", name)
+		}
+	}
+	for name := range columns {
+		if !containsString(csvProductColumns, name) {
+			return nil, fmt.Errorf("CSV header has unknown column %q", name)
+		}
+	}
+	return columns, nil
+}
+
+// productFromCSVRecord converts a CSV row into a Product
+func productFromCSVRecord(columns map[string]int, record []string) (Product, error) {
+	var product Product
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var err error
+	if product.Id, err = strconv.Atoi(field("id")); err != nil {
+		return product, fmt.Errorf("invalid id %q", field("id"))
+	}
+	if value := field("price"); value != "" {
+		if product.Price, err = strconv.ParseFloat(value, 64); err != nil {
+			return product, fmt.Errorf("invalid price %q", value)
+		}
+	}
+	if value := field("quantity"); value != "" {
+		if product.Quantity, err = strconv.Atoi(value); err != nil {
+			return product, fmt.Errorf("invalid quantity %q", value)
+		}
+	}
+
+	product.Name = field("name")
+	product.Category = field("category")
+	product.Description = field("description")
+	product.ImageUrl = field("imageUrl")
+	product.Tags = make([]string, 0)
+	for _, tag := range strings.Split(field("tags"), "|") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			product.Tags = append(product.Tags, tag)
+		}
+	}
+	return product, nil
+}
+
+// validateSeedCatalog checks the whole catalog before anything is written
+func validateSeedCatalog(products []Product) error {
+	if len(products) == 0 {
+		return errors.New("catalog is empty")
+	}
+
+	var problems []string
+	seen := make(map[int]bool, len(products))
+	for i, product := range products {
+		if seen[product.Id] {
+			problems = append(problems, fmt.Sprintf("entry %d: duplicate id %d", i, product.Id))
+		}
+		seen[product.Id] = true
+		for _, fieldErr := range validateProduct(product) {
+			problems = append(problems, fmt.Sprintf("entry %d: %s: %s", i, fieldErr.Field, fieldErr.Message))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
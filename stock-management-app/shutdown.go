@@ -0,0 +1,157 @@
+// stock-management-app/shutdown.go
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	// shuttingDown fails readiness as soon as a shutdown signal arrives
+	shuttingDown atomic.Bool
+
+	// backgroundWorkers tracks work that outlives the request that started it
+	backgroundWorkers = newWorkerGroup()
+
+	// inFlightRequests tracks requests on the HTTP callback service, whose own shutdown
+	// only waits a fixed five seconds
+	inFlightRequests sync.WaitGroup
+)
+
+// workerGroup runs background work that shutdown waits for. Workers get a context
+// that is cancelled when the drain deadline passes, so they can stop at a safe point.
+type workerGroup struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running int
+}
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go starts fn unless the group is draining, in which case it returns false
+func (g *workerGroup) Go(fn func(ctx context.Context)) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	g.running++
+	go func() {
+		defer func() {
+			g.mu.Lock()
+			g.running--
+			g.mu.Unlock()
+			g.wg.Done()
+		}()
+		fn(g.ctx)
+	}()
+	return true
+}
+
+// Drain stops new work and waits for running work until ctx is done, then cancels what is left
+func (g *workerGroup) Drain(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	running := g.running
+	g.mu.Unlock()
+
+	if running > 0 {
+		slog.Info("Waiting for background workers to finish", "running", running)
+	}
+	if err := waitWithContext(ctx, g.wg.Wait); err != nil {
+		g.cancel()
+		return err
+	}
+	return nil
+}
+
+// trackInFlight counts requests so shutdown can wait for them past the SDK's own timeout
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightRequests.Add(1)
+		defer inFlightRequests.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpServerStopper stops an HTTP server, waiting for in-flight requests until ctx is done
+type httpServerStopper func(ctx context.Context) error
+
+// gracefulShutdown fails readiness, stops accepting traffic, drains requests, streams and
+// background workers, and returns once everything has finished or ctx is done. The Dapr
+// client must only be closed after it returns, since draining work still uses the sidecar.
+func gracefulShutdown(ctx context.Context, stopHTTP httpServerStopper, grpcServer *grpc.Server) {
+	shuttingDown.Store(true)
+	slog.Info("Shutting down: readiness is failing, still serving", "delay", config().ShutdownReadinessDelay.String())
+	select {
+	case <-time.After(config().ShutdownReadinessDelay):
+	case <-ctx.Done():
+	}
+
+	// Streams never finish on their own, end them so the gRPC server can stop gracefully
+	stockWatchers.close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := stopHTTP(ctx); err != nil {
+			slog.Warn("HTTP server did not drain in time", "error", err)
+			return
+		}
+		slog.Info("HTTP server drained")
+	}()
+	go func() {
+		defer wg.Done()
+		if err := waitWithContext(ctx, grpcServer.GracefulStop); err != nil {
+			slog.Warn("gRPC server did not drain in time, closing remaining calls", "error", err)
+			grpcServer.Stop()
+			return
+		}
+		slog.Info("gRPC server drained")
+	}()
+	wg.Wait()
+
+	if err := backgroundWorkers.Drain(ctx); err != nil {
+		slog.Warn("Background workers did not finish in time", "error", err)
+		return
+	}
+	slog.Info("Background workers finished")
+}
+
+// waitWithContext runs a blocking wait until it returns or ctx is done
+func waitWithContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isServerClosed reports whether a server stopped because it was shut down
+func isServerClosed(err error) bool {
+	return err == nil || errors.Is(err, http.ErrServerClosed) || errors.Is(err, grpc.ErrServerStopped)
+}
@@ -0,0 +1,251 @@
+// stock-management-app/startup.go
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	startupJobRunning = "running"
+	startupJobDone    = "done"
+)
+
+var (
+	// startupJobPollInterval is how often waiting replicas re-check a job held by another replica
+	startupJobPollInterval = 2 * time.Second
+
+	// seedCompleted gates readiness until the seed job has finished on this or another replica
+	seedCompleted atomic.Bool
+)
+
+// startupJobMarker is stored under startup-job-<name> to coordinate replicas
+type startupJobMarker struct {
+	Status      string    `json:"status"`
+	Owner       string    `json:"owner"`
+	StartedAt   time.Time `json:"startedAt"`
+	LeaseUntil  time.Time `json:"leaseUntil,omitempty"`
+	CompletedAt time.Time `json:"completedAt,omitempty"`
+}
+
+// runStartupJob runs job on exactly one replica. The first replica to create the
+// marker key (first-write concurrency) runs the job, the others wait until it is
+// done or skip it if it already completed. A crashed owner is taken over once its
+// lease expires, using the marker's ETag so only one replica wins the takeover.
+func runStartupJob(ctx context.Context, client dapr.Client, name string, job func() error) error {
+	key := "startup-job-" + name
+	owner := startupJobOwner()
+
+	for {
+		item, err := client.GetState(ctx, config().StateStoreName, key, nil)
+		if err != nil {
+			return fmt.Errorf("failed to read startup job marker %s: %v", key, err)
+		}
+
+		var marker startupJobMarker
+		if item.Value != nil {
+			if err := json.Unmarshal(item.Value, &marker); err != nil {
+				return fmt.Errorf("failed to decode startup job marker %s: %v", key, err)
+			}
+		}
+
+		switch {
+		case item.Value != nil && marker.Status == startupJobDone:
+			slog.InfoContext(ctx, "Startup job already completed, skipping", "job", name, "owner", marker.Owner)
+			return nil
+
+		case item.Value == nil || time.Now().After(marker.LeaseUntil):
+			claimed, err := claimStartupJob(ctx, client, key, owner, item.Etag)
+			if err != nil {
+				return err
+			}
+			if claimed {
+				slog.InfoContext(ctx, "Running startup job", "job", name, "owner", owner)
+				return completeStartupJob(ctx, client, key, owner, job)
+			}
+			slog.InfoContext(ctx, "Startup job was claimed by another replica", "job", name)
+
+		default:
+			slog.InfoContext(ctx, "Waiting for startup job", "job", name, "owner", marker.Owner)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for startup job %s: %v", name, ctx.Err())
+		case <-time.After(startupJobPollInterval):
+		}
+	}
+}
+
+// claimStartupJob writes a running marker. With no etag the write only succeeds if the key
+// does not exist yet, otherwise only if the marker is unchanged since it was read.
+func claimStartupJob(ctx context.Context, client dapr.Client, key, owner, etag string) (bool, error) {
+	now := time.Now().UTC()
+	value, err := json.Marshal(startupJobMarker{
+		Status:     startupJobRunning,
+		Owner:      owner,
+		StartedAt:  now,
+		LeaseUntil: now.Add(config().StartupJobLease),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	err = client.SaveStateWithETag(ctx, config().StateStoreName, key, value, etag, startupJobLeaseMetadata(),
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	if status.Code(err) == codes.Aborted {
+		// Another replica claimed the job first
+		slog.InfoContext(ctx, "Could not claim startup job marker", "key", key, "error", err)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim startup job marker %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// startupJobLeaseMetadata sets a TTL on running markers, so the store drops those of crashed owners on its own
+func startupJobLeaseMetadata() map[string]string {
+	return map[string]string{"ttlInSeconds": strconv.Itoa(int(config().StartupJobLease.Seconds()))}
+}
+
+// completeStartupJob runs the job, renewing its lease meanwhile, and records the outcome on the marker
+func completeStartupJob(ctx context.Context, client dapr.Client, key, owner string, job func() error) error {
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		renewStartupJob(heartbeatCtx, client, key, owner)
+	}()
+	err := job()
+	stopHeartbeat()
+	<-heartbeatDone
+
+	if err != nil {
+		// Release the claim so another replica can retry straight away
+		if delErr := releaseStartupJob(ctx, client, key, owner); delErr != nil {
+			slog.WarnContext(ctx, "Failed to release startup job marker", "key", key, "error", delErr)
+		}
+		return err
+	}
+
+	// Overwrite without a TTL so the completed marker is kept
+	held, err := updateStartupJob(ctx, client, key, owner, map[string]string{"ttlInSeconds": "-1"}, func(marker *startupJobMarker) {
+		marker.Status = startupJobDone
+		marker.CompletedAt = time.Now().UTC()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark startup job %s as done: %w", key, err)
+	}
+	if !held {
+		slog.WarnContext(ctx, "Startup job was taken over by another replica before it completed", "key", key)
+	}
+	return nil
+}
+
+// renewStartupJob extends the lease of a running job every third of STARTUP_JOB_LEASE_SECONDS
+// until ctx is cancelled, so a job running longer than the lease is not taken over
+func renewStartupJob(ctx context.Context, client dapr.Client, key, owner string) {
+	ticker := time.NewTicker(config().StartupJobLease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		held, err := updateStartupJob(ctx, client, key, owner, startupJobLeaseMetadata(), func(marker *startupJobMarker) {
+			marker.LeaseUntil = time.Now().UTC().Add(config().StartupJobLease)
+		})
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			slog.WarnContext(ctx, "Failed to renew startup job lease", "key", key, "error", err)
+		case !held:
+			slog.WarnContext(ctx, "Startup job lease was taken over by another replica", "key", key)
+			return
+		}
+	}
+}
+
+// updateStartupJob rewrites the marker of a job this replica is running, guarded by the ETag
+// read alongside it. It reports false when the marker is gone or held by another replica.
+func updateStartupJob(ctx context.Context, client dapr.Client, key, owner string, meta map[string]string, update func(marker *startupJobMarker)) (bool, error) {
+	marker, etag, held, err := getHeldStartupJob(ctx, client, key, owner)
+	if err != nil || !held {
+		return false, err
+	}
+	update(marker)
+	value, err := json.Marshal(marker)
+	if err != nil {
+		return false, err
+	}
+
+	err = client.SaveStateWithETag(ctx, config().StateStoreName, key, value, etag, meta,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	if status.Code(err) == codes.Aborted {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseStartupJob deletes the marker of a job this replica is running, leaving it alone
+// once another replica has taken the job over
+func releaseStartupJob(ctx context.Context, client dapr.Client, key, owner string) error {
+	_, etag, held, err := getHeldStartupJob(ctx, client, key, owner)
+	if err != nil || !held {
+		return err
+	}
+	err = client.DeleteStateWithETag(ctx, config().StateStoreName, key, &dapr.ETag{Value: etag}, nil, nil)
+	if status.Code(err) == codes.Aborted {
+		return nil
+	}
+	return err
+}
+
+// getHeldStartupJob reads a marker and its ETag, reporting whether this replica is running the job
+func getHeldStartupJob(ctx context.Context, client dapr.Client, key, owner string) (*startupJobMarker, string, bool, error) {
+	item, err := client.GetState(ctx, config().StateStoreName, key, nil)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to read startup job marker %s: %w", key, err)
+	}
+	if item.Value == nil {
+		return nil, "", false, nil
+	}
+	var marker startupJobMarker
+	if err := json.Unmarshal(item.Value, &marker); err != nil {
+		return nil, "", false, fmt.Errorf("failed to decode startup job marker %s: %v", key, err)
+	}
+	return &marker, item.Etag, marker.Status == startupJobRunning && marker.Owner == owner, nil
+}
+
+// seedJobName identifies a seeding run by tenant, mode and catalog contents, so changing the
+// seed file or mode seeds again once while restarts with the same catalog are skipped
+func seedJobName(tenant, mode string, products []Product) string {
+	data, _ := json.Marshal(products)
+	sum := sha256.Sum256(append([]byte(mode+"\n"), data...))
+	return "seed-" + tenant + "-" + hex.EncodeToString(sum[:8])
+}
+
+// startupJobOwner identifies this replica, using the pod name when running in Kubernetes
+func startupJobOwner() string {
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname + "-" + strconv.Itoa(os.Getpid())
+	}
+	return "pid-" + strconv.Itoa(os.Getpid())
+}
@@ -0,0 +1,162 @@
+// stock-management-app/startup_test.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useShortStartupLease shortens the startup job lease and polling for the rest of the test
+func useShortStartupLease(t *testing.T, cfg *Config) {
+	t.Helper()
+	cfg.StartupJobLease = time.Second
+	currentConfig.Store(cfg)
+	interval := startupJobPollInterval
+	startupJobPollInterval = 20 * time.Millisecond
+	t.Cleanup(func() { startupJobPollInterval = interval })
+}
+
+// readStartupJobMarker decodes the marker of a startup job from the sidecar
+func readStartupJobMarker(t *testing.T, value []byte) startupJobMarker {
+	t.Helper()
+	var marker startupJobMarker
+	if err := json.Unmarshal(value, &marker); err != nil {
+		t.Fatalf("decoding marker %s: %v", value, err)
+	}
+	return marker
+}
+
+func TestStartupJobLeaseIsRenewedWhileRunning(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	useShortStartupLease(t, cfg)
+	sidecar, client := connectSidecar(t)
+
+	var runs atomic.Int32
+	job := func() error {
+		runs.Add(1)
+		time.Sleep(3 * cfg.StartupJobLease)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := runStartupJob(ctx, client, "slow", job); err != nil {
+				t.Errorf("runStartupJob: %v", err)
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if got := runs.Load(); got != 1 {
+		t.Errorf("job ran %d times, want once", got)
+	}
+	value, _ := sidecar.State(cfg.StateStoreName, "startup-job-slow")
+	if marker := readStartupJobMarker(t, value); marker.Status != startupJobDone {
+		t.Errorf("marker status = %s, want %s", marker.Status, startupJobDone)
+	}
+}
+
+func TestStartupJobTakenOverIsNotCompleted(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	ctx := context.Background()
+	key := "startup-job-taken"
+
+	if claimed, err := claimStartupJob(ctx, client, key, "replica-a", ""); err != nil || !claimed {
+		t.Fatalf("claimStartupJob = %v, %v, want claimed", claimed, err)
+	}
+	err := completeStartupJob(ctx, client, key, "replica-a", func() error {
+		// The lease ran out and another replica claimed the job meanwhile
+		sidecar.SetState(cfg.StateStoreName, key, []byte(`{"status":"running","owner":"replica-b"}`))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("completeStartupJob: %v", err)
+	}
+
+	value, _ := sidecar.State(cfg.StateStoreName, key)
+	if marker := readStartupJobMarker(t, value); marker.Status != startupJobRunning || marker.Owner != "replica-b" {
+		t.Errorf("marker = %+v, want the other replica's claim kept", marker)
+	}
+}
+
+func TestClaimStartupJobReportsStoreFailures(t *testing.T) {
+	useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	ctx := context.Background()
+
+	if claimed, err := claimStartupJob(ctx, client, "startup-job-claimed", "replica-a", ""); err != nil || !claimed {
+		t.Fatalf("first claim = %v, %v, want claimed", claimed, err)
+	}
+	if claimed, err := claimStartupJob(ctx, client, "startup-job-claimed", "replica-b", ""); err != nil || claimed {
+		t.Fatalf("second claim = %v, %v, want a conflict", claimed, err)
+	}
+
+	sidecar.Close()
+	if claimed, err := claimStartupJob(ctx, client, "startup-job-down", "replica-a", ""); err == nil || claimed {
+		t.Fatalf("claim with the sidecar down = %v, %v, want an error", claimed, err)
+	}
+}
+
+// unwritableRepository fails to save one product
+type unwritableRepository struct {
+	ProductRepository
+	id int
+}
+
+func (r *unwritableRepository) SaveProduct(ctx context.Context, product Product) error {
+	if product.Id == r.id {
+		return errStateStore
+	}
+	return r.ProductRepository.SaveProduct(ctx, product)
+}
+
+func TestFailedSeedIsRetried(t *testing.T) {
+	cfg, _ := useTestConfig(t)
+	sidecar, client := connectSidecar(t)
+	ctx := withTenant(context.Background(), cfg.DefaultTenant, tenantSourceJob)
+	memory := newMemoryProductRepository()
+	products := []Product{{Id: 1, Name: "Mug", Quantity: 3}, {Id: 2, Name: "Lamp", Quantity: 7}}
+
+	seed := func(repo ProductRepository) (*seedReport, error) {
+		var report *seedReport
+		err := runStartupJob(ctx, client, "seed", func() error {
+			var err error
+			report, err = seedProducts(ctx, repo, products, seedModeUpsert)
+			return err
+		})
+		return report, err
+	}
+
+	report, err := seed(&unwritableRepository{ProductRepository: memory, id: 2})
+	if err == nil {
+		t.Fatal("seeding succeeded without product 2")
+	}
+	if len(report.Failed) != 1 || report.Failed[0] != 2 || len(report.Created) != 1 {
+		t.Errorf("report = %+v, want product 1 created and product 2 failed", report)
+	}
+	if value, ok := sidecar.State(cfg.StateStoreName, "startup-job-seed"); ok && readStartupJobMarker(t, value).Status == startupJobDone {
+		t.Fatal("failed seeding was marked as done")
+	}
+
+	// The next replica seeds again
+	report, err = seed(memory)
+	if err != nil {
+		t.Fatalf("seeding again: %v", err)
+	}
+	if len(report.Created) != 1 || report.Created[0] != 2 || len(report.Updated) != 1 {
+		t.Errorf("report = %+v, want product 2 created and product 1 updated", report)
+	}
+	expectQuantity(t, memory, 2, 7)
+}
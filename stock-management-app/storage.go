@@ -0,0 +1,119 @@
+// stock-management-app/storage.go
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// productSchemaVersion is the current version of the stored product record format
+	productSchemaVersion = 1
+
+	// productEncodingJSON stores the product as a plain JSON object in the payload
+	productEncodingJSON = "json"
+)
+
+// errLegacyProductRecord is returned when a value predates the versioned record format
+var errLegacyProductRecord = errors.New("product record has no schema version; run the migrate command")
+
+// productRecord is the versioned envelope products are stored in
+type productRecord struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Encoding      string          `json:"encoding"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// productKey returns the state store key for a product of a tenant
+func productKey(tenant string, id int) string {
+	return tenant + ":product-" + strconv.Itoa(id)
+}
+
+// productIDsKey returns the state store key of the product ID index of a tenant
+func productIDsKey(tenant string) string {
+	return tenant + ":productIDs"
+}
+
+// auditKey returns the state store key of an audit stream of a tenant
+func auditKey(tenant, stream string) string {
+	return tenant + ":audit-" + stream
+}
+
+// importJobKey returns the state store key of an import job of a tenant
+func importJobKey(tenant, id string) string {
+	return tenant + ":import-job-" + id
+}
+
+// legacyProductIDsKey indexes the products stored before catalogs were kept per tenant,
+// moveLegacyCatalog moves them into the default tenant
+const legacyProductIDsKey = "productIDs"
+
+// legacyProductKey returns the key a product was stored under before catalogs were kept per tenant
+func legacyProductKey(id int) string {
+	return "product-" + strconv.Itoa(id)
+}
+
+// encodeProductRecord wraps a product in the current record format
+func encodeProductRecord(product Product) ([]byte, error) {
+	payload, err := json.Marshal(product)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(productRecord{
+		SchemaVersion: productSchemaVersion,
+		Encoding:      productEncodingJSON,
+		Payload:       payload,
+	})
+}
+
+// decodeProductRecord strictly decodes a stored record, rejecting legacy values and unknown versions
+func decodeProductRecord(data []byte, product *Product) error {
+	var record productRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return errLegacyProductRecord
+	}
+
+	switch record.SchemaVersion {
+	case 0:
+		return errLegacyProductRecord
+	case productSchemaVersion:
+	default:
+		return fmt.Errorf("unsupported product record schema version %d (this build supports version %d)", record.SchemaVersion, productSchemaVersion)
+	}
+
+	if record.Encoding != productEncodingJSON {
+		return fmt.Errorf("unsupported product record encoding %q for schema version %d", record.Encoding, record.SchemaVersion)
+	}
+
+	if err := json.Unmarshal(record.Payload, product); err != nil {
+		return fmt.Errorf("failed to unmarshal product record payload: %v", err)
+	}
+	return nil
+}
+
+// decodeLegacyProduct decodes values written before the versioned record format,
+// either as a plain JSON object or as a base64 encoded JSON string
+func decodeLegacyProduct(data []byte, product *Product) error {
+	// First, try to unmarshal directly without Base64 decoding
+	if err := json.Unmarshal(data, product); err == nil {
+		return nil
+	}
+
+	// If direct unmarshal fails, try Base64 decoding
+	trimmed := strings.Trim(string(data), "\"")
+	decodedBytes, err := base64.StdEncoding.DecodeString(trimmed)
+	if err != nil {
+		return fmt.Errorf("failed to decode base64 string: %v", err)
+	}
+
+	if err := json.Unmarshal(decodedBytes, product); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON after Base64 decoding: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// stock-management-app/subscriptions.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	runtimev1pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/dapr/go-sdk/service/common"
+	daprhttp "github.com/dapr/go-sdk/service/http"
+	"github.com/go-chi/chi/v5"
+	"google.golang.org/grpc"
+)
+
+// App protocols the Dapr callback channel can be served with, selected by DAPR_APP_PROTOCOL.
+// With grpc the sidecar must be annotated with dapr.io/app-protocol: grpc and GRPC_PORT as its app port.
+const (
+	appProtocolHTTP = "http"
+	appProtocolGRPC = "grpc"
+)
+
+// bulkSubscribeOptions lets the sidecar deliver the events of a subscription in batches
+type bulkSubscribeOptions struct {
+	MaxMessagesCount   int32
+	MaxAwaitDurationMs int32
+}
+
+// topicSubscription declares a subscription once for both app protocols. The SDK serves
+// routes; dead-letter topics and bulk options are added to what it advertises,
+// and batches are handed to BulkHandler.
+type topicSubscription struct {
+	PubsubName      string
+	Topic           string
+	Route           string
+	Handler         common.TopicEventHandler
+	DeadLetterTopic string
+	Bulk            *bulkSubscribeOptions
+	BulkHandler     bulkEventHandler
+	Metadata        map[string]string
+}
+
+// stockSubscriptions are the topics this service consumes
+func stockSubscriptions(repo ProductRepository) []topicSubscription {
+	return []topicSubscription{
+		{
+			PubsubName:      config().PubsubName,
+			Topic:           config().StockUpdateTopic,
+			Route:           "/events/stock-update",
+			Handler:         stockUpdateEventHandler(repo),
+			DeadLetterTopic: config().StockUpdateDeadLetterTopic,
+			Bulk:            stockSubscriptionBulkOptions(),
+			BulkHandler:     stockUpdateBulkHandler(repo),
+		},
+		{
+			PubsubName: config().PubsubName,
+			Topic:      config().StockUpdateDeadLetterTopic,
+			Route:      "/events/stock-update-dead-letter",
+			Handler:    deadLetterEventHandler,
+		},
+	}
+}
+
+// stockUpdateEventHandler applies a stockUpdate event. Events that can never succeed are dropped,
+// state store failures are retried.
+func stockUpdateEventHandler(repo ProductRepository) common.TopicEventHandler {
+	return func(ctx context.Context, e *common.TopicEvent) (bool, error) {
+		var req StockUpdateRequest
+		if err := json.Unmarshal(e.RawData, &req); err != nil {
+			slog.WarnContext(ctx, "Dropping stock update event with invalid payload", "eventId", e.ID, "payload", logPayload(e.RawData), "error", err)
+			countStockUpdate(stockUpdateSourceEvent, stockUpdateFailed)
+			return false, err
+		}
+		if errs := validateStockUpdateRequest(req); len(errs) > 0 {
+			slog.WarnContext(ctx, "Dropping invalid stock update event", "eventId", e.ID, "errors", errs.Error())
+			countStockUpdate(stockUpdateSourceEvent, stockUpdateFailed)
+			return false, errs
+		}
+
+		_, err := applyStockUpdates(ctx, repo, req.Updates)
+		countStockUpdate(stockUpdateSourceEvent, stockUpdateResult(err, true))
+		if err != nil {
+			if isPermanentStockUpdateError(err) {
+				slog.WarnContext(ctx, "Dropping stock update event", "eventId", e.ID, "error", err)
+				return false, err
+			}
+			slog.WarnContext(ctx, "Stock update event failed, asking Dapr to retry", "eventId", e.ID, "error", err)
+			return true, err
+		}
+		return false, nil
+	}
+}
+
+// deadLetterEventHandler records events Dapr gave up on so they can be replayed by hand
+func deadLetterEventHandler(ctx context.Context, e *common.TopicEvent) (bool, error) {
+	slog.ErrorContext(ctx, "Dead-lettered event", "eventId", e.ID, "topic", e.Topic, "payload", logPayload(e.RawData))
+	return false, nil
+}
+
+// registerTopicHandlers adds the handler of every subscription to a Dapr service
+func registerTopicHandlers(service common.Service, subscriptions []topicSubscription) error {
+	for _, sub := range subscriptions {
+		err := service.AddTopicEventHandler(&common.Subscription{
+			PubsubName: sub.PubsubName,
+			Topic:      sub.Topic,
+			Route:      sub.Route,
+			Metadata:   sub.Metadata,
+		}, sub.Handler)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s/%s: %v", sub.PubsubName, sub.Topic, err)
+		}
+	}
+	return nil
+}
+
+// findSubscription returns the declaration of a subscription advertised by the SDK
+func findSubscription(subscriptions []topicSubscription, pubsub, topic string) (topicSubscription, bool) {
+	for _, sub := range subscriptions {
+		if sub.PubsubName == pubsub && sub.Topic == topic {
+			return sub, true
+		}
+	}
+	return topicSubscription{}, false
+}
+
+// newHTTPCallbackService serves the Gin handler and the Dapr callback channel from one port
+// through the SDK's service/http package
+func newHTTPCallbackService(address string, handler http.Handler, subscriptions []topicSubscription, auth *authChain) (common.Service, error) {
+	mux := chi.NewRouter()
+	mux.Use(limitEventBody(subscriptions), correlationMiddleware, daprTokenMiddleware(auth, subscriptions), cloudEventTraceMiddleware(subscriptions),
+		eventSpanMiddleware(subscriptions), trackInFlight, subscribeResponseMiddleware(subscriptions), bulkEventMiddleware(subscriptions),
+		eventTenantMiddleware(subscriptions))
+
+	// Everything the SDK does not serve, including the health endpoints, is left to Gin
+	mux.Handle("/healthz", handler)
+	mux.NotFound(handler.ServeHTTP)
+	mux.MethodNotAllowed(handler.ServeHTTP)
+
+	service := daprhttp.NewServiceWithMux(address, mux)
+	if err := registerTopicHandlers(service, subscriptions); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// subscribeResponseMiddleware adds dead-letter topics and bulk options to /dapr/subscribe
+func subscribeResponseMiddleware(subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/dapr/subscribe" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			recorder := &bufferedResponseWriter{header: w.Header(), status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			var advertised []map[string]interface{}
+			if recorder.status != http.StatusOK || json.Unmarshal(recorder.body.Bytes(), &advertised) != nil {
+				w.WriteHeader(recorder.status)
+				_, _ = w.Write(recorder.body.Bytes())
+				return
+			}
+
+			for _, entry := range advertised {
+				pubsub, _ := entry["pubsubname"].(string)
+				topic, _ := entry["topic"].(string)
+				sub, ok := findSubscription(subscriptions, pubsub, topic)
+				if !ok {
+					continue
+				}
+				if sub.DeadLetterTopic != "" {
+					entry["deadLetterTopic"] = sub.DeadLetterTopic
+				}
+				if sub.Bulk != nil {
+					entry["bulkSubscribe"] = map[string]interface{}{
+						"enabled":            true,
+						"maxMessagesCount":   sub.Bulk.MaxMessagesCount,
+						"maxAwaitDurationMs": sub.Bulk.MaxAwaitDurationMs,
+					}
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(advertised); err != nil {
+				slog.WarnContext(r.Context(), "Failed to write subscriptions", "error", err)
+			}
+		})
+	}
+}
+
+// bufferedResponseWriter holds a response so it can be rewritten before it is sent
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// subscriptionsInterceptor adds dead-letter topics and bulk options to ListTopicSubscriptions
+func subscriptionsInterceptor(subscriptions []topicSubscription) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err != nil || info.FullMethod != runtimev1pb.AppCallback_ListTopicSubscriptions_FullMethodName {
+			return resp, err
+		}
+
+		list, ok := resp.(*runtimev1pb.ListTopicSubscriptionsResponse)
+		if !ok {
+			return resp, nil
+		}
+		for _, advertised := range list.GetSubscriptions() {
+			sub, ok := findSubscription(subscriptions, advertised.GetPubsubName(), advertised.GetTopic())
+			if !ok {
+				continue
+			}
+			advertised.DeadLetterTopic = sub.DeadLetterTopic
+			if sub.Bulk != nil {
+				advertised.BulkSubscribe = &runtimev1pb.BulkSubscribeConfig{
+					Enabled:            true,
+					MaxMessagesCount:   sub.Bulk.MaxMessagesCount,
+					MaxAwaitDurationMs: sub.Bulk.MaxAwaitDurationMs,
+				}
+			}
+		}
+		return list, nil
+	}
+}
@@ -0,0 +1,355 @@
+// stock-management-app/tenant.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	commonv1pb "github.com/dapr/dapr/pkg/proto/common/v1"
+	runtimev1pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"gopkg.in/yaml.v3"
+)
+
+// tenantHeader names the tenant of a request whose credentials are not bound to one
+const tenantHeader = "X-Tenant-ID"
+
+// tenantExtension is the CloudEvent extension attribute naming the tenant of an event
+const tenantExtension = "tenantid"
+
+// Where the tenant of a request came from
+const (
+	tenantSourceCredentials = "credentials"
+	tenantSourceHeader      = "header"
+	tenantSourceEvent       = "event"
+	tenantSourceDefault     = "default"
+	tenantSourceJob         = "job"
+)
+
+// tenantIDPattern keeps tenant IDs safe to use in state store keys
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// errNoTenant is returned by repositories asked to work outside of a tenant's scope
+var errNoTenant = errors.New("no tenant in scope")
+
+// tenantSettings are the settings a tenant can override in TENANTS_FILE, empty ones inherit
+// the service's own
+type tenantSettings struct {
+	SeedFile         string `yaml:"seedFile"`
+	SeedMode         string `yaml:"seedMode"`
+	StorefrontURL    string `yaml:"storefrontUrl"`
+	MerchantCurrency string `yaml:"merchantCurrency"`
+}
+
+var registeredTenants atomic.Pointer[map[string]tenantSettings]
+
+// setTenants replaces the tenants the service serves, as read by loadTenants
+func setTenants(tenants map[string]tenantSettings) {
+	registeredTenants.Store(&tenants)
+}
+
+// tenants returns the tenants the service serves by ID, the default tenant alone until main
+// has loaded them
+func tenants() map[string]tenantSettings {
+	if tenants := registeredTenants.Load(); tenants != nil {
+		return *tenants
+	}
+	return map[string]tenantSettings{config().DefaultTenant: {}}
+}
+
+// tenantIDs lists the tenants the service serves
+func tenantIDs() []string {
+	ids := make([]string, 0, len(tenants()))
+	for id := range tenants() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// loadTenants reads the tenants listed in TENANTS_FILE, without one the default tenant is the
+// only tenant. The file maps tenant IDs to their settings:
+//
+//	tenants:
+//	  acme:
+//	    seedFile: /etc/stock/acme-products.csv
+//	    merchantCurrency: EUR
+//	  globex: {}
+func loadTenants(cfg *Config) (map[string]tenantSettings, error) {
+	if cfg.TenantsFile == "" {
+		if cfg.DefaultTenant == "" {
+			return nil, errors.New("DEFAULT_TENANT must be set unless TENANTS_FILE lists the tenants")
+		}
+		return map[string]tenantSettings{cfg.DefaultTenant: {}}, nil
+	}
+
+	data, err := os.ReadFile(cfg.TenantsFile)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Tenants map[string]tenantSettings `yaml:"tenants"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", cfg.TenantsFile, err)
+	}
+	if len(doc.Tenants) == 0 {
+		return nil, fmt.Errorf("%s lists no tenants", cfg.TenantsFile)
+	}
+
+	ids := make([]string, 0, len(doc.Tenants))
+	for id := range doc.Tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		settings := doc.Tenants[id]
+		if !tenantIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("tenant %q: IDs are lowercase letters, digits and dashes", id)
+		}
+		switch settings.SeedMode {
+		case "", seedModeNone, seedModeIfEmpty, seedModeUpsert:
+		default:
+			return nil, fmt.Errorf("tenant %s: seedMode %q is not one of %s, %s, %s", id, settings.SeedMode, seedModeNone, seedModeIfEmpty, seedModeUpsert)
+		}
+		if settings.StorefrontURL != "" {
+			if u, err := url.Parse(settings.StorefrontURL); err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("tenant %s: storefrontUrl %q is not an absolute URL", id, settings.StorefrontURL)
+			}
+		}
+		if settings.MerchantCurrency != "" && !currencyPattern.MatchString(settings.MerchantCurrency) {
+			return nil, fmt.Errorf("tenant %s: merchantCurrency %q is not an ISO 4217 code such as USD", id, settings.MerchantCurrency)
+		}
+	}
+	if _, ok := doc.Tenants[cfg.DefaultTenant]; cfg.DefaultTenant != "" && !ok {
+		return nil, fmt.Errorf("DEFAULT_TENANT %s is not listed", cfg.DefaultTenant)
+	}
+	return doc.Tenants, nil
+}
+
+// tenantConfig returns the settings of the tenant ctx is scoped to, with the service's own
+// settings filling in what the tenant does not override
+func tenantConfig(ctx context.Context) tenantSettings {
+	cfg := config()
+	settings := tenantSettings{
+		SeedFile:         cfg.SeedFile,
+		SeedMode:         cfg.SeedMode,
+		StorefrontURL:    cfg.StorefrontURL,
+		MerchantCurrency: cfg.MerchantCurrency,
+	}
+	id, _ := tenantFromContext(ctx)
+	overrides := tenants()[id]
+	if overrides.SeedFile != "" {
+		settings.SeedFile = overrides.SeedFile
+	}
+	if overrides.SeedMode != "" {
+		settings.SeedMode = overrides.SeedMode
+	}
+	if overrides.StorefrontURL != "" {
+		settings.StorefrontURL = overrides.StorefrontURL
+	}
+	if overrides.MerchantCurrency != "" {
+		settings.MerchantCurrency = overrides.MerchantCurrency
+	}
+	return settings
+}
+
+// tenantScope is the tenant a request works on and where it came from
+type tenantScope struct {
+	ID     string
+	Source string
+}
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, id, source string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantScope{ID: id, Source: source})
+}
+
+// tenantFromContext returns the tenant ctx is scoped to
+func tenantFromContext(ctx context.Context) (string, bool) {
+	scope, ok := ctx.Value(tenantKey{}).(tenantScope)
+	return scope.ID, ok
+}
+
+// requireTenant returns the tenant ctx is scoped to. Repositories refuse to read or write
+// anything without one, so a code path that forgot to scope cannot reach another tenant's data.
+func requireTenant(ctx context.Context) (string, error) {
+	if id, ok := tenantFromContext(ctx); ok {
+		return id, nil
+	}
+	return "", errNoTenant
+}
+
+// scopeTenant scopes ctx to the tenant of a request: the one the caller's credentials are bound
+// to, else the one the request names, else DEFAULT_TENANT. Callers bound to a tenant cannot
+// name another, and while several tenants are served only crossTenant callers may go unbound.
+func scopeTenant(ctx context.Context, p *principal, requested, source string) (context.Context, error) {
+	id := requested
+	switch {
+	case p != nil && p.Tenant != "":
+		if requested != "" && requested != p.Tenant {
+			return ctx, newForbiddenError("The credentials are bound to tenant %s", p.Tenant)
+		}
+		id, source = p.Tenant, tenantSourceCredentials
+	case p != nil && len(tenants()) > 1 && !crossTenant(p, source):
+		return ctx, newForbiddenError("The credentials are not bound to a tenant")
+	case requested == "":
+		id, source = config().DefaultTenant, tenantSourceDefault
+		if id == "" {
+			return ctx, newBadRequestError("No tenant given, set the %s header", tenantHeader)
+		}
+	}
+	if _, ok := tenants()[id]; !ok {
+		return ctx, newNotFoundError("Tenant %s not found", id)
+	}
+	return withTenant(ctx, id, source), nil
+}
+
+// crossTenant reports whether a caller not bound to a tenant may pick one: admins, and the
+// sidecar when it delivers events, which carry their own tenant
+func crossTenant(p *principal, source string) bool {
+	return p.hasRole(roleAdmin) || (p.Method == "dapr-api-token" && source == tenantSourceEvent)
+}
+
+// scopeEventTenant scopes ctx to the tenant named by the tenantid extension of an event. A
+// request delivering the event that already named a tenant may only carry events for it.
+func scopeEventTenant(ctx context.Context, requested string) (context.Context, error) {
+	scope, ok := ctx.Value(tenantKey{}).(tenantScope)
+	if !ok || scope.Source == tenantSourceDefault {
+		p, _ := principalFromContext(ctx)
+		return scopeTenant(ctx, p, requested, tenantSourceEvent)
+	}
+	if requested != "" && requested != scope.ID {
+		return ctx, newForbiddenError("The event is for tenant %s, the request for tenant %s", requested, scope.ID)
+	}
+	return ctx, nil
+}
+
+// resolveTenant scopes every request on a route group to its tenant, once authenticate has
+// identified the caller
+func resolveTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, _ := principalFromContext(c.Request.Context())
+		ctx, err := scopeTenant(c.Request.Context(), p, c.GetHeader(tenantHeader), tenantSourceHeader)
+		if err != nil {
+			abortWithError(c, err)
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// cloudEventTenant returns the tenantid extension of a CloudEvent, empty when it has none
+func cloudEventTenant(event []byte) string {
+	var ce struct {
+		TenantID string `json:"tenantid"`
+	}
+	if json.Unmarshal(event, &ce) != nil {
+		return ""
+	}
+	return ce.TenantID
+}
+
+// eventTenantMiddleware scopes events delivered to the Dapr HTTP service to their tenant.
+// Events for a tenant that is not served are dropped, redelivering them would not help.
+// Bulk deliveries are answered before it, their entries are scoped one tenant at a time.
+func eventTenantMiddleware(subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	routes := subscriptionRoutes(subscriptions)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || !routes[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			// Keep the error, if any, for the handler that reads the body next
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, err := scopeEventTenant(r.Context(), cloudEventTenant(body))
+			if err != nil {
+				slog.WarnContext(r.Context(), "Dropping event for a tenant that is not served", "path", r.URL.Path, "error", err)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"DROP"}`))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// tenantUnaryInterceptor scopes RPCs to their tenant once authUnaryInterceptor has identified
+// the caller: the x-tenant-id metadata names it, or the tenantid extension for OnTopicEvent.
+// Events for a tenant that is not served are dropped.
+func tenantUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if in, ok := req.(*runtimev1pb.TopicEventRequest); ok && info.FullMethod == runtimev1pb.AppCallback_OnTopicEvent_FullMethodName {
+		scoped, err := scopeEventTenant(ctx, in.GetExtensions().GetFields()[tenantExtension].GetStringValue())
+		if err != nil {
+			slog.WarnContext(ctx, "Dropping event for a tenant that is not served", "topic", in.GetTopic(), "eventId", in.GetId(), "error", err)
+			return &runtimev1pb.TopicEventResponse{Status: runtimev1pb.TopicEventResponse_DROP}, nil
+		}
+		return handler(scoped, req)
+	}
+
+	if !tenantScopedRPC(info.FullMethod, req) {
+		return handler(ctx, req)
+	}
+	ctx, err := scopeRPCTenant(ctx)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return handler(ctx, req)
+}
+
+// tenantStreamInterceptor scopes streaming RPCs to the tenant the x-tenant-id metadata names
+func tenantStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !tenantScopedRPC(info.FullMethod, nil) {
+		return handler(srv, stream)
+	}
+	ctx, err := scopeRPCTenant(stream.Context())
+	if err != nil {
+		return grpcError(ctx, err)
+	}
+	return handler(srv, &correlatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// tenantScopedRPC reports whether an RPC works on a catalog, directly or through OnInvoke
+func tenantScopedRPC(method string, req interface{}) bool {
+	if in, ok := req.(*commonv1pb.InvokeRequest); ok && method == runtimev1pb.AppCallback_OnInvoke_FullMethodName {
+		method = "/" + in.GetMethod()
+	}
+	_, ok := grpcMethodRoles[method]
+	return ok
+}
+
+func scopeRPCTenant(ctx context.Context) (context.Context, error) {
+	var requested string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(strings.ToLower(tenantHeader)); len(values) > 0 {
+		requested = values[0]
+	}
+	p, _ := principalFromContext(ctx)
+	return scopeTenant(ctx, p, requested, tenantSourceHeader)
+}
@@ -0,0 +1,213 @@
+// stock-management-app/tracing.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	runtimev1pb "github.com/dapr/dapr/pkg/proto/runtime/v1"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const traceStateHeader = "tracestate"
+
+var tracer = otel.Tracer("stock-management-app")
+
+// setupTracing installs the W3C trace context propagator and a tracer provider exporting to
+// TRACING_EXPORTER. The returned function flushes the spans that are still buffered.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Tracing error", "error", err)
+	}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config().TracingExporter {
+	case "none":
+		// Trace context is still propagated, so callers and the sidecar keep one trace
+		return func(context.Context) error { return nil }, nil
+	case "zipkin":
+		exporter, err = zipkin.New(config().ZipkinEndpoint)
+	case "otlp":
+		exporter, err = otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(config().OTLPEndpoint), otlptracegrpc.WithInsecure())
+	default:
+		return nil, fmt.Errorf("invalid TRACING_EXPORTER %q: expected zipkin, otlp or none", config().TracingExporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the %s exporter: %w", config().TracingExporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", config().ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(float64(config().TracingSamplePercent)/100))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporter", config().TracingExporter, "samplePercent", config().TracingSamplePercent)
+	return provider.Shutdown, nil
+}
+
+// isTracedRequest leaves probes and metrics scrapes out of traces
+func isTracedRequest(r *http.Request) bool {
+	return !isOperationalPath(r.URL.Path)
+}
+
+// withCloudEventTrace makes the publisher's span, taken from the traceparent and tracestate
+// of a CloudEvent, the parent of spans started with the returned context
+func withCloudEventTrace(ctx context.Context, traceParent, traceState string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{traceParentHeader: traceParent, traceStateHeader: traceState}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// cloudEventTraceFields reads the trace context a publisher stored on a CloudEvent
+func cloudEventTraceFields(event []byte) (traceParent, traceState string) {
+	var ce struct {
+		TraceParent string `json:"traceparent"`
+		TraceState  string `json:"tracestate"`
+	}
+	if json.Unmarshal(event, &ce) != nil {
+		return "", ""
+	}
+	return ce.TraceParent, ce.TraceState
+}
+
+// cloudEventTraceRequest continues the publisher's trace for a CloudEvent delivered without
+// a traceparent header. A header, set by the sidecar, is already part of the same trace.
+func cloudEventTraceRequest(r *http.Request) *http.Request {
+	if r.Method != http.MethodPost || r.Body == nil || r.Header.Get(traceParentHeader) != "" {
+		return r
+	}
+
+	body, err := io.ReadAll(r.Body)
+	// Keep the error, if any, for the handler that reads the body next
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return r
+	}
+	traceParent, traceState := cloudEventTraceFields(body)
+	return r.WithContext(withCloudEventTrace(r.Context(), traceParent, traceState))
+}
+
+// cloudEventTraceMiddleware applies cloudEventTraceRequest to event deliveries on the routes
+// of the subscriptions, ahead of the middleware that starts the request span
+func cloudEventTraceMiddleware(subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	routes := subscriptionRoutes(subscriptions)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if routes[r.URL.Path] {
+				r = cloudEventTraceRequest(r)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// cloudEventTrace applies cloudEventTraceRequest to /v1/updateStock, which also accepts CloudEvents
+func cloudEventTrace() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() == apiBasePath+"/updateStock" {
+			c.Request = cloudEventTraceRequest(c.Request)
+		}
+		c.Next()
+	}
+}
+
+// eventSpanMiddleware starts the request span of event deliveries to the Dapr HTTP service,
+// everything else is passed on to Gin, which starts its own spans
+func eventSpanMiddleware(subscriptions []topicSubscription) func(http.Handler) http.Handler {
+	routes := subscriptionRoutes(subscriptions)
+	return otelhttp.NewMiddleware("dapr-event",
+		otelhttp.WithFilter(func(r *http.Request) bool { return routes[r.URL.Path] }),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method + " " + r.URL.Path }))
+}
+
+func subscriptionRoutes(subscriptions []topicSubscription) map[string]bool {
+	routes := make(map[string]bool, len(subscriptions))
+	for _, sub := range subscriptions {
+		routes[sub.Route] = true
+	}
+	return routes
+}
+
+// startEventSpan starts the span of processing one event. It continues the publisher's trace
+// and links to the span of the delivery, which may carry several events; events without a
+// trace context are processed as children of the delivery.
+func startEventSpan(ctx context.Context, topic, traceParent, traceState string) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "dapr"),
+			attribute.String("messaging.destination.name", topic),
+		),
+	}
+	if link := trace.LinkFromContext(ctx); traceParent != "" && link.SpanContext.IsValid() {
+		opts = append(opts, trace.WithLinks(link))
+	}
+	return tracer.Start(withCloudEventTrace(ctx, traceParent, traceState), topic+" process", opts...)
+}
+
+// eventTraceInterceptor wraps OnTopicEvent in a span continuing the publisher's trace, the
+// SDK's gRPC service does not pass the CloudEvent extensions that hold it to the handler
+func eventTraceInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	in, ok := req.(*runtimev1pb.TopicEventRequest)
+	if !ok || info.FullMethod != runtimev1pb.AppCallback_OnTopicEvent_FullMethodName {
+		return handler(ctx, req)
+	}
+
+	fields := in.GetExtensions().GetFields()
+	ctx, span := startEventSpan(ctx, in.GetTopic(), fields[traceParentHeader].GetStringValue(), fields[traceStateHeader].GetStringValue())
+	resp, err := handler(ctx, req)
+	if out, ok := resp.(*runtimev1pb.TopicEventResponse); ok {
+		span.SetAttributes(attribute.String("dapr.event.status", out.GetStatus().String()))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// startClientSpan starts the span of a sidecar call and passes its trace context on in the
+// gRPC metadata, so the sidecar's own spans and published events join the trace
+func startClientSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for key, value := range carrier {
+		ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+	}
+	return ctx, span
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,103 @@
+// stock-management-app/validation.go
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes why a single field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is the list of field errors found in a request
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateProduct applies the product rules used by the API, imports and seeding
+func validateProduct(product Product) ValidationErrors {
+	errs := ValidationErrors{}
+
+	if product.Id <= 0 {
+		errs.add("id", "must be a positive integer")
+	}
+
+	name := strings.TrimSpace(product.Name)
+	switch {
+	case name == "":
+		errs.add("name", "is required")
+	case utf8.RuneCountInString(name) > config().MaxProductNameLength:
+		errs.add("name", "must be at most %d characters", config().MaxProductNameLength)
+	}
+
+	if product.Price < 0 {
+		errs.add("price", "must not be negative")
+	}
+	if product.Quantity < 0 {
+		errs.add("quantity", "must not be negative")
+	}
+
+	if product.ImageUrl != "" {
+		if u, err := url.Parse(product.ImageUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("imageUrl", "must be an absolute http or https URL")
+		}
+	}
+
+	if len(product.Tags) > config().MaxProductTags {
+		errs.add("tags", "must have at most %d entries", config().MaxProductTags)
+	}
+	seen := make(map[string]bool, len(product.Tags))
+	for i, tag := range product.Tags {
+		field := fmt.Sprintf("tags[%d]", i)
+		normalized := strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case normalized == "":
+			errs.add(field, "must not be empty")
+		case utf8.RuneCountInString(normalized) > config().MaxProductTagLength:
+			errs.add(field, "must be at most %d characters", config().MaxProductTagLength)
+		case seen[normalized]:
+			errs.add(field, "duplicates tag %q", tag)
+		}
+		seen[normalized] = true
+	}
+
+	return errs
+}
+
+// validateStockUpdateRequest checks every update before any of them is applied
+func validateStockUpdateRequest(req StockUpdateRequest) ValidationErrors {
+	errs := ValidationErrors{}
+
+	if len(req.Updates) == 0 {
+		errs.add("updates", "must contain at least one update")
+	}
+	if limit := config().MaxStockUpdates; len(req.Updates) > limit {
+		errs.add("updates", "must contain at most %d updates", limit)
+	}
+	for i, update := range req.Updates {
+		if update.Id <= 0 {
+			errs.add(fmt.Sprintf("updates[%d].id", i), "must be a positive integer")
+		}
+		if update.PurchaseQty <= 0 {
+			errs.add(fmt.Sprintf("updates[%d].purchaseQty", i), "must be greater than zero")
+		}
+	}
+
+	return errs
+}
@@ -13,7 +13,7 @@ export async function GET(request, { params }) {
 
     const client = new DaprClient(daprHost, daprPort);
     const serviceAppId = "stock-management-app";
-    const serviceMethod = `product/${productId}`;
+    const serviceMethod = `v1/product/${productId}`;
 
     console.log(`Preparing to invoke service with App ID: ${serviceAppId} and Method: ${serviceMethod}`);
 
@@ -23,7 +23,8 @@ export async function GET(request, { params }) {
 
     console.log(`Response received for product ID ${productId} from service:`, response);
 
-    const data = response;
+    // The stock service wraps results in a versioned envelope: { apiVersion, status, data }
+    const data = response.data;
     console.log(`Data received for product ID ${productId}:`, data);
 
     console.log(`Sending response back with data for product ID ${productId}`);
@@ -11,7 +11,7 @@ export async function GET() {
   const client = new DaprClient(daprHost, daprPort);
 
   const serviceAppId = "stock-management-app";
-  const serviceMethod = "products";
+  const serviceMethod = "v1/products";
   console.log("Preparing to invoke service with App ID:", serviceAppId, "and Method:", serviceMethod);
 
   try {
@@ -19,7 +19,8 @@ export async function GET() {
     const response = await client.invoker.invoke(serviceAppId, serviceMethod, HttpMethod.GET);
     console.log("Response received from service:", response);
 
-    const data = response;
+    // The stock service wraps results in a versioned envelope: { apiVersion, status, data }
+    const data = response.data;
     console.log("Processing response data:", data);
 
     console.log("Returning response with no-store cache setting...");